@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+const (
+	// authCommandTTL is how long credentials without an expiry are reused.
+	authCommandTTL = 10 * time.Minute
+	// authCommandRefresh is how long before expiry the command runs again.
+	authCommandRefresh = time.Minute
+	// authCommandTimeout bounds a single run of the command.
+	authCommandTimeout = 30 * time.Second
+)
+
+// authCommandOutput is the JSON printed by -auth-command. Either username
+// and password or a bearer token are expected; the expiry is optional.
+type authCommandOutput struct {
+	Username  string    `json:"username"`
+	Password  string    `json:"password"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+var commandAuth struct {
+	mu      sync.Mutex
+	auth    types.AuthConfig
+	expires time.Time
+}
+
+// authFromCommand returns the credentials printed by -auth-command, running
+// it again only when the cached ones are about to expire.
+func authFromCommand(serverAddress string) (types.AuthConfig, error) {
+	commandAuth.mu.Lock()
+	defer commandAuth.mu.Unlock()
+	if time.Until(commandAuth.expires) > authCommandRefresh {
+		return commandAuth.auth, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), authCommandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", *authCommand)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return types.AuthConfig{}, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	var parsed authCommandOutput
+	if err := json.Unmarshal(out, &parsed); err != nil {
+		return types.AuthConfig{}, fmt.Errorf("decode output: %w", err)
+	}
+	auth := types.AuthConfig{
+		Username:      parsed.Username,
+		Password:      parsed.Password,
+		RegistryToken: parsed.Token,
+		ServerAddress: serverAddress,
+	}
+	if !hasCredentials(auth) {
+		return types.AuthConfig{}, fmt.Errorf("output has neither username and password nor token")
+	}
+
+	expires := parsed.ExpiresAt
+	if expires.IsZero() {
+		expires = time.Now().Add(authCommandTTL)
+	}
+	commandAuth.auth, commandAuth.expires = auth, expires
+	logVerbose("Obtained registry credentials from -auth-command, valid until %s", expires.Format(time.RFC3339))
+	return auth, nil
+}
+
+// currentAuth returns auth with the -auth-command credentials brought up to
+// date, so a pull late in a long cycle does not send an expired token.
+func currentAuth(auth types.AuthConfig) types.AuthConfig {
+	if *authCommand == "" {
+		return auth
+	}
+	fresh, err := authFromCommand(auth.ServerAddress)
+	if err != nil {
+		logWarn("-auth-command failed, pulling anonymously: %v", err)
+		return types.AuthConfig{}
+	}
+	return fresh
+}
+
+// expireCredentials drops cached -auth-command and credential helper
+// answers after a registry rejected them. It reports whether there were
+// any, i.e. whether retrying with fresh credentials can help.
+func expireCredentials() bool {
+	expired := false
+	if *authCommand != "" {
+		commandAuth.mu.Lock()
+		commandAuth.expires = time.Time{}
+		commandAuth.mu.Unlock()
+		expired = true
+	}
+	if dockerCredentials != nil && dockerCredentials.expireHelpers() {
+		expired = true
+	}
+	return expired
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+// withAuthCommand sets -auth-command to a script printing output and
+// counting its runs in the returned file, with no credentials cached.
+func withAuthCommand(t *testing.T, output string, exit int) string {
+	t.Helper()
+	dir := t.TempDir()
+	runs := filepath.Join(dir, "runs")
+	script := filepath.Join(dir, "auth.sh")
+	body := fmt.Sprintf("#!/bin/sh\necho run >> '%s'\necho '%s'\nexit %d\n", runs, output, exit)
+	if err := os.WriteFile(script, []byte(body), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	old := *authCommand
+	*authCommand = script
+	resetCommandAuth()
+	t.Cleanup(func() {
+		*authCommand = old
+		resetCommandAuth()
+	})
+	return runs
+}
+
+func resetCommandAuth() {
+	commandAuth.mu.Lock()
+	defer commandAuth.mu.Unlock()
+	commandAuth.auth = types.AuthConfig{}
+	commandAuth.expires = time.Time{}
+}
+
+// commandRuns returns how often the script from withAuthCommand ran.
+func commandRuns(t *testing.T, runs string) int {
+	t.Helper()
+	data, err := os.ReadFile(runs)
+	if os.IsNotExist(err) {
+		return 0
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Count(string(data), "run\n")
+}
+
+func TestAuthCommandCredentials(t *testing.T) {
+	runs := withAuthCommand(t, `{"username":"AWS","password":"ecr-token"}`, 0)
+
+	auth := buildAuthConfig("123456789012.dkr.ecr.eu-west-1.amazonaws.com", "static", "ignored")
+	if auth.Username != "AWS" || auth.Password != "ecr-token" {
+		t.Errorf("credentials = %q/%q, want the command's", auth.Username, auth.Password)
+	}
+	if auth.ServerAddress != "123456789012.dkr.ecr.eu-west-1.amazonaws.com" {
+		t.Errorf("ServerAddress = %q", auth.ServerAddress)
+	}
+	if again := currentAuth(auth); again.Password != "ecr-token" {
+		t.Errorf("cached credentials = %+v", again)
+	}
+	if n := commandRuns(t, runs); n != 1 {
+		t.Errorf("command ran %d times, want 1 while the credentials are fresh", n)
+	}
+
+	// Close to expiry the command runs again.
+	commandAuth.mu.Lock()
+	commandAuth.expires = time.Now().Add(authCommandRefresh / 2)
+	commandAuth.mu.Unlock()
+	currentAuth(auth)
+	if n := commandRuns(t, runs); n != 2 {
+		t.Errorf("command ran %d times, want 2 after the credentials neared expiry", n)
+	}
+}
+
+func TestAuthCommandToken(t *testing.T) {
+	expires := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	withAuthCommand(t, `{"token":"bearer-token","expiresAt":"`+expires.Format(time.RFC3339)+`"}`, 0)
+
+	auth := buildAuthConfig("europe-docker.pkg.dev", "", "")
+	if auth.RegistryToken != "bearer-token" || auth.Username != "" {
+		t.Errorf("auth = %+v, want the bearer token", auth)
+	}
+	if got := commandAuth.expires; !got.Equal(expires) {
+		t.Errorf("credentials expire at %s, want %s from the output", got, expires)
+	}
+}
+
+func TestAuthCommandFailureFallsBackToAnonymous(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		exit   int
+	}{
+		{"command fails", `{"username":"AWS","password":"ecr-token"}`, 1},
+		{"output is not JSON", `not json`, 0},
+		{"output has no credentials", `{"expiresAt":"2030-01-01T00:00:00Z"}`, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withAuthCommand(t, tt.output, tt.exit)
+			logs := captureLog(t, levelInfo)
+			if auth := buildAuthConfig("registry.example.com", "static", "secret"); hasCredentials(auth) {
+				t.Errorf("auth = %+v, want anonymous", auth)
+			}
+			if !strings.Contains(logs.String(), "-auth-command failed, pulling anonymously") {
+				t.Errorf("no warning logged:\n%s", logs)
+			}
+		})
+	}
+}
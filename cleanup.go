@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+)
+
+// Modes selectable with -cleanup-mode.
+const (
+	cleanupReplaced = "replaced"
+	cleanupPrune    = "prune"
+)
+
+// historyLimit returns how many previous images are kept per container as
+// rollback targets or for -keep-images; 0 means none are.
+func historyLimit() int {
+	limit := *keepImages
+	if *rollback && *rollbackHistory > limit {
+		limit = *rollbackHistory
+	}
+	return limit
+}
+
+// cleanupImages removes old images after an update. In replaced mode only the
+// given image IDs are removed, and only while no other container uses them;
+// in prune mode all dangling images are pruned.
+func cleanupImages(cli *client.Client, ctx context.Context, replaced []string) error {
+	if *cleanupMode == cleanupPrune {
+		logVerbose("Pruning dangling images")
+		pruneCtx, cancel := withAPITimeout(ctx)
+		pruned, err := cli.ImagesPrune(pruneCtx, filters.NewArgs())
+		cancel()
+		if err != nil {
+			return err
+		}
+		if len(pruned.ImagesDeleted) > 0 {
+			logInfo("Cleaned up %d images, reclaimed %d bytes", len(pruned.ImagesDeleted), pruned.SpaceReclaimed)
+		}
+		return nil
+	}
+
+	if len(replaced) == 0 {
+		return nil
+	}
+	listCtx, cancel := withAPITimeout(ctx)
+	containers, err := cli.ContainerList(listCtx, types.ContainerListOptions{All: true})
+	cancel()
+	if err != nil {
+		return fmt.Errorf("list containers: %w", err)
+	}
+	inUse := make(map[string]bool)
+	for _, c := range containers {
+		inUse[c.ImageID] = true
+	}
+
+	for _, id := range replaced {
+		if inUse[id] {
+			logVerbose("Keeping image %s: still used by another container", id)
+			continue
+		}
+		removeCtx, cancel := withAPITimeout(ctx)
+		_, err := cli.ImageRemove(removeCtx, id, types.ImageRemoveOptions{PruneChildren: true})
+		cancel()
+		if err != nil {
+			// Images with other tags or dependent images are expected to be
+			// refused by the daemon; they are left alone.
+			logVerbose("Keeping image %s: %v", id, err)
+			continue
+		}
+		logInfo("Removed replaced image %s", id)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+const otherImageID = "sha256:3333333333333333333333333333333333333333333333333333333333333333"
+
+// withCleanup enables -cleanup in mode for the duration of a test.
+func withCleanup(t *testing.T, mode string) {
+	t.Helper()
+	oldCleanup, oldMode := *cleanup, *cleanupMode
+	*cleanup, *cleanupMode = true, mode
+	t.Cleanup(func() { *cleanup, *cleanupMode = oldCleanup, oldMode })
+}
+
+func TestCleanupReplacedRemovesOnlyUnusedReplacedImages(t *testing.T) {
+	withCleanup(t, cleanupReplaced)
+	d, cli := newFakeDocker(t)
+	d.addImage(oldImageID, "2024-01-01T00:00:00Z")
+	d.addImage(newImageID, "2024-02-01T00:00:00Z", "nginx:latest")
+	d.addImage(otherImageID, "2023-12-01T00:00:00Z")
+	// Another container still runs the old image of the second replaced one.
+	d.addContainer(testContainer("web-id", "web", "nginx:latest", newImageID))
+	d.addContainer(testContainer("api-id", "api", "nginx:1.24", newImageID))
+
+	if err := cleanupImages(cli, context.Background(), []string{oldImageID, newImageID}); err != nil {
+		t.Fatalf("cleanupImages: %v", err)
+	}
+	if !d.called("DELETE /images/" + oldImageID) {
+		t.Errorf("replaced image %s not removed", oldImageID)
+	}
+	if d.called("DELETE /images/" + newImageID) {
+		t.Errorf("image %s removed although containers use it", newImageID)
+	}
+	if d.called("DELETE /images/"+otherImageID) || d.called("POST /images/prune") {
+		t.Error("an image that was not replaced was removed")
+	}
+	if _, ok := d.images[otherImageID]; !ok {
+		t.Error("unrelated dangling image is gone")
+	}
+}
+
+func TestCleanupPruneRemovesDanglingImages(t *testing.T) {
+	withCleanup(t, cleanupPrune)
+	d, cli := newFakeDocker(t)
+	d.addImage(oldImageID, "2024-01-01T00:00:00Z")
+	d.addImage(newImageID, "2024-02-01T00:00:00Z", "nginx:latest")
+	d.addImage(otherImageID, "2023-12-01T00:00:00Z")
+	d.addContainer(testContainer("web-id", "web", "nginx:latest", newImageID))
+
+	if err := cleanupImages(cli, context.Background(), []string{oldImageID}); err != nil {
+		t.Fatalf("cleanupImages: %v", err)
+	}
+	if d.count("POST /images/prune") != 1 {
+		t.Error("dangling images were not pruned")
+	}
+	if d.called("DELETE /images/" + oldImageID) {
+		t.Error("prune mode removed the replaced image by ID")
+	}
+	for _, id := range []string{oldImageID, otherImageID} {
+		if _, ok := d.images[id]; ok {
+			t.Errorf("dangling image %s kept", id)
+		}
+	}
+	if _, ok := d.images[newImageID]; !ok {
+		t.Error("tagged image in use was pruned")
+	}
+}
+
+func TestCheckCleansUpReplacedImage(t *testing.T) {
+	withCleanup(t, cleanupReplaced)
+	d, cli := withUpdate(t)
+	d.addImage(otherImageID, "2023-12-01T00:00:00Z")
+
+	if err := checkContainers(cli, "", "", "", "", NoopNotifier{}); err != nil {
+		t.Fatalf("checkContainers: %v", err)
+	}
+	if !d.called("DELETE /images/" + oldImageID) {
+		t.Errorf("image %s of the updated container not removed", oldImageID)
+	}
+	if d.called("DELETE /images/" + otherImageID) {
+		t.Error("unrelated image removed")
+	}
+}
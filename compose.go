@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/docker/docker/client"
+)
+
+// composeRecreate updates a Compose container through composeUp, with the
+// same steps around it as recreateContainer: containers started with --rm
+// are refused, the pre- and post-update hooks run, stopped containers stay
+// stopped unless -start-stopped is set, and the new container has to become
+// healthy within -health-timeout.
+func composeRecreate(cli *client.Client, ctx context.Context, containerID, name string, labels map[string]string) error {
+	callCtx, cancel := withAPITimeout(ctx)
+	inspect, err := cli.ContainerInspect(callCtx, containerID)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("inspect failed: %w", err)
+	}
+	if inspect.HostConfig.AutoRemove {
+		return errAutoRemove
+	}
+	if err := runPreUpdateHook(cli, ctx, inspect, name); err != nil {
+		return err
+	}
+
+	start := inspect.State.Running || *startStopped
+	if err := composeUp(ctx, cli.DaemonHost(), labels, start); err != nil {
+		return err
+	}
+
+	// Compose keeps the container name, which now belongs to the new one.
+	callCtx, cancel = withAPITimeout(ctx)
+	created, err := cli.ContainerInspect(callCtx, name)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("inspect recreated container: %w", err)
+	}
+	noteOwnEvent(created.ID)
+	if !start {
+		logInfo("Container %s was %s before the update, leaving it stopped", name, inspect.State.Status)
+		return nil
+	}
+
+	if *healthTimeout > 0 && hasHealthcheck(created.Config) {
+		if err := waitForHealthy(cli, ctx, created.ID, *healthTimeout); err != nil {
+			return &healthCheckError{containerID: created.ID, previousImage: inspect.Config.Image, previousImageID: inspect.Image, err: err}
+		}
+		logVerbose("Container %s is healthy", name)
+	}
+	runPostUpdateHook(cli, ctx, created.ID, name, inspect.Config.Labels)
+	return nil
+}
+
+// composeUp updates a Compose service by running docker compose up for it,
+// so Compose itself recreates the container from the pulled image, and
+// starts it when start is set. The project files are located through the
+// labels Compose sets on the container, and must be readable at the same
+// paths by the puller.
+func composeUp(ctx context.Context, dockerHost string, labels map[string]string, start bool) error {
+	args := []string{"compose", "-p", labels[composeProjectLabel]}
+	if dir := labels[composeWorkingDirLabel]; dir != "" {
+		args = append(args, "--project-directory", dir)
+	}
+	for _, file := range strings.Split(labels[composeConfigFilesLabel], ",") {
+		if file = strings.TrimSpace(file); file != "" {
+			args = append(args, "-f", file)
+		}
+	}
+	args = append(args, "up")
+	if start {
+		args = append(args, "-d")
+	} else {
+		args = append(args, "--no-start")
+	}
+	args = append(args, "--no-deps", "--force-recreate", "--pull", "never", labels[composeServiceLabel])
+
+	// Compose stops the old container and starts the new one, which can take
+	// much longer than a single API call.
+	if *composeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *composeTimeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, "docker", args...)
+	cmd.Env = append(os.Environ(), "DOCKER_HOST="+dockerHost)
+	logVerbose("Running docker %s", strings.Join(args, " "))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("docker compose up failed: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	logVerbose("docker compose output: %s", strings.TrimSpace(string(out)))
+	return nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+)
+
+// fakeDockerCLI puts a docker executable running script first on PATH.
+func fakeDockerCLI(t *testing.T, script string) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "docker"), []byte("#!/bin/sh\n"+script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return dir
+}
+
+func TestComposeUp(t *testing.T) {
+	dir := fakeDockerCLI(t, `echo "$DOCKER_HOST $*" > "$(dirname "$0")/args"`)
+	labels := map[string]string{
+		composeProjectLabel:     "shop",
+		composeServiceLabel:     "web",
+		composeWorkingDirLabel:  "/srv/shop",
+		composeConfigFilesLabel: "/srv/shop/compose.yml, /srv/shop/compose.prod.yml",
+	}
+	if err := composeUp(context.Background(), "unix:///var/run/docker.sock", labels, true); err != nil {
+		t.Fatalf("composeUp: %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "args"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "unix:///var/run/docker.sock compose -p shop --project-directory /srv/shop -f /srv/shop/compose.yml -f /srv/shop/compose.prod.yml up -d --no-deps --force-recreate --pull never web"
+	if strings.TrimSpace(string(got)) != want {
+		t.Errorf("ran docker %s\nwant %s", got, want)
+	}
+}
+
+func TestComposeUpFailures(t *testing.T) {
+	labels := map[string]string{composeProjectLabel: "shop", composeServiceLabel: "web"}
+
+	fakeDockerCLI(t, `echo "no such service: web" >&2; exit 1`)
+	err := composeUp(context.Background(), "", labels, true)
+	if err == nil || !strings.Contains(err.Error(), "no such service: web") {
+		t.Errorf("failing compose: got %v, want its output in the error", err)
+	}
+
+	// A hanging compose run is bounded by -compose-timeout, not -api-timeout.
+	fakeDockerCLI(t, `exec sleep 10`)
+	oldCompose, oldAPI := *composeTimeout, *apiTimeout
+	*composeTimeout, *apiTimeout = 100*time.Millisecond, time.Hour
+	defer func() { *composeTimeout, *apiTimeout = oldCompose, oldAPI }()
+	start := time.Now()
+	if err := composeUp(context.Background(), "", labels, true); err == nil {
+		t.Error("hanging compose run succeeded")
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("compose run was stopped after %s, want about -compose-timeout", took)
+	}
+}
+
+// fakeCompose puts a docker executable first on PATH that acts like
+// docker compose up against the fake daemon: it replaces the container
+// named web with a new one from nginx:latest, started unless --no-start is
+// given. It returns the file the arguments are written to.
+func fakeCompose(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("curl"); err != nil {
+		t.Skip("curl is needed to fake docker compose")
+	}
+	dir := fakeDockerCLI(t, `api="http://${DOCKER_HOST#tcp://}/v1.43"
+echo "$*" > "$(dirname "$0")/args"
+curl -sf -X DELETE "$api/containers/web" >/dev/null || exit 1
+curl -sf -X POST -H 'Content-Type: application/json' \
+	-d '{"Image":"nginx:latest","Labels":{"com.docker.compose.project":"shop","com.docker.compose.service":"web"},"Healthcheck":{"Test":["CMD","true"]}}' \
+	"$api/containers/create?name=web" >/dev/null || exit 1
+case "$*" in
+*--no-start*) ;;
+*) curl -sf -X POST "$api/containers/web/start" >/dev/null || exit 1 ;;
+esac
+`)
+	return filepath.Join(dir, "args")
+}
+
+// withComposeContainer sets up web as the Compose service shop/web running
+// oldImageID, with newImageID pulled as nginx:latest.
+func withComposeContainer(t *testing.T, modify func(c *types.ContainerJSON)) (*fakeDocker, *client.Client) {
+	t.Helper()
+	d, cli := newFakeDocker(t)
+	d.addImage(oldImageID, "2024-01-01T00:00:00Z")
+	d.addImage(newImageID, "2024-02-01T00:00:00Z", "nginx:latest")
+	c := testContainer("old", "web", "nginx:latest", oldImageID)
+	c.Config.Labels = map[string]string{composeProjectLabel: "shop", composeServiceLabel: "web"}
+	c.Config.Healthcheck = &container.HealthConfig{Test: []string{"CMD", "true"}}
+	if modify != nil {
+		modify(&c)
+	}
+	d.addContainer(c)
+	oldTimeout := *healthTimeout
+	*healthTimeout = 5 * time.Second
+	t.Cleanup(func() { *healthTimeout = oldTimeout })
+	return d, cli
+}
+
+func TestComposeRecreate(t *testing.T) {
+	args := fakeCompose(t)
+	d, cli := withComposeContainer(t, nil)
+
+	if err := composeRecreate(cli, context.Background(), "old", "web", d.container("web").Config.Labels); err != nil {
+		t.Fatalf("composeRecreate: %v", err)
+	}
+	recreated := d.container("web")
+	if recreated == nil || recreated.ID == "old" || !recreated.State.Running || recreated.Image != newImageID {
+		t.Errorf("web was not recreated and started on the new image: %+v", recreated)
+	}
+	if got, _ := os.ReadFile(args); !strings.Contains(string(got), " up -d ") {
+		t.Errorf("ran docker %s, want up -d", got)
+	}
+}
+
+func TestComposeRecreateWaitsForHealth(t *testing.T) {
+	fakeCompose(t)
+	d, cli := withComposeContainer(t, nil)
+	d.unhealthy[newImageID] = true
+
+	err := composeRecreate(cli, context.Background(), "old", "web", d.container("web").Config.Labels)
+	var healthErr *healthCheckError
+	if !errors.As(err, &healthErr) {
+		t.Fatalf("got %v, want a health check error", err)
+	}
+	if healthErr.containerID != d.container("web").ID || healthErr.previousImageID != oldImageID {
+		t.Errorf("health check error for %s from %s, want the new container from %s", healthErr.containerID, healthErr.previousImageID, oldImageID)
+	}
+}
+
+func TestComposeRecreateKeepsStoppedContainersStopped(t *testing.T) {
+	args := fakeCompose(t)
+	d, cli := withComposeContainer(t, func(c *types.ContainerJSON) {
+		c.State = &types.ContainerState{Status: "exited"}
+	})
+
+	if err := composeRecreate(cli, context.Background(), "old", "web", d.container("web").Config.Labels); err != nil {
+		t.Fatalf("composeRecreate: %v", err)
+	}
+	if recreated := d.container("web"); recreated.ID == "old" || recreated.State.Running {
+		t.Errorf("web was not recreated stopped: %+v", recreated.State)
+	}
+	if got, _ := os.ReadFile(args); !strings.Contains(string(got), " up --no-start ") {
+		t.Errorf("ran docker %s, want up --no-start", got)
+	}
+}
+
+func TestComposeRecreateGuards(t *testing.T) {
+	t.Run("--rm", func(t *testing.T) {
+		args := fakeCompose(t)
+		d, cli := withComposeContainer(t, func(c *types.ContainerJSON) { c.HostConfig.AutoRemove = true })
+		err := composeRecreate(cli, context.Background(), "old", "web", d.container("web").Config.Labels)
+		if !errors.Is(err, errAutoRemove) {
+			t.Errorf("got %v, want errAutoRemove", err)
+		}
+		if _, err := os.Stat(args); err == nil {
+			t.Error("docker compose ran for a container started with --rm")
+		}
+	})
+
+	t.Run("failing pre-update hook", func(t *testing.T) {
+		args := fakeCompose(t)
+		d, cli := withComposeContainer(t, func(c *types.ContainerJSON) { c.Config.Labels[preHookLabel] = "exit 1" })
+		err := composeRecreate(cli, context.Background(), "old", "web", d.container("web").Config.Labels)
+		if err == nil || !strings.Contains(err.Error(), "pre-update hook failed") {
+			t.Errorf("got %v, want the pre-update hook failure", err)
+		}
+		if _, err := os.Stat(args); err == nil {
+			t.Error("docker compose ran although the pre-update hook failed")
+		}
+		if !d.called("POST /containers/old/exec") {
+			t.Error("the pre-update hook did not run in the old container")
+		}
+	})
+}
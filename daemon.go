@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/tlsconfig"
+)
+
+// dockerClientOptions returns the options for the Docker client. The
+// environment (DOCKER_HOST, DOCKER_TLS_VERIFY, DOCKER_CERT_PATH) is used
+// unless -docker-host or the -tls-* flags override it.
+func dockerClientOptions() ([]client.Opt, error) {
+	opts := []client.Opt{client.FromEnv, client.WithAPIVersionNegotiation()}
+
+	if (*tlsCert == "") != (*tlsKey == "") {
+		return nil, errors.New("-tls-cert and -tls-key must be given together")
+	}
+
+	host := *dockerHost
+	if *tlsCACert != "" || *tlsCert != "" || flagWasSet("tls-verify") {
+		tlsCfg, err := tlsconfig.Client(tlsconfig.Options{
+			CAFile:             *tlsCACert,
+			CertFile:           *tlsCert,
+			KeyFile:            *tlsKey,
+			ExclusiveRootPools: *tlsCACert != "",
+			InsecureSkipVerify: !*tlsVerify,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("load TLS configuration: %w", err)
+		}
+		opts = append(opts, client.WithHTTPClient(&http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsCfg},
+		}))
+
+		// The replaced transport has to be configured for the daemon
+		// address again, so the host is always applied after it.
+		if host == "" {
+			host = os.Getenv("DOCKER_HOST")
+		}
+		if host == "" {
+			host = client.DefaultDockerHost
+		}
+	}
+	if host != "" {
+		opts = append(opts, client.WithHost(host))
+	}
+	return opts, nil
+}
+
+// defaultStopGrace is how long the daemon waits for a container to stop
+// before killing it when no stop timeout is configured.
+const defaultStopGrace = 10 * time.Second
+
+// withAPITimeout bounds a single Docker API call by -api-timeout plus any
+// extra time the call is expected to take.
+func withAPITimeout(ctx context.Context, extra ...time.Duration) (context.Context, context.CancelFunc) {
+	if *apiTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	timeout := *apiTimeout
+	for _, d := range extra {
+		timeout += d
+	}
+	return context.WithTimeout(ctx, timeout)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+// writeTestCert writes a self-signed certificate and its key to dir.
+func writeTestCert(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "puller-test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// withDaemonFlags sets the daemon connection flags for the duration of a test.
+func withDaemonFlags(t *testing.T, host, caCert, cert, key string) {
+	t.Helper()
+	oldHost, oldCA, oldCert, oldKey := *dockerHost, *tlsCACert, *tlsCert, *tlsKey
+	*dockerHost, *tlsCACert, *tlsCert, *tlsKey = host, caCert, cert, key
+	t.Cleanup(func() {
+		*dockerHost, *tlsCACert, *tlsCert, *tlsKey = oldHost, oldCA, oldCert, oldKey
+	})
+}
+
+func TestDockerClientOptionsRequiresCertAndKey(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, t.TempDir())
+	tests := []struct {
+		name      string
+		cert, key string
+	}{
+		{"cert without key", certFile, ""},
+		{"key without cert", "", keyFile},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withDaemonFlags(t, "tcp://docker.example.com:2376", "", tt.cert, tt.key)
+			if _, err := dockerClientOptions(); err == nil {
+				t.Fatal("dockerClientOptions accepted an incomplete client certificate")
+			}
+		})
+	}
+}
+
+func TestDockerClientOptionsFromFlags(t *testing.T) {
+	t.Setenv("DOCKER_HOST", "")
+	t.Setenv("DOCKER_TLS_VERIFY", "")
+	t.Setenv("DOCKER_CERT_PATH", "")
+	certFile, keyFile := writeTestCert(t, t.TempDir())
+
+	t.Run("host only", func(t *testing.T) {
+		withDaemonFlags(t, "tcp://docker.example.com:2375", "", "", "")
+		cli := newTestClient(t)
+		if got := cli.DaemonHost(); got != "tcp://docker.example.com:2375" {
+			t.Errorf("DaemonHost() = %q", got)
+		}
+	})
+
+	t.Run("mutual TLS", func(t *testing.T) {
+		withDaemonFlags(t, "tcp://docker.example.com:2376", certFile, certFile, keyFile)
+		cli := newTestClient(t)
+		if got := cli.DaemonHost(); got != "tcp://docker.example.com:2376" {
+			t.Errorf("DaemonHost() = %q", got)
+		}
+		transport, ok := cli.HTTPClient().Transport.(*http.Transport)
+		if !ok || transport.TLSClientConfig == nil {
+			t.Fatalf("client transport %T has no TLS configuration", cli.HTTPClient().Transport)
+		}
+		tlsCfg := transport.TLSClientConfig
+		if len(tlsCfg.Certificates) != 1 {
+			t.Errorf("client certificates = %d, want 1", len(tlsCfg.Certificates))
+		}
+		if tlsCfg.RootCAs == nil {
+			t.Error("the -tls-cacert pool is not used")
+		}
+		if tlsCfg.InsecureSkipVerify {
+			t.Error("daemon certificate verification is disabled")
+		}
+	})
+
+	t.Run("TLS falls back to DOCKER_HOST", func(t *testing.T) {
+		t.Setenv("DOCKER_HOST", "tcp://env.example.com:2376")
+		withDaemonFlags(t, "", certFile, "", "")
+		if got := newTestClient(t).DaemonHost(); got != "tcp://env.example.com:2376" {
+			t.Errorf("DaemonHost() = %q, want the DOCKER_HOST address", got)
+		}
+	})
+
+	t.Run("unreadable CA", func(t *testing.T) {
+		withDaemonFlags(t, "tcp://docker.example.com:2376", filepath.Join(t.TempDir(), "missing.pem"), "", "")
+		if _, err := dockerClientOptions(); err == nil {
+			t.Fatal("dockerClientOptions accepted a missing CA file")
+		}
+	})
+}
+
+// newTestClient builds a client from the current flags.
+func newTestClient(t *testing.T) *client.Client {
+	t.Helper()
+	opts, err := dockerClientOptions()
+	if err != nil {
+		t.Fatalf("dockerClientOptions: %v", err)
+	}
+	cli, err := client.NewClientWithOpts(opts...)
+	if err != nil {
+		t.Fatalf("NewClientWithOpts: %v", err)
+	}
+	t.Cleanup(func() { cli.Close() })
+	return cli
+}
+
+func TestAPITimeoutBoundsBlockedCalls(t *testing.T) {
+	old := *apiTimeout
+	*apiTimeout = 100 * time.Millisecond
+	defer func() { *apiTimeout = old }()
+
+	d, cli := withUpdate(t)
+	d.hang("GET /containers/old/json")
+
+	started := time.Now()
+	err := recreateContainer(cli, context.Background(), "old", "web", "")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Errorf("returned after %s, want about %s", elapsed, *apiTimeout)
+	}
+	if d.container("web").ID != "old" {
+		t.Error("container changed although its inspect timed out")
+	}
+}
+
+func TestWithAPITimeout(t *testing.T) {
+	old := *apiTimeout
+	defer func() { *apiTimeout = old }()
+
+	*apiTimeout = time.Minute
+	ctx, cancel := withAPITimeout(context.Background(), 30*time.Second)
+	deadline, ok := ctx.Deadline()
+	cancel()
+	if remaining := time.Until(deadline); !ok || remaining <= time.Minute || remaining > 90*time.Second {
+		t.Errorf("deadline in %s (set %v), want 90s", remaining, ok)
+	}
+
+	*apiTimeout = 0
+	ctx, cancel = withAPITimeout(context.Background(), 30*time.Second)
+	_, ok = ctx.Deadline()
+	cancel()
+	if ok {
+		t.Error("-api-timeout 0 set a deadline")
+	}
+}
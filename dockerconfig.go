@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types"
+)
+
+// helperCacheTTL bounds how long credentials from a credential helper are
+// reused. Helpers such as the ECR one hand out short-lived tokens.
+const helperCacheTTL = 5 * time.Minute
+
+// dockerHubServer is the key the docker CLI stores Docker Hub credentials under.
+const dockerHubServer = "https://index.docker.io/v1/"
+
+// dockerConfig is the part of the docker CLI config.json holding registry
+// credentials.
+type dockerConfig struct {
+	Auths       map[string]dockerConfigAuth `json:"auths"`
+	CredsStore  string                      `json:"credsStore"`
+	CredHelpers map[string]string           `json:"credHelpers"`
+
+	mu     sync.Mutex
+	cached map[string]cachedCredentials
+}
+
+type dockerConfigAuth struct {
+	Auth          string `json:"auth"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	IdentityToken string `json:"identitytoken"`
+}
+
+type cachedCredentials struct {
+	auth    types.AuthConfig
+	expires time.Time
+}
+
+// dockerCredentials is loaded from -docker-config; nil when not configured.
+var dockerCredentials *dockerConfig
+
+// loadDockerConfig reads a docker CLI config file. path may also name the
+// directory containing config.json.
+func loadDockerConfig(path string) (*dockerConfig, error) {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		path = filepath.Join(path, "config.json")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &dockerConfig{cached: make(map[string]cachedCredentials)}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// normalizeRegistry reduces a config key or registry host such as
+// "https://index.docker.io/v1/" or "registry-1.docker.io" to the registry
+// domain used in image references.
+func normalizeRegistry(server string) string {
+	if u, err := url.Parse(server); err == nil && u.Host != "" {
+		server = u.Host
+	}
+	server, _, _ = strings.Cut(server, "/")
+	switch server {
+	case "index.docker.io", "registry-1.docker.io":
+		return "docker.io"
+	}
+	return server
+}
+
+// lookup returns the credentials for a registry domain, asking the matching
+// credential helper first and falling back to the auths section.
+func (c *dockerConfig) lookup(domain string) (types.AuthConfig, bool) {
+	domain = normalizeRegistry(domain)
+	server := domain
+	if domain == "docker.io" {
+		server = dockerHubServer
+	}
+
+	helper := c.CredsStore
+	for key, h := range c.CredHelpers {
+		if normalizeRegistry(key) == domain {
+			helper = h
+		}
+	}
+	if helper != "" {
+		auth, err := c.fromHelper(helper, server)
+		if err != nil {
+			logWarn("Credential helper %s failed for %s: %v", helper, domain, err)
+		} else if auth.Username != "" || auth.IdentityToken != "" {
+			return auth, true
+		}
+	}
+
+	for key, entry := range c.Auths {
+		if normalizeRegistry(key) != domain {
+			continue
+		}
+		auth := types.AuthConfig{
+			Username:      entry.Username,
+			Password:      entry.Password,
+			IdentityToken: entry.IdentityToken,
+			ServerAddress: server,
+		}
+		if entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				logWarn("Ignoring invalid auth entry for %s in docker config: %v", key, err)
+				continue
+			}
+			auth.Username, auth.Password, _ = strings.Cut(string(decoded), ":")
+		}
+		if auth.Username != "" || auth.IdentityToken != "" {
+			return auth, true
+		}
+	}
+	return types.AuthConfig{}, false
+}
+
+// fromHelper runs docker-credential-<helper> get for server, caching the
+// answer for helperCacheTTL.
+func (c *dockerConfig) fromHelper(helper, server string) (types.AuthConfig, error) {
+	key := helper + "\x00" + server
+	c.mu.Lock()
+	if cached, ok := c.cached[key]; ok && time.Now().Before(cached.expires) {
+		c.mu.Unlock()
+		return cached.auth, nil
+	}
+	c.mu.Unlock()
+
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(server)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		// Helpers report a missing entry on stdout and exit non-zero.
+		msg := strings.TrimSpace(string(out) + stderr.String())
+		if strings.Contains(msg, "credentials not found") {
+			return types.AuthConfig{}, nil
+		}
+		return types.AuthConfig{}, fmt.Errorf("%w: %s", err, msg)
+	}
+	var resp struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return types.AuthConfig{}, fmt.Errorf("decode helper output: %w", err)
+	}
+	auth := types.AuthConfig{ServerAddress: server}
+	if resp.Username == "<token>" {
+		auth.IdentityToken = resp.Secret
+	} else {
+		auth.Username, auth.Password = resp.Username, resp.Secret
+	}
+
+	c.mu.Lock()
+	c.cached[key] = cachedCredentials{auth: auth, expires: time.Now().Add(helperCacheTTL)}
+	c.mu.Unlock()
+	return auth, nil
+}
+
+// expireHelpers drops all cached credential helper answers and reports
+// whether there were any.
+func (c *dockerConfig) expireHelpers() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	had := len(c.cached) > 0
+	c.cached = make(map[string]cachedCredentials)
+	return had
+}
+
+// authFor returns the credentials for pulling image: the docker config entry
+// of its registry when there is one, otherwise fallback.
+func authFor(image string, fallback types.AuthConfig) types.AuthConfig {
+	if dockerCredentials == nil {
+		return fallback
+	}
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return fallback
+	}
+	if auth, ok := dockerCredentials.lookup(reference.Domain(named)); ok {
+		return auth
+	}
+	return fallback
+}
+
+// hasCredentials reports whether auth carries anything to send.
+func hasCredentials(auth types.AuthConfig) bool {
+	return (auth.Username != "" && auth.Password != "") || auth.IdentityToken != "" || auth.RegistryToken != ""
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// smtpConfig holds the SMTP settings read from the SMTP_* environment variables.
+type smtpConfig struct {
+	host string
+	port string
+	user string
+	pass string
+	from string
+	to   []string
+}
+
+// loadSMTPConfig reads and validates the SMTP_* environment variables.
+func loadSMTPConfig() (smtpConfig, error) {
+	cfg := smtpConfig{
+		host: os.Getenv("SMTP_HOST"),
+		port: os.Getenv("SMTP_PORT"),
+		user: os.Getenv("SMTP_USER"),
+		pass: os.Getenv("SMTP_PASS"),
+		from: os.Getenv("SMTP_FROM"),
+	}
+	if cfg.port == "" {
+		cfg.port = "587"
+	}
+	for _, to := range strings.Split(os.Getenv("SMTP_TO"), ",") {
+		if to = strings.TrimSpace(to); to != "" {
+			cfg.to = append(cfg.to, to)
+		}
+	}
+	switch {
+	case cfg.host == "":
+		return cfg, fmt.Errorf("SMTP_HOST is required")
+	case cfg.from == "":
+		return cfg, fmt.Errorf("SMTP_FROM is required")
+	case len(cfg.to) == 0:
+		return cfg, fmt.Errorf("SMTP_TO is required")
+	}
+	return cfg, nil
+}
+
+// emailBatcher collects the messages of a check cycle so they can be sent
+// as a single email instead of one per container.
+type emailBatcher struct {
+	cfg      smtpConfig
+	mu       sync.Mutex
+	messages []string
+}
+
+// emailNotifications is set when -notify-format is email.
+var emailNotifications *emailBatcher
+
+// Notify collects the event's message for the next batched email.
+func (b *emailBatcher) Notify(_ context.Context, event Event) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.messages = append(b.messages, levelPrefix(event))
+	return nil
+}
+
+// flush queues the collected messages as one email. It is safe to call on a
+// nil batcher.
+func (b *emailBatcher) flush() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	messages := b.messages
+	b.messages = nil
+	b.mu.Unlock()
+	if len(messages) == 0 {
+		return
+	}
+
+	n := queuedNotifier{next: emailSender{cfg: b.cfg}}
+	if err := n.Notify(context.Background(), Event{Message: strings.Join(messages, "\n")}); err != nil {
+		logWarn("Dropping email with %d messages: %v", len(messages), err)
+	}
+}
+
+// emailSender delivers each event as a single email.
+type emailSender struct {
+	cfg smtpConfig
+}
+
+func (e emailSender) Notify(_ context.Context, event Event) error {
+	return sendEmail(e.cfg, event.Message)
+}
+
+// sendEmail delivers body to the configured recipients, upgrading the
+// connection with STARTTLS when offered (or using implicit TLS on port 465).
+func sendEmail(cfg smtpConfig, body string) error {
+	addr := net.JoinHostPort(cfg.host, cfg.port)
+	tlsConfig := &tls.Config{ServerName: cfg.host}
+
+	var c *smtp.Client
+	if cfg.port == "465" {
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: *notificationTimeout}, "tcp", addr, tlsConfig)
+		if err != nil {
+			return fmt.Errorf("connect %s: %w", addr, err)
+		}
+		if c, err = smtp.NewClient(conn, cfg.host); err != nil {
+			conn.Close()
+			return err
+		}
+	} else {
+		conn, err := net.DialTimeout("tcp", addr, *notificationTimeout)
+		if err != nil {
+			return fmt.Errorf("connect %s: %w", addr, err)
+		}
+		if c, err = smtp.NewClient(conn, cfg.host); err != nil {
+			conn.Close()
+			return err
+		}
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(tlsConfig); err != nil {
+				c.Close()
+				return fmt.Errorf("starttls: %w", err)
+			}
+		}
+	}
+	defer c.Close()
+
+	if cfg.user != "" {
+		if err := c.Auth(smtp.PlainAuth("", cfg.user, cfg.pass, cfg.host)); err != nil {
+			return fmt.Errorf("auth: %w", err)
+		}
+	}
+	if err := c.Mail(cfg.from); err != nil {
+		return err
+	}
+	for _, to := range cfg.to {
+		if err := c.Rcpt(to); err != nil {
+			return fmt.Errorf("recipient %s: %w", to, err)
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	host, _ := os.Hostname()
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: [puller] Update report from %s\r\nDate: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		cfg.from, strings.Join(cfg.to, ", "), host, time.Now().Format(time.RFC1123Z), strings.ReplaceAll(body, "\n", "\r\n"))
+	if _, err := w.Write([]byte(msg)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
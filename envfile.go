@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// envVar is one assignment read from an env file.
+type envVar struct {
+	key, value string
+}
+
+// loadEnvFileFlag loads the -env-file path. explicit tells whether the flag
+// was given: the default file may be missing, and loading it is logged at
+// info level since it is picked up from the working directory unasked. An
+// empty path disables the env file.
+func loadEnvFileFlag(path string, explicit bool) error {
+	if path == "" {
+		return nil
+	}
+	n, err := loadEnvFile(path)
+	if err != nil {
+		if !explicit && errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if explicit {
+		logVerbose("Loaded %d variables from %s", n, path)
+	} else {
+		logInfo("Loaded %d variables from %s (default -env-file, pass -env-file= to disable)", n, path)
+	}
+	return nil
+}
+
+// loadEnvFile sets the variables assigned in path that are not set in the
+// environment already, so real environment variables take precedence.
+func loadEnvFile(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	vars, err := parseEnvFile(f)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", path, err)
+	}
+	loaded := 0
+	for _, v := range vars {
+		if _, ok := os.LookupEnv(v.key); ok {
+			continue
+		}
+		if err := os.Setenv(v.key, v.value); err != nil {
+			return loaded, err
+		}
+		loaded++
+	}
+	return loaded, nil
+}
+
+// parseEnvFile reads KEY=VALUE lines as written for docker compose: blank
+// lines and # comments are skipped, an optional "export " prefix is
+// allowed, and values may be single quoted (literal) or double quoted
+// (with \n, \t, \" and \\ escapes).
+func parseEnvFile(r io.Reader) ([]envVar, error) {
+	var vars []envVar
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		key, raw, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("line %d: expected KEY=VALUE", lineNo)
+		}
+		value, err := parseEnvValue(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		vars = append(vars, envVar{key: key, value: value})
+	}
+	return vars, scanner.Err()
+}
+
+// parseEnvValue unquotes a value and drops a trailing comment. An unquoted
+// value only ends at a # that follows whitespace, so URLs with fragments
+// survive.
+func parseEnvValue(raw string) (string, error) {
+	if raw == "" {
+		return "", nil
+	}
+	var value, rest string
+	switch quote := raw[0]; quote {
+	case '\'':
+		end := strings.IndexByte(raw[1:], '\'')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated single quote")
+		}
+		value, rest = raw[1:end+1], raw[end+2:]
+	case '"':
+		var b strings.Builder
+		i := 1
+		for ; i < len(raw) && raw[i] != '"'; i++ {
+			c := raw[i]
+			if c == '\\' && i+1 < len(raw) {
+				i++
+				switch raw[i] {
+				case 'n':
+					c = '\n'
+				case 't':
+					c = '\t'
+				case '"', '\\':
+					c = raw[i]
+				default:
+					b.WriteByte('\\')
+					c = raw[i]
+				}
+			}
+			b.WriteByte(c)
+		}
+		if i == len(raw) {
+			return "", fmt.Errorf("unterminated double quote")
+		}
+		value, rest = b.String(), raw[i+1:]
+	default:
+		value = raw
+		for i := 1; i < len(raw); i++ {
+			if raw[i] == '#' && (raw[i-1] == ' ' || raw[i-1] == '\t') {
+				value = strings.TrimSpace(raw[:i])
+				break
+			}
+		}
+		return value, nil
+	}
+	if rest = strings.TrimSpace(rest); rest != "" && !strings.HasPrefix(rest, "#") {
+		return "", fmt.Errorf("unexpected text after quoted value")
+	}
+	return value, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseEnvFile(t *testing.T) {
+	input := `# registry credentials
+
+REGISTRY_USERNAME=alice
+  export REGISTRY_PASSWORD = "p@ss \"word\"\n"   # quoted
+REGISTRY_URL='https://registry.example.com/#not-a-comment'
+NOTIFICATION_URL=https://hooks.example.com/x#frag # trailing comment
+EMPTY=
+SPACED = value with spaces
+BACKSLASH="C:\\path\q"
+`
+	got, err := parseEnvFile(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("parseEnvFile: %v", err)
+	}
+	want := []envVar{
+		{"REGISTRY_USERNAME", "alice"},
+		{"REGISTRY_PASSWORD", "p@ss \"word\"\n"},
+		{"REGISTRY_URL", "https://registry.example.com/#not-a-comment"},
+		{"NOTIFICATION_URL", "https://hooks.example.com/x#frag"},
+		{"EMPTY", ""},
+		{"SPACED", "value with spaces"},
+		{"BACKSLASH", `C:\path\q`},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseEnvFile =\n%q\nwant\n%q", got, want)
+	}
+
+	for _, bad := range []string{
+		"NO_EQUALS",
+		"=value",
+		"TWO WORDS=value",
+		`OPEN="unterminated`,
+		`OPEN='unterminated`,
+		`QUOTED="value" trailing`,
+	} {
+		if _, err := parseEnvFile(strings.NewReader("OK=1\n" + bad + "\n")); err == nil || !strings.Contains(err.Error(), "line 2") {
+			t.Errorf("parseEnvFile(%q) = %v, want an error on line 2", bad, err)
+		}
+	}
+}
+
+func TestLoadEnvFileKeepsRealEnvironment(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".env")
+	if err := os.WriteFile(path, []byte("PULLER_TEST_SET=from-file\nPULLER_TEST_UNSET=from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PULLER_TEST_SET", "from-env")
+	t.Setenv("PULLER_TEST_UNSET", "")
+	os.Unsetenv("PULLER_TEST_UNSET")
+
+	loaded, err := loadEnvFile(path)
+	if err != nil {
+		t.Fatalf("loadEnvFile: %v", err)
+	}
+	if loaded != 1 {
+		t.Errorf("loaded %d variables, want 1", loaded)
+	}
+	if got := os.Getenv("PULLER_TEST_SET"); got != "from-env" {
+		t.Errorf("PULLER_TEST_SET = %q, the real environment must win", got)
+	}
+	if got := os.Getenv("PULLER_TEST_UNSET"); got != "from-file" {
+		t.Errorf("PULLER_TEST_UNSET = %q, want the file's value", got)
+	}
+
+	if _, err := loadEnvFile(filepath.Join(t.TempDir(), "missing.env")); !os.IsNotExist(err) {
+		t.Errorf("loadEnvFile of a missing file = %v, want a not-exist error", err)
+	}
+}
+
+func TestLoadEnvFileFlag(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".env")
+	if err := os.WriteFile(path, []byte("PULLER_TEST_DEFAULT=from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PULLER_TEST_DEFAULT", "")
+	os.Unsetenv("PULLER_TEST_DEFAULT")
+	logs := captureLog(t, levelInfo)
+
+	if err := loadEnvFileFlag(path, false); err != nil {
+		t.Fatalf("loadEnvFileFlag of the default file: %v", err)
+	}
+	if !strings.Contains(logs.String(), "Loaded 1 variables from "+path+" (default -env-file") {
+		t.Errorf("loading the default file was not logged at info level:\n%s", logs)
+	}
+
+	missing := filepath.Join(t.TempDir(), ".env")
+	if err := loadEnvFileFlag(missing, false); err != nil {
+		t.Errorf("missing default file = %v, want it ignored", err)
+	}
+	if err := loadEnvFileFlag(missing, true); !os.IsNotExist(err) {
+		t.Errorf("missing explicit file = %v, want a not-exist error", err)
+	}
+	if err := loadEnvFileFlag("", true); err != nil {
+		t.Errorf("-env-file= = %v, want the env file disabled", err)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// eventSchemaVersion is sent with every -event-url payload and is bumped on
+// incompatible changes.
+const eventSchemaVersion = 1
+
+// Event names sent to -event-url.
+const (
+	kindCheckStarted    = "check_started"
+	kindCheckCompleted  = "check_completed"
+	kindCheckFailed     = "check_failed"
+	kindCheckRecovered  = "check_recovered"
+	kindUpdateAvailable = "update_available"
+	kindUpdated         = "updated"
+	kindUpdateFailed    = "update_failed"
+	kindRolledBack      = "rolled_back"
+)
+
+// structuredEvent is the JSON document posted to -event-url.
+type structuredEvent struct {
+	Version   int    `json:"version"`
+	Event     string `json:"event"`
+	Severity  string `json:"severity"`
+	Container string `json:"container,omitempty"`
+	OldImage  string `json:"oldImage,omitempty"`
+	NewImage  string `json:"newImage,omitempty"`
+	Message   string `json:"message,omitempty"`
+	Time      string `json:"time"`
+}
+
+// eventKind returns the -event-url name of event, or "" for events that are
+// not sent, such as cycle summaries.
+func eventKind(event Event) string {
+	if event.Kind != "" {
+		return event.Kind
+	}
+	switch event.Type {
+	case eventStart:
+		return kindCheckStarted
+	case eventComplete:
+		return kindCheckCompleted
+	case eventUpdate:
+		return kindUpdated
+	case eventRollback:
+		return kindRolledBack
+	case eventError:
+		if event.Container != "" {
+			return kindUpdateFailed
+		}
+		return kindCheckFailed
+	}
+	return ""
+}
+
+// EventWebhookNotifier posts events as structured JSON for machine
+// consumption, independent of the human-readable notifications. It sends its
+// own credentials and headers, never those of the notification backends.
+type EventWebhookNotifier struct {
+	URL     string
+	Auth    string
+	Headers []string
+}
+
+func (n EventWebhookNotifier) Notify(ctx context.Context, event Event) error {
+	kind := eventKind(event)
+	if kind == "" {
+		return nil
+	}
+	at := event.Time
+	if at.IsZero() {
+		at = time.Now()
+	}
+	body, err := json.Marshal(structuredEvent{
+		Version:   eventSchemaVersion,
+		Event:     kind,
+		Severity:  event.Severity,
+		Container: event.Container,
+		OldImage:  event.OldImage,
+		NewImage:  event.NewImage,
+		Message:   event.Message,
+		Time:      at.UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	applyAuth(req, n.Auth, n.Headers)
+	return sendNotificationRequest(req)
+}
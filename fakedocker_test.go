@@ -0,0 +1,540 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+)
+
+// fakeDocker is a minimal Docker Engine API server holding containers and
+// images in memory. Tests talk to it through the real client, so the code
+// under test runs unchanged.
+type fakeDocker struct {
+	t   *testing.T
+	srv *httptest.Server
+
+	mu         sync.Mutex
+	containers map[string]*types.ContainerJSON
+	order      []string
+	images     map[string]types.ImageInspect // by image ID
+	tags       map[string]string             // local reference -> image ID
+	remote     map[string]string             // reference served by pulls -> image ID
+	streams    map[string]string             // reference -> pull progress stream
+	pullAuth   map[string]string             // pulled reference -> X-Registry-Auth
+	platforms  map[string]string             // pulled reference -> requested platform
+	failures   map[string]int                // "METHOD /path" -> status code
+	hangs      map[string]bool               // "METHOD /path" requests that never answer
+	unhealthy  map[string]bool               // image IDs whose containers fail their healthcheck
+	password   string                        // when set, pulls with another password are unauthorized
+	calls      []string
+	created    []fakeCreate
+	connected  map[string]*network.EndpointSettings // "network container" -> settings
+	nextID     int
+}
+
+// fakeCreate is a ContainerCreate call as received by the daemon.
+type fakeCreate struct {
+	Name string
+	container.Config
+	HostConfig       *container.HostConfig
+	NetworkingConfig *network.NetworkingConfig
+}
+
+func newFakeDocker(t *testing.T) (*fakeDocker, *client.Client) {
+	t.Helper()
+	d := &fakeDocker{
+		t:          t,
+		containers: make(map[string]*types.ContainerJSON),
+		images:     make(map[string]types.ImageInspect),
+		tags:       make(map[string]string),
+		remote:     make(map[string]string),
+		streams:    make(map[string]string),
+		pullAuth:   make(map[string]string),
+		platforms:  make(map[string]string),
+		failures:   make(map[string]int),
+		hangs:      make(map[string]bool),
+		unhealthy:  make(map[string]bool),
+		connected:  make(map[string]*network.EndpointSettings),
+	}
+	d.srv = httptest.NewServer(http.HandlerFunc(d.serve))
+	t.Cleanup(d.srv.Close)
+	cli, err := client.NewClientWithOpts(
+		client.WithHost("tcp://"+d.srv.Listener.Addr().String()),
+		client.WithVersion("1.43"),
+		client.WithHTTPClient(d.srv.Client()),
+	)
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+	t.Cleanup(func() { cli.Close() })
+	return d, cli
+}
+
+// normalizeRef returns the fully qualified form of ref with a default tag,
+// or ref itself for image IDs.
+func normalizeRef(ref string) string {
+	if strings.HasPrefix(ref, "sha256:") {
+		return ref
+	}
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return ref
+	}
+	return reference.TagNameOnly(named).String()
+}
+
+// addImage stores a local image, tagged with refs.
+func (d *fakeDocker) addImage(id, created string, refs ...string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	img := d.images[id]
+	img.ID, img.Created, img.Os, img.Architecture = id, created, "linux", "amd64"
+	if img.RootFS.Layers == nil {
+		img.RootFS.Layers = []string{"sha256:layer-" + id}
+	}
+	if img.Config == nil {
+		img.Config = &container.Config{}
+	}
+	d.images[id] = img
+	for _, ref := range refs {
+		d.tagLocked(id, ref)
+	}
+}
+
+// publish makes pulls of ref return the image id, which must have been
+// added with addImage.
+func (d *fakeDocker) publish(ref, id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.remote[normalizeRef(ref)] = id
+}
+
+func (d *fakeDocker) tagLocked(id, ref string) {
+	ref = normalizeRef(ref)
+	if old, ok := d.tags[ref]; ok {
+		img := d.images[old]
+		img.RepoTags = removeString(img.RepoTags, ref)
+		d.images[old] = img
+	}
+	d.tags[ref] = id
+	img := d.images[id]
+	img.RepoTags = append(img.RepoTags, ref)
+	d.images[id] = img
+}
+
+// resolveLocked returns the ID of the local image ref refers to by tag or by
+// registry digest, or "".
+func (d *fakeDocker) resolveLocked(ref string) string {
+	if id, ok := d.tags[normalizeRef(ref)]; ok {
+		return id
+	}
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return ""
+	}
+	digested, ok := named.(reference.Digested)
+	if !ok {
+		return ""
+	}
+	want := named.Name() + "@" + digested.Digest().String()
+	for id, img := range d.images {
+		for _, rd := range img.RepoDigests {
+			if normalizeRef(rd) == want {
+				return id
+			}
+		}
+	}
+	return ""
+}
+
+func removeString(list []string, s string) []string {
+	out := list[:0]
+	for _, v := range list {
+		if v != s {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// addContainer stores a container. Unset fields get running defaults.
+func (d *fakeDocker) addContainer(c types.ContainerJSON) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.storeLocked(&c)
+}
+
+func (d *fakeDocker) storeLocked(c *types.ContainerJSON) {
+	if c.State == nil {
+		c.State = &types.ContainerState{Running: true, Status: "running"}
+	}
+	if c.HostConfig == nil {
+		c.HostConfig = &container.HostConfig{}
+	}
+	if c.Config == nil {
+		c.Config = &container.Config{}
+	}
+	if c.NetworkSettings == nil {
+		c.NetworkSettings = &types.NetworkSettings{}
+	}
+	if _, ok := d.containers[c.ID]; !ok {
+		d.order = append(d.order, c.ID)
+	}
+	d.containers[c.ID] = c
+}
+
+// fail makes the request "METHOD /path" (without the API version) fail with
+// status.
+func (d *fakeDocker) fail(request string, status int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.failures[request] = status
+}
+
+// hang makes the request "METHOD /path" block until the client cancels it.
+func (d *fakeDocker) hang(request string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.hangs[request] = true
+}
+
+// container returns the stored container with the given name, or nil.
+func (d *fakeDocker) container(name string) *types.ContainerJSON {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, id := range d.order {
+		if c := d.containers[id]; c != nil && c.Name == "/"+name {
+			return c
+		}
+	}
+	return nil
+}
+
+// called reports whether the request "METHOD /path" was made.
+func (d *fakeDocker) called(request string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, c := range d.calls {
+		if c == request {
+			return true
+		}
+	}
+	return false
+}
+
+// callIndex returns the position of the first request "METHOD /path", or -1.
+func (d *fakeDocker) callIndex(request string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i, c := range d.calls {
+		if c == request {
+			return i
+		}
+	}
+	return -1
+}
+
+// count returns how often the request "METHOD /path" was made.
+func (d *fakeDocker) count(request string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := 0
+	for _, c := range d.calls {
+		if c == request {
+			n++
+		}
+	}
+	return n
+}
+
+func (d *fakeDocker) serve(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	path := r.URL.Path
+	if strings.HasPrefix(path, "/v1.") {
+		if i := strings.Index(path[1:], "/"); i >= 0 {
+			path = path[i+1:]
+		}
+	}
+	if unescaped, err := url.PathUnescape(path); err == nil {
+		path = unescaped
+	}
+	request := r.Method + " " + path
+	d.calls = append(d.calls, request)
+	if d.hangs[request] {
+		// Block until the client gives up, without holding the lock.
+		d.mu.Unlock()
+		<-r.Context().Done()
+		d.mu.Lock()
+		return
+	}
+	if status, ok := d.failures[request]; ok {
+		writeError(w, status, fmt.Sprintf("injected failure of %s", request))
+		return
+	}
+
+	switch {
+	case path == "/_ping":
+		w.Header().Set("API-Version", "1.43")
+		_, _ = w.Write([]byte("OK"))
+	case request == "GET /containers/json":
+		d.listContainers(w, r)
+	case request == "POST /containers/create":
+		d.createContainer(w, r)
+	case strings.HasPrefix(path, "/containers/"):
+		d.containerRequest(w, r, strings.TrimPrefix(path, "/containers/"))
+	case strings.HasPrefix(path, "/networks/") && strings.HasSuffix(path, "/connect"):
+		var body types.NetworkConnect
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		name := strings.TrimSuffix(strings.TrimPrefix(path, "/networks/"), "/connect")
+		d.connected[name+" "+body.Container] = body.EndpointConfig
+		w.WriteHeader(http.StatusOK)
+	case request == "POST /images/create":
+		d.pull(w, r)
+	case request == "POST /images/prune":
+		d.prune(w)
+	case strings.HasPrefix(path, "/images/"):
+		d.imageRequest(w, r, strings.TrimPrefix(path, "/images/"))
+	default:
+		writeError(w, http.StatusNotFound, "unsupported request "+request)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"message": msg})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (d *fakeDocker) listContainers(w http.ResponseWriter, r *http.Request) {
+	args, err := filters.FromJSON(r.URL.Query().Get("filters"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	list := []types.Container{}
+	for _, id := range d.order {
+		c := d.containers[id]
+		if c == nil || !args.MatchKVList("label", c.Config.Labels) {
+			continue
+		}
+		list = append(list, types.Container{
+			ID:      c.ID,
+			Names:   []string{c.Name},
+			Image:   c.Config.Image,
+			ImageID: c.Image,
+			Labels:  c.Config.Labels,
+			State:   c.State.Status,
+		})
+	}
+	writeJSON(w, list)
+}
+
+func (d *fakeDocker) createContainer(w http.ResponseWriter, r *http.Request) {
+	var body fakeCreate
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	body.Name = r.URL.Query().Get("name")
+	d.created = append(d.created, body)
+	for _, c := range d.containers {
+		if c.Name == "/"+body.Name {
+			writeError(w, http.StatusConflict, "name already in use")
+			return
+		}
+	}
+	imageID := d.resolveLocked(body.Image)
+
+	d.nextID++
+	cfg := body.Config
+	c := &types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:         fmt.Sprintf("%064d", d.nextID),
+			Name:       "/" + body.Name,
+			Image:      imageID,
+			State:      &types.ContainerState{Status: "created"},
+			HostConfig: body.HostConfig,
+		},
+		Config:          &cfg,
+		NetworkSettings: &types.NetworkSettings{Networks: map[string]*network.EndpointSettings{}},
+	}
+	if body.NetworkingConfig != nil {
+		for name, es := range body.NetworkingConfig.EndpointsConfig {
+			c.NetworkSettings.Networks[name] = es
+		}
+	}
+	d.storeLocked(c)
+	writeJSON(w, container.CreateResponse{ID: c.ID})
+}
+
+func (d *fakeDocker) containerRequest(w http.ResponseWriter, r *http.Request, rest string) {
+	id, action, _ := strings.Cut(rest, "/")
+	c := d.containers[id]
+	if c == nil {
+		for _, candidate := range d.containers {
+			if candidate.Name == "/"+id {
+				c = candidate
+			}
+		}
+	}
+	if c == nil {
+		writeError(w, http.StatusNotFound, "No such container: "+id)
+		return
+	}
+	switch r.Method + " " + action {
+	case "GET json":
+		writeJSON(w, c)
+	case "POST start":
+		c.State.Running, c.State.Status = true, "running"
+		if c.Config.Healthcheck != nil {
+			c.State.Health = &types.Health{Status: types.Healthy}
+			if d.unhealthy[c.Image] {
+				c.State.Health.Status = types.Unhealthy
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "POST stop", "POST kill":
+		if !c.State.Running && action == "kill" {
+			writeError(w, http.StatusConflict, "container is not running")
+			return
+		}
+		c.State.Running, c.State.Status = false, "exited"
+		w.WriteHeader(http.StatusNoContent)
+	case "POST update":
+		var update container.UpdateConfig
+		_ = json.NewDecoder(r.Body).Decode(&update)
+		c.HostConfig.RestartPolicy = update.RestartPolicy
+		writeJSON(w, container.ContainerUpdateOKBody{})
+	case "DELETE ":
+		delete(d.containers, c.ID)
+		d.order = removeString(d.order, c.ID)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusNotFound, "unsupported container request "+r.Method+" "+action)
+	}
+}
+
+func (d *fakeDocker) pull(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	ref := q.Get("fromImage")
+	if tag := q.Get("tag"); tag != "" {
+		if strings.HasPrefix(tag, "sha256:") {
+			ref += "@" + tag
+		} else {
+			ref += ":" + tag
+		}
+	}
+	ref = normalizeRef(ref)
+	d.pullAuth[ref] = r.Header.Get("X-Registry-Auth")
+	d.platforms[ref] = q.Get("platform")
+	if d.password != "" && pullPassword(r.Header.Get("X-Registry-Auth")) != d.password {
+		writeError(w, http.StatusUnauthorized, "unauthorized: authentication required")
+		return
+	}
+	stream, hasStream := d.streams[ref]
+	id, ok := d.remote[ref]
+	if !ok && !hasStream {
+		writeError(w, http.StatusNotFound, "manifest for "+ref+" not found")
+		return
+	}
+	if ok {
+		d.tagLocked(id, ref)
+	}
+	if !hasStream {
+		stream = `{"status":"Pulling from ` + ref + `"}` + "\n" + `{"status":"Status: Downloaded newer image for ` + ref + `"}` + "\n"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(stream))
+}
+
+// prune removes the dangling images no container uses.
+func (d *fakeDocker) prune(w http.ResponseWriter) {
+	inUse := make(map[string]bool)
+	for _, c := range d.containers {
+		inUse[c.Image] = true
+	}
+	report := types.ImagesPruneReport{ImagesDeleted: []types.ImageDeleteResponseItem{}}
+	for id, img := range d.images {
+		if len(img.RepoTags) == 0 && !inUse[id] {
+			delete(d.images, id)
+			report.ImagesDeleted = append(report.ImagesDeleted, types.ImageDeleteResponseItem{Deleted: id})
+		}
+	}
+	writeJSON(w, report)
+}
+
+// pullPassword returns the password in an X-Registry-Auth header.
+func pullPassword(header string) string {
+	var auth types.AuthConfig
+	if data, err := base64.URLEncoding.DecodeString(header); err == nil {
+		_ = json.Unmarshal(data, &auth)
+	}
+	return auth.Password
+}
+
+func (d *fakeDocker) imageRequest(w http.ResponseWriter, r *http.Request, rest string) {
+	var name, action string
+	switch {
+	case strings.HasSuffix(rest, "/json"):
+		name, action = strings.TrimSuffix(rest, "/json"), "json"
+	case strings.HasSuffix(rest, "/tag"):
+		name, action = strings.TrimSuffix(rest, "/tag"), "tag"
+	default:
+		name = rest
+	}
+	id := name
+	if !strings.HasPrefix(name, "sha256:") {
+		id = d.resolveLocked(name)
+	}
+	img, ok := d.images[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "No such image: "+name)
+		return
+	}
+
+	switch r.Method + " " + action {
+	case "GET json":
+		writeJSON(w, img)
+	case "POST tag":
+		q := r.URL.Query()
+		d.tagLocked(id, q.Get("repo")+":"+q.Get("tag"))
+		w.WriteHeader(http.StatusCreated)
+	case "DELETE ":
+		if strings.HasPrefix(name, "sha256:") {
+			delete(d.images, id)
+			for ref, tagged := range d.tags {
+				if tagged == id {
+					delete(d.tags, ref)
+				}
+			}
+		} else {
+			ref := normalizeRef(name)
+			delete(d.tags, ref)
+			img.RepoTags = removeString(img.RepoTags, ref)
+			d.images[id] = img
+		}
+		writeJSON(w, []types.ImageDeleteResponseItem{{Untagged: name}})
+	default:
+		writeError(w, http.StatusNotFound, "unsupported image request "+r.Method+" "+action)
+	}
+}
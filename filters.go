@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types"
+)
+
+var (
+	includeNamesRe   *regexp.Regexp
+	excludeNamesRe   *regexp.Regexp
+	nameGlobs        []string
+	allowedNames     map[string]bool
+	includeRepoGlobs []string
+	excludeRepoGlobs []string
+)
+
+// compileNameFilters compiles the include/exclude name expressions and the
+// name globs. Empty values disable the corresponding filter.
+func compileNameFilters(include, exclude, globs string) error {
+	var err error
+	if nameGlobs, err = splitGlobs(globs); err != nil {
+		return fmt.Errorf("name-filter: %w", err)
+	}
+	if include != "" {
+		if includeNamesRe, err = regexp.Compile(include); err != nil {
+			return fmt.Errorf("include-names: %w", err)
+		}
+	}
+	if exclude != "" {
+		if excludeNamesRe, err = regexp.Compile(exclude); err != nil {
+			return fmt.Errorf("exclude-names: %w", err)
+		}
+	}
+	return nil
+}
+
+// parseContainerList parses the -containers allowlist. An empty list allows
+// every container and yields nil.
+func parseContainerList(list string) map[string]bool {
+	var names map[string]bool
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimPrefix(strings.TrimSpace(name), "/"); name == "" {
+			continue
+		}
+		if names == nil {
+			names = make(map[string]bool)
+		}
+		names[name] = true
+	}
+	return names
+}
+
+// compileRepoFilters splits and validates the comma-separated repository
+// glob patterns.
+func compileRepoFilters(include, exclude string) error {
+	var err error
+	if includeRepoGlobs, err = splitGlobs(include); err != nil {
+		return fmt.Errorf("include-repos: %w", err)
+	}
+	if excludeRepoGlobs, err = splitGlobs(exclude); err != nil {
+		return fmt.Errorf("exclude-repos: %w", err)
+	}
+	return nil
+}
+
+func splitGlobs(list string) ([]string, error) {
+	var globs []string
+	for _, g := range strings.Split(list, ",") {
+		if g = strings.TrimSpace(g); g == "" {
+			continue
+		}
+		if _, err := path.Match(g, ""); err != nil {
+			return nil, fmt.Errorf("%q: %w", g, err)
+		}
+		globs = append(globs, g)
+	}
+	return globs, nil
+}
+
+// matchesAnyGlob reports whether any of the candidates matches any glob.
+func matchesAnyGlob(globs []string, candidates ...string) bool {
+	for _, g := range globs {
+		for _, c := range candidates {
+			if ok, _ := path.Match(g, c); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchesRepoFilters reports whether the repository of image passes the
+// include/exclude globs. Patterns are matched against both the short form
+// (myorg/app) and the fully qualified name (docker.io/myorg/app).
+func matchesRepoFilters(image string) bool {
+	if len(includeRepoGlobs) == 0 && len(excludeRepoGlobs) == 0 {
+		return true
+	}
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return len(includeRepoGlobs) == 0
+	}
+	candidates := []string{reference.FamiliarName(named), named.Name()}
+	if len(includeRepoGlobs) > 0 && !matchesAnyGlob(includeRepoGlobs, candidates...) {
+		return false
+	}
+	return !matchesAnyGlob(excludeRepoGlobs, candidates...)
+}
+
+// stringList collects the values of a repeatable flag; each value may also
+// hold a comma-separated list.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// imagePrefixes holds the -image-prefix repository prefixes.
+var imagePrefixes stringList
+
+// hasImagePrefix reports whether image, as written or fully qualified
+// (docker.io/library/nginx), starts with one of the -image-prefix values.
+func hasImagePrefix(image string) bool {
+	candidates := []string{image}
+	if named, err := reference.ParseNormalizedNamed(image); err == nil {
+		candidates = append(candidates, named.String())
+	}
+	for _, prefix := range imagePrefixes {
+		for _, c := range candidates {
+			if strings.HasPrefix(c, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isIgnored reports whether a container opted out of updates via labels.
+// An explicit opt-out always wins over the enable label filter.
+func isIgnored(labels map[string]string) bool {
+	return labels[*enableLabel] == "false" || labels[ignoreLabel] == "true"
+}
+
+// matchesNameFilters reports whether a container name passes the
+// include/exclude expressions and the name globs; all of them must match.
+func matchesNameFilters(name string) bool {
+	if len(nameGlobs) > 0 && !matchesAnyGlob(nameGlobs, name) {
+		return false
+	}
+	if includeNamesRe != nil && !includeNamesRe.MatchString(name) {
+		return false
+	}
+	if excludeNamesRe != nil && excludeNamesRe.MatchString(name) {
+		return false
+	}
+	return true
+}
+
+// digestPinnedRepo reports whether image references an immutable digest
+// (repo@sha256:...) and returns the repository without the digest.
+func digestPinnedRepo(image string) (string, bool) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", false
+	}
+	if _, ok := named.(reference.Digested); !ok {
+		return "", false
+	}
+	return reference.FamiliarString(reference.TrimNamed(named)), true
+}
+
+// Labels set by Docker Compose on the containers it manages.
+const (
+	composeLabelPrefix      = "com.docker.compose."
+	composeProjectLabel     = "com.docker.compose.project"
+	composeServiceLabel     = "com.docker.compose.service"
+	composeWorkingDirLabel  = "com.docker.compose.project.working_dir"
+	composeConfigFilesLabel = "com.docker.compose.project.config_files"
+)
+
+// displayName returns the container name for log lines, followed by its
+// Compose service when it has one.
+func displayName(name string, labels map[string]string) string {
+	if service := labels[composeServiceLabel]; service != "" {
+		return fmt.Sprintf("%s (service %s)", name, service)
+	}
+	return name
+}
+
+// unsettledState reports whether a container in state is left alone even
+// with -include-stopped: recreating it would interrupt whatever is going on.
+func unsettledState(state string) bool {
+	switch state {
+	case "created", "paused", "restarting":
+		return true
+	}
+	return false
+}
+
+// selectContainers drops containers excluded by labels, state or name filters.
+func selectContainers(containers []types.Container) []types.Container {
+	selected := containers[:0]
+	found := make(map[string]bool)
+	for _, c := range containers {
+		name := containerName(c)
+		if allowedNames != nil {
+			if !allowedNames[name] {
+				continue
+			}
+			found[name] = true
+		}
+		if isIgnored(c.Labels) {
+			logVerbose("Skipping %s: excluded by ignore label", name)
+			continue
+		}
+		if !isTargeted(floatingImage(c)) && !targetContainers[c.ID] {
+			continue
+		}
+		if c.Labels[swarmServiceLabel] != "" {
+			logVerbose("Skipping %s: task of Swarm service %s", name, c.Labels["com.docker.swarm.service.name"])
+			continue
+		}
+		if unsettledState(c.State) {
+			logVerbose("Skipping %s: container is %s", name, c.State)
+			continue
+		}
+		if !*includeStopped && c.State != "running" {
+			logVerbose("Skipping %s: container is %s", name, c.State)
+			continue
+		}
+		if !matchesNameFilters(name) {
+			logVerbose("Skipping %s: excluded by name filters", name)
+			continue
+		}
+		if *composeProject != "" && c.Labels[composeProjectLabel] != *composeProject {
+			logVerbose("Skipping %s: not part of compose project %s", name, *composeProject)
+			continue
+		}
+		selected = append(selected, c)
+	}
+	for name := range allowedNames {
+		if !found[name] {
+			logWarn("Container %s from -containers not found", name)
+		}
+	}
+	return selected
+}
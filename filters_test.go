@@ -0,0 +1,244 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+)
+
+func TestSelectContainersSkipsStopped(t *testing.T) {
+	containers := []types.Container{
+		{ID: "a", Names: []string{"/web"}, Image: "nginx", State: "running"},
+		{ID: "b", Names: []string{"/batch"}, Image: "busybox", State: "exited"},
+	}
+	selected := selectContainers(containers)
+	if len(selected) != 1 || containerName(selected[0]) != "web" {
+		t.Errorf("selected %v, want only the running container", selected)
+	}
+
+	*includeStopped = true
+	defer func() { *includeStopped = false }()
+	containers = []types.Container{
+		{ID: "a", Names: []string{"/web"}, Image: "nginx", State: "running"},
+		{ID: "b", Names: []string{"/batch"}, Image: "busybox", State: "exited"},
+	}
+	if selected := selectContainers(containers); len(selected) != 2 {
+		t.Errorf("-include-stopped selected %d containers, want 2", len(selected))
+	}
+}
+
+func TestMatchesRepoFilters(t *testing.T) {
+	tests := []struct {
+		include, exclude string
+		image            string
+		want             bool
+	}{
+		{"", "", "nginx:latest", true},
+		{"myorg/*", "", "myorg/api:1.2", true},
+		{"myorg/*", "", "docker.io/myorg/api", true},
+		{"myorg/*", "", "otherorg/api", false},
+		{"myorg/*", "", "nginx", false},
+		{"library/*", "", "nginx", false},
+		{"docker.io/library/*", "", "nginx", true},
+		{"", "*/internal-*", "myorg/internal-tools:2", false},
+		{"", "*/internal-*", "myorg/api", true},
+		{"myorg/*", "*/internal-*", "myorg/internal-db", false},
+		{"myorg/*,ghcr.io/myorg/*", "", "ghcr.io/myorg/web:edge", true},
+	}
+	defer compileRepoFilters("", "")
+	for _, tt := range tests {
+		if err := compileRepoFilters(tt.include, tt.exclude); err != nil {
+			t.Fatalf("compileRepoFilters(%q, %q): %v", tt.include, tt.exclude, err)
+		}
+		if got := matchesRepoFilters(tt.image); got != tt.want {
+			t.Errorf("include %q, exclude %q: matchesRepoFilters(%q) = %v, want %v", tt.include, tt.exclude, tt.image, got, tt.want)
+		}
+	}
+}
+
+func TestCompileRepoFiltersRejectsBadPatterns(t *testing.T) {
+	defer compileRepoFilters("", "")
+	if err := compileRepoFilters("myorg/[", ""); err == nil {
+		t.Error("malformed include pattern accepted")
+	}
+	if err := compileRepoFilters("", "["); err == nil {
+		t.Error("malformed exclude pattern accepted")
+	}
+}
+
+func TestComposeProjectFilter(t *testing.T) {
+	projects := map[string]string{
+		"shop-web": "shop",
+		"shop-db":  "shop",
+		"blog-web": "blog",
+		"loose":    "",
+	}
+	tests := []struct {
+		project string
+		updated []string
+	}{
+		{"", []string{"shop-web", "shop-db", "blog-web", "loose"}},
+		{"shop", []string{"shop-web", "shop-db"}},
+		{"blog", []string{"blog-web"}},
+		{"other", nil},
+	}
+	for _, tt := range tests {
+		t.Run("project "+tt.project, func(t *testing.T) {
+			old := *composeProject
+			*composeProject = tt.project
+			defer func() { *composeProject = old }()
+
+			d, cli := newFakeDocker(t)
+			d.addImage(oldImageID, "2024-01-01T00:00:00Z", "nginx:latest")
+			d.addImage(newImageID, "2024-02-01T00:00:00Z")
+			d.publish("nginx:latest", newImageID)
+			for name, project := range projects {
+				c := testContainer(name+"-old", name, "nginx:latest", oldImageID)
+				if project != "" {
+					c.Config.Labels[composeProjectLabel] = project
+					c.Config.Labels[composeServiceLabel] = strings.TrimPrefix(name, project+"-")
+				}
+				d.addContainer(c)
+			}
+
+			if err := checkContainers(cli, "", "", "", "", NoopNotifier{}); err != nil {
+				t.Fatalf("checkContainers: %v", err)
+			}
+			want := make(map[string]bool)
+			for _, name := range tt.updated {
+				want[name] = true
+			}
+			for name := range projects {
+				if updated := d.container(name).ID != name+"-old"; updated != want[name] {
+					t.Errorf("%s updated = %v, want %v", name, updated, want[name])
+				}
+			}
+		})
+	}
+}
+
+func TestSelectContainersByState(t *testing.T) {
+	tests := []struct {
+		state          string
+		normal, withIS bool // selected by default and with -include-stopped
+	}{
+		{"running", true, true},
+		{"exited", false, true},
+		{"dead", false, true},
+		{"created", false, false},
+		{"paused", false, false},
+		{"restarting", false, false},
+	}
+	defer func() { *includeStopped = false }()
+	for _, tt := range tests {
+		for _, include := range []bool{false, true} {
+			*includeStopped = include
+			selected := selectContainers([]types.Container{{ID: "a", Names: []string{"/web"}, Image: "nginx", State: tt.state}})
+			want := tt.normal
+			if include {
+				want = tt.withIS
+			}
+			if got := len(selected) == 1; got != want {
+				t.Errorf("state %q, -include-stopped=%v: selected = %v, want %v", tt.state, include, got, want)
+			}
+		}
+	}
+}
+
+func TestUnsettledState(t *testing.T) {
+	for state, want := range map[string]bool{
+		"created": true, "paused": true, "restarting": true,
+		"running": false, "exited": false, "dead": false, "removing": false, "": false,
+	} {
+		if got := unsettledState(state); got != want {
+			t.Errorf("unsettledState(%q) = %v, want %v", state, got, want)
+		}
+	}
+}
+
+func TestCustomEnableLabel(t *testing.T) {
+	oldLabel, oldEnable := *enableLabel, *labelEnable
+	*enableLabel, *labelEnable = "com.centurylinklabs.watchtower.enable", true
+	defer func() { *enableLabel, *labelEnable = oldLabel, oldEnable }()
+
+	d, cli := withUpdate(t)
+	d.container("web").Config.Labels["com.centurylinklabs.watchtower.enable"] = "true"
+	api := testContainer("api-old", "api", "nginx:latest", oldImageID)
+	api.Config.Labels["puller.update.enable"] = "true"
+	d.addContainer(api)
+	worker := testContainer("worker-old", "worker", "nginx:latest", oldImageID)
+	worker.Config.Labels["com.centurylinklabs.watchtower.enable"] = "false"
+	d.addContainer(worker)
+
+	if err := checkContainers(cli, "", "", "", "", NoopNotifier{}); err != nil {
+		t.Fatalf("checkContainers: %v", err)
+	}
+	if c := d.container("web"); c.ID == "old" {
+		t.Error("web, enabled with the custom label, was not updated")
+	}
+	if c := d.container("api"); c.ID != "api-old" {
+		t.Error("api, enabled only with the default label, was updated")
+	}
+	if c := d.container("worker"); c.ID != "worker-old" {
+		t.Error("worker, disabled with the custom label, was updated")
+	}
+
+	// The custom label also opts containers out without -label-enable.
+	if !isIgnored(map[string]string{"com.centurylinklabs.watchtower.enable": "false"}) {
+		t.Error("custom label =false does not exclude a container")
+	}
+	if isIgnored(map[string]string{"puller.update.enable": "false"}) {
+		t.Error("default label still excludes containers after -enable-label changed it")
+	}
+}
+
+func TestEnableModesWithMixedLabels(t *testing.T) {
+	labels := map[string]map[string]string{
+		"enabled":  {"puller.update.enable": "true"},
+		"plain":    {},
+		"disabled": {"puller.update.enable": "false"},
+		"ignored":  {"puller.ignore": "true"},
+		"both":     {"puller.update.enable": "true", "puller.ignore": "true"},
+	}
+	tests := []struct {
+		name        string
+		labelEnable bool
+		updated     []string
+	}{
+		{"opt-out (default)", false, []string{"enabled", "plain"}},
+		{"opt-in (-label-enable)", true, []string{"enabled"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := *labelEnable
+			*labelEnable = tt.labelEnable
+			defer func() { *labelEnable = old }()
+
+			d, cli := newFakeDocker(t)
+			d.addImage(oldImageID, "2024-01-01T00:00:00Z", "nginx:latest")
+			d.addImage(newImageID, "2024-02-01T00:00:00Z")
+			d.publish("nginx:latest", newImageID)
+			for name, l := range labels {
+				c := testContainer(name+"-old", name, "nginx:latest", oldImageID)
+				for k, v := range l {
+					c.Config.Labels[k] = v
+				}
+				d.addContainer(c)
+			}
+
+			if err := checkContainers(cli, "", "", "", "", NoopNotifier{}); err != nil {
+				t.Fatalf("checkContainers: %v", err)
+			}
+			want := make(map[string]bool)
+			for _, name := range tt.updated {
+				want[name] = true
+			}
+			for name := range labels {
+				if updated := d.container(name).ID != name+"-old"; updated != want[name] {
+					t.Errorf("%s (labels %v) updated = %v, want %v", name, labels[name], updated, want[name])
+				}
+			}
+		})
+	}
+}
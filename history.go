@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultHistoryLimit is the number of entries GET /history returns when no
+// limit is given.
+const defaultHistoryLimit = 50
+
+// historyEntry is one update outcome served by GET /history.
+type historyEntry struct {
+	Container string    `json:"container"`
+	OldImage  string    `json:"oldImage,omitempty"`
+	NewImage  string    `json:"newImage,omitempty"`
+	Outcome   string    `json:"outcome"`
+	Message   string    `json:"message,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// updateHistory is a ring buffer of the most recent update outcomes.
+type updateHistory struct {
+	mu      sync.Mutex
+	entries []historyEntry
+	next    int
+	full    bool
+}
+
+func newUpdateHistory(size int) *updateHistory {
+	return &updateHistory{entries: make([]historyEntry, size)}
+}
+
+// history is set when the HTTP server is enabled.
+var history *updateHistory
+
+func (h *updateHistory) add(e historyEntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.entries) == 0 {
+		return
+	}
+	h.entries[h.next] = e
+	h.next = (h.next + 1) % len(h.entries)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// recent returns up to limit entries, newest first.
+func (h *updateHistory) recent(limit int) []historyEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := h.next
+	if h.full {
+		n = len(h.entries)
+	}
+	if limit > n {
+		limit = n
+	}
+	out := make([]historyEntry, 0, limit)
+	for i := 1; i <= limit; i++ {
+		out = append(out, h.entries[(h.next-i+len(h.entries))%len(h.entries)])
+	}
+	return out
+}
+
+// historyRecorder adds the outcome of every container update to the
+// history, whether or not it is notified, and passes the event on.
+type historyRecorder struct {
+	history *updateHistory
+	next    Notifier
+}
+
+func (r historyRecorder) Notify(ctx context.Context, event Event) error {
+	if event.Container != "" {
+		switch kind := eventKind(event); kind {
+		case kindUpdated, kindUpdateFailed, kindRolledBack:
+			r.history.add(historyEntry{
+				Container: event.Container,
+				OldImage:  event.OldImage,
+				NewImage:  event.NewImage,
+				Outcome:   kind,
+				Message:   event.Message,
+				Time:      event.Time,
+			})
+		}
+	}
+	return r.next.Notify(ctx, event)
+}
+
+func handleHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := defaultHistoryLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(history.recent(limit)); err != nil {
+		logWarn("Failed to write history response: %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// withHistory installs an update history of size for the duration of a test.
+func withHistory(t *testing.T, size int) *updateHistory {
+	t.Helper()
+	old := history
+	history = newUpdateHistory(size)
+	t.Cleanup(func() { history = old })
+	return history
+}
+
+// getHistory requests GET /history with query and decodes the response.
+func getHistory(t *testing.T, query string) []historyEntry {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handleHistory(rec, httptest.NewRequest(http.MethodGet, "/history"+query, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /history%s = %d: %s", query, rec.Code, rec.Body)
+	}
+	var entries []historyEntry
+	if err := json.NewDecoder(rec.Body).Decode(&entries); err != nil {
+		t.Fatalf("decode /history: %v", err)
+	}
+	return entries
+}
+
+func historyContainers(entries []historyEntry) []string {
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Container)
+	}
+	return names
+}
+
+func TestHistoryNewestFirstAndCapped(t *testing.T) {
+	h := withHistory(t, 3)
+	recorder := historyRecorder{history: h, next: NoopNotifier{}}
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i := 1; i <= 5; i++ {
+		event := Event{Type: eventUpdate, Container: fmt.Sprintf("c%d", i), Time: start.Add(time.Duration(i) * time.Minute)}
+		if err := recorder.Notify(context.Background(), event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Events not about a container update are not history.
+	_ = recorder.Notify(context.Background(), Event{Type: eventComplete, Message: "done"})
+
+	entries := getHistory(t, "")
+	if got, want := historyContainers(entries), []string{"c5", "c4", "c3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("history = %v, want %v", got, want)
+	}
+	for i := 1; i < len(entries); i++ {
+		if !entries[i].Time.Before(entries[i-1].Time) {
+			t.Errorf("entry %d (%s) is not older than entry %d (%s)", i, entries[i].Time, i-1, entries[i-1].Time)
+		}
+	}
+	if entries[0].Outcome != kindUpdated {
+		t.Errorf("outcome = %q, want %q", entries[0].Outcome, kindUpdated)
+	}
+
+	if got, want := historyContainers(getHistory(t, "?limit=2")), []string{"c5", "c4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("limit=2: history = %v, want %v", got, want)
+	}
+	if got := getHistory(t, "?limit=10"); len(got) != 3 {
+		t.Errorf("limit=10: %d entries, want the 3 kept", len(got))
+	}
+}
+
+func TestHistoryBeforeWrapping(t *testing.T) {
+	h := withHistory(t, 5)
+	h.add(historyEntry{Container: "a", Outcome: kindUpdated})
+	h.add(historyEntry{Container: "b", Outcome: kindUpdateFailed})
+	if got, want := historyContainers(getHistory(t, "")), []string{"b", "a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("history = %v, want %v", got, want)
+	}
+}
+
+func TestHistoryRejectsBadRequests(t *testing.T) {
+	withHistory(t, 5)
+	for _, tt := range []struct {
+		method, query string
+		want          int
+	}{
+		{http.MethodPost, "", http.StatusMethodNotAllowed},
+		{http.MethodGet, "?limit=0", http.StatusBadRequest},
+		{http.MethodGet, "?limit=many", http.StatusBadRequest},
+	} {
+		rec := httptest.NewRecorder()
+		handleHistory(rec, httptest.NewRequest(tt.method, "/history"+tt.query, nil))
+		if rec.Code != tt.want {
+			t.Errorf("%s /history%s = %d, want %d", tt.method, tt.query, rec.Code, tt.want)
+		}
+	}
+}
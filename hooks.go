@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// Labels holding shell commands run inside a container around its update:
+// the pre hook in the old container before it is stopped, the post hook in
+// the new container once it is started.
+const (
+	preHookLabel  = "puller.hook.pre"
+	postHookLabel = "puller.hook.post"
+)
+
+// runPreUpdateHook runs the pre-update hook of a running container before it
+// is stopped. A failing hook aborts the update with -abort-on-hook-failure.
+func runPreUpdateHook(cli *client.Client, ctx context.Context, inspect types.ContainerJSON, name string) error {
+	hook := inspect.Config.Labels[preHookLabel]
+	if hook == "" || !inspect.State.Running {
+		return nil
+	}
+	logVerbose("Running pre-update hook for %s", name)
+	if err := runHook(cli, ctx, inspect.ID, name, "pre-update", hook); err != nil {
+		if *abortOnHookFailure {
+			return fmt.Errorf("pre-update hook failed: %w", err)
+		}
+		logWarn("Pre-update hook for %s failed, updating anyway: %v", name, err)
+	}
+	return nil
+}
+
+// runPostUpdateHook runs the post-update hook of the old container's labels
+// in the new container. A failing hook is only logged.
+func runPostUpdateHook(cli *client.Client, ctx context.Context, containerID, name string, labels map[string]string) {
+	hook := labels[postHookLabel]
+	if hook == "" {
+		return
+	}
+	logVerbose("Running post-update hook for %s", name)
+	if err := runHook(cli, ctx, containerID, name, "post-update", hook); err != nil {
+		logWarn("Post-update hook for %s failed: %v", name, err)
+	}
+}
+
+// runHook runs command with sh -c inside the container and fails when it
+// cannot be started, exceeds -hook-timeout or exits non-zero. The output is
+// logged at verbose level.
+func runHook(cli *client.Client, ctx context.Context, containerID, name, kind, command string) error {
+	ctx, cancel := context.WithTimeout(ctx, *hookTimeout)
+	defer cancel()
+
+	exec, err := cli.ContainerExecCreate(ctx, containerID, types.ExecConfig{
+		Cmd:          []string{"sh", "-c", command},
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return fmt.Errorf("create exec: %w", err)
+	}
+	attach, err := cli.ContainerExecAttach(ctx, exec.ID, types.ExecStartCheck{})
+	if err != nil {
+		return fmt.Errorf("start exec: %w", err)
+	}
+	defer attach.Close()
+
+	// Reads on the hijacked connection ignore the context, so the timeout
+	// is applied to the connection itself.
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = attach.Conn.SetDeadline(deadline)
+	}
+	var out bytes.Buffer
+	_, copyErr := stdcopy.StdCopy(&out, &out, attach.Reader)
+	if output := strings.TrimSpace(out.String()); output != "" {
+		logVerbose("%s hook output for %s:\n%s", kind, name, output)
+	}
+	if copyErr != nil {
+		return fmt.Errorf("read output: %w", copyErr)
+	}
+
+	// The exec can still be marked running for a moment after its output
+	// is closed.
+	for {
+		inspect, err := cli.ContainerExecInspect(ctx, exec.ID)
+		if err != nil {
+			return fmt.Errorf("inspect exec: %w", err)
+		}
+		if !inspect.Running {
+			if inspect.ExitCode != 0 {
+				return fmt.Errorf("exited with code %d", inspect.ExitCode)
+			}
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
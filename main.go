@@ -4,44 +4,207 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
+	"math/rand"
 	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"github.com/robfig/cron/v3"
+	"golang.org/x/time/rate"
 )
 
 var (
-	interval    = flag.Int("interval", 30, "Check interval in seconds")
-	cleanup     = flag.Bool("cleanup", false, "Remove old images after pulling")
-	labelEnable = flag.Bool("label-enable", false, "Only update containers with enable label")
-	verbose     = flag.Bool("verbose", false, "Enable verbose logging")
-	quiet       = flag.Bool("quiet", false, "Reduce logging to minimum (only errors and updates)")
-	enableLabel = "puller.update.enable"
+	interval             = secondsDurationFlag("interval", 30*time.Second, "Check interval, e.g. 90s or 6h; a bare number is seconds")
+	cleanup              = flag.Bool("cleanup", false, "Remove old images after pulling")
+	labelEnable          = flag.Bool("label-enable", false, "Only update containers with enable label")
+	verbose              = flag.Bool("verbose", false, "Deprecated: same as -log-level verbose")
+	quiet                = flag.Bool("quiet", false, "Deprecated: same as -log-level warn")
+	includeNames         = flag.String("include-names", "", "Only update containers whose name matches this regular expression")
+	excludeNames         = flag.String("exclude-names", "", "Never update containers whose name matches this regular expression")
+	headCheck            = flag.Bool("head-check", false, "Query the registry for the manifest digest and only pull when it changed")
+	notificationTimeout  = flag.Duration("notification-timeout", 10*time.Second, "Timeout for each notification request")
+	pullRetries          = flag.Int("pull-retries", 3, "Maximum attempts for a failing image pull")
+	pullRetryDelay       = flag.Duration("pull-retry-delay", 2*time.Second, "Initial delay between pull retries, doubled after each attempt")
+	includeStopped       = flag.Bool("include-stopped", false, "Also update containers that are not running")
+	pullsPerMinute       = flag.Int("pulls-per-minute", 0, "Maximum registry pulls per minute (0 = unlimited)")
+	cronSpec             = flag.String("cron", "", "Cron expression for scheduling checks; overrides -interval")
+	runOnStart           = flag.Bool("run-on-start", true, "Run a check immediately at startup")
+	httpAddr             = flag.String("http-addr", "", "Address for the HTTP status server (e.g. :8080); disabled when empty")
+	maxUpdatesPerCycle   = flag.Int("max-updates-per-cycle", 0, "Maximum containers to recreate per check cycle (0 = unlimited)")
+	healthTimeout        = flag.Duration("health-timeout", 0, "Wait up to this long for a recreated container with a healthcheck to become healthy (0 = do not wait)")
+	updatePinned         = flag.Bool("update-pinned", false, "Also check containers whose image is pinned to a digest (repo@sha256:...)")
+	stateFile            = flag.String("state-file", "", "Path to a JSON file persisting the last-seen image per container across restarts")
+	stopTimeout          = flag.Int("stop-timeout", 10, "Seconds to wait for a container to stop before killing it (0 = Docker default)")
+	notifyOn             = flag.String("notify-on", "update,error", "Comma-separated events that send notifications: start,complete,update,error,rollback")
+	includeRepos         = flag.String("include-repos", "", "Comma-separated glob patterns of image repositories to update (e.g. myorg/*)")
+	excludeRepos         = flag.String("exclude-repos", "", "Comma-separated glob patterns of image repositories never to update")
+	swarmMode            = flag.Bool("swarm", false, "Update Docker Swarm services via ServiceUpdate instead of standalone containers")
+	once                 = flag.Bool("once", false, "Run a single check and exit; the exit code is non-zero if any check failed")
+	notifySummary        = flag.Bool("notify-summary", false, "Send one summary notification per check cycle, even when nothing was updated")
+	notifyFormat         = flag.String("notify-format", "text", "Notification backend: text, gotify or ntfy (POST to NOTIFICATION_URL) or email (SMTP_* settings)")
+	platformOverride     = flag.String("platform", "", "Platform to pull (os/arch[/variant]) instead of the running image's platform")
+	updateWindowSpec     = flag.String("update-window", "", "Daily window in which containers may be recreated, e.g. 02:00-05:00")
+	updateWindowTZ       = flag.String("update-window-tz", "", "Time zone for -update-window (default: local time)")
+	notificationToken    = flag.String("notification-token", "", "Application token for Gotify, or access token for ntfy")
+	exitOnError          = flag.Int("exit-on-error", 0, "Exit non-zero after this many consecutive failed check cycles (0 = never)")
+	dockerHost           = flag.String("docker-host", "", "Docker daemon address (e.g. tcp://host:2376); defaults to DOCKER_HOST")
+	tlsCACert            = flag.String("tls-cacert", "", "CA certificate used to verify the Docker daemon")
+	tlsCert              = flag.String("tls-cert", "", "Client certificate for the Docker daemon (requires -tls-key)")
+	tlsKey               = flag.String("tls-key", "", "Client key for the Docker daemon (requires -tls-cert)")
+	tlsVerify            = flag.Bool("tls-verify", true, "Verify the Docker daemon certificate when TLS is used")
+	maxBackoff           = flag.Duration("max-backoff", 10*time.Minute, "Upper bound for the check interval while consecutive cycles fail (0 = no backoff)")
+	reportFile           = flag.String("report-file", "", "Write a JSON report of each container's outcome to this file after every cycle")
+	reportAppend         = flag.Bool("report-append", false, "Append one timestamped JSON line per cycle to -report-file instead of overwriting it")
+	composeProject       = flag.String("compose-project", "", "Only update containers of this Docker Compose project")
+	registryCACert       = flag.String("ca-cert", "", "Additional CA bundle (PEM) trusted for registry requests; defaults to REGISTRY_CA_CERT")
+	insecureRegistry     = flag.Bool("insecure-registry", false, "Skip TLS verification for registry requests (unsafe, for lab setups only)")
+	notifyAuth           = flag.String("notify-auth", "", "Authorization for notification requests: \"Bearer <token>\" or \"user:pass\" for basic auth")
+	notifyHeaders        headerList
+	tagMapSpec           = flag.String("tag-map", "", "Check a different tag than the one a container runs, as running=checked pairs (e.g. prod=stable,staging=edge)")
+	hookTimeout          = flag.Duration("hook-timeout", time.Minute, "Maximum run time of a pre- or post-update hook")
+	abortOnHookFailure   = flag.Bool("abort-on-hook-failure", true, "Abort an update when its pre-update hook fails")
+	registryMirrorSpec   = flag.String("registry-mirror", "", "Pull through a mirror: a host for docker.io, or comma-separated source=mirror pairs")
+	summaryJSON          = flag.String("summary-json", "", "Write a JSON summary line after each cycle to this file, or to stdout with -")
+	pullTimeout          = flag.Duration("pull-timeout", 10*time.Minute, "Maximum time for a single image pull or inspect (0 = no limit)")
+	cycleTimeout         = flag.Duration("cycle-timeout", time.Hour, "Maximum time for checking images in one cycle; remaining containers wait for the next cycle (0 = no limit)")
+	nameFilter           = flag.String("name-filter", "", "Comma-separated glob patterns; only containers whose name matches one are updated (e.g. web-*)")
+	startStopped         = flag.Bool("start-stopped", false, "Start updated containers that were stopped before the update")
+	containerList        = flag.String("containers", "", "Comma-separated container names; when set only these containers are checked")
+	restartStrategy      = flag.String("restart-strategy", strategyRecreate, "How updated containers pick up a new image: recreate, or restart, which falls back to recreate as Docker fixes the image of a container when it is created")
+	pullOnly             = flag.Bool("pull-only", false, "Pull and retag new images but never recreate containers")
+	apiTimeout           = flag.Duration("api-timeout", 60*time.Second, "Timeout for each Docker API call other than pulls (0 = none)")
+	eventURL             = flag.String("event-url", "", "URL receiving structured JSON events for every check and update")
+	eventAuth            = flag.String("event-auth", "", "Authorization for -event-url requests: \"Bearer <token>\" or \"user:pass\" for basic auth")
+	eventHeaders         headerList
+	notificationTemplate = flag.String("notification-template", "", "Go text/template for notification messages, e.g. \"{{.Host}}: {{.Message}}\"")
+	rollback             = flag.Bool("rollback", false, "Roll a container back to its previous image when it fails the health check after an update")
+	rollbackHistory      = flag.Int("rollback-history", 1, "Number of previous images per container kept as rollback targets")
+	notifyDedupe         = flag.Duration("notify-dedupe", 0, "Suppress repeated identical error notifications within this window (0 = send all)")
+	watchEvents          = flag.Bool("watch-events", false, "Also run a check when a container starts or an image is pulled, based on the Docker event stream")
+	cleanupMode          = flag.String("cleanup-mode", cleanupReplaced, "What -cleanup removes: replaced (the image an updated container ran) or prune (all dangling images)")
+	composeSafe          = flag.Bool("compose-safe", false, "Update Compose containers with docker compose up instead of recreating them directly")
+	composeTimeout       = flag.Duration("compose-timeout", 5*time.Minute, "Timeout for each docker compose up run by -compose-safe (0 = none)")
+	intervalJitter       = flag.Duration("interval-jitter", 0, "Randomize each interval by up to this much in either direction")
+	startJitter          = flag.Duration("start-jitter", 0, "Delay the initial check by a random duration up to this much")
+	failFast             = flag.Bool("fail-fast", false, "Abort a check cycle at the first container that fails")
+	dockerConfigPath     = flag.String("docker-config", "", "Docker config.json (or its directory) to read registry credentials and credential helpers from")
+	maxParallelRecreate  = flag.Int("max-parallel-recreate", 1, "Maximum number of containers recreated at the same time")
+	authCommand          = flag.String("auth-command", "", "Command printing registry credentials as JSON, run again when they near expiry")
+	pinDigest            = flag.Bool("pin-digest", false, "Recreate updated containers from the exact pulled digest instead of the floating tag")
+	verifySignatures     = flag.Bool("verify-signatures", false, "Verify the cosign signature of a new image before recreating a container from it")
+	cosignKey            = flag.String("cosign-key", "", "Public key for -verify-signatures: a PEM file or a KMS URI such as awskms:// or gcpkms://")
+	cosignIdentity       = flag.String("cosign-identity", "", "Regular expression for the certificate identity of keyless signatures")
+	cosignIssuer         = flag.String("cosign-issuer", "", "OIDC issuer of keyless signatures, e.g. https://token.actions.githubusercontent.com")
+	updateDelay          = flag.Duration("update-delay", 0, "Wait this long after a new image is first seen before applying it, restarting the wait if the image changes again")
+	envFile              = flag.String("env-file", ".env", "File of KEY=VALUE lines loaded into the environment; variables already set take precedence")
+	historySize          = flag.Int("history-size", 100, "Number of update events kept for GET /history")
+	keepImages           = flag.Int("keep-images", 0, "Number of previous images kept per container by -cleanup; older ones are removed")
+	enableDefault        = flag.Bool("enable-default", true, "Update containers without the enable label; false is the same as -label-enable")
+	notifyDigest         = flag.Bool("notify-digest", false, "Collect the notifications of a check cycle and send them as one message when it ends")
+	serveWebhook         = flag.Bool("serve-webhook", false, "Check containers when POST /webhook on -http-addr reports a registry push, instead of polling")
+	logLevel             = flag.String("log-level", "info", "Minimum level logged: error, warn, info or verbose; [UPDATE] lines are always logged")
+	logTime              = flag.Bool("log-time", true, "Prefix log lines with the date and time; disable when the platform adds timestamps")
+	enableLabel          = flag.String("enable-label", "puller.update.enable", "Label key checked by -label-enable and for opting a container out with =false")
+	ignoreLabel          = "puller.ignore"
+	stopTimeoutLabel     = "puller.stop.timeout"
 )
 
+const healthPollInterval = 2 * time.Second
+
+// errAutoRemove is returned by recreateContainer for containers started with
+// --rm, which are not recreated.
+var errAutoRemove = errors.New("container was started with --rm")
+
+// announcedImages maps containers to the new image announced for them in
+// -pull-only mode, so each image is only announced once.
+var announcedImages = make(map[string]string)
+
+// detectedUpdate is the new image first seen for a container and when, for
+// -update-delay.
+type detectedUpdate struct {
+	imageID string
+	at      time.Time
+}
+
+// detectedUpdates maps container IDs to the update waiting out -update-delay.
+var detectedUpdates = make(map[string]detectedUpdate)
+
+// Log levels selectable with -log-level, from least to most output.
+const (
+	levelError = iota
+	levelWarn
+	levelInfo
+	levelVerbose
+)
+
+var levelNames = map[string]int{
+	"error":   levelError,
+	"warn":    levelWarn,
+	"info":    levelInfo,
+	"verbose": levelVerbose,
+}
+
+// currentLevel is the level set by setupLogging.
+var currentLevel = levelInfo
+
+// setupLogging applies -log-level and -log-time. The deprecated -verbose and
+// -quiet flags map onto levels unless -log-level is given.
+func setupLogging() error {
+	level, ok := levelNames[strings.ToLower(*logLevel)]
+	if !ok {
+		return fmt.Errorf("unknown -log-level %q: must be error, warn, info or verbose", *logLevel)
+	}
+	if !flagWasSet("log-level") {
+		switch {
+		case *quiet:
+			level = levelWarn
+		case *verbose:
+			level = levelVerbose
+		}
+	}
+	currentLevel = level
+	if !*logTime {
+		log.SetFlags(0)
+	}
+	return nil
+}
+
+// logEnabled reports whether messages of level are logged.
+func logEnabled(level int) bool {
+	return currentLevel >= level
+}
+
 // Logging helpers
 func logInfo(format string, v ...interface{}) {
-	if !*quiet {
+	if logEnabled(levelInfo) {
 		log.Printf("[INFO] "+format, v...)
 	}
 }
 func logVerbose(format string, v ...interface{}) {
-	if *verbose && !*quiet {
+	if logEnabled(levelVerbose) {
 		log.Printf("[VERBOSE] "+format, v...)
 	}
 }
 func logWarn(format string, v ...interface{}) {
-	log.Printf("[WARN] "+format, v...)
+	if logEnabled(levelWarn) {
+		log.Printf("[WARN] "+format, v...)
+	}
 }
 func logError(format string, v ...interface{}) {
 	log.Printf("[ERROR] "+format, v...)
@@ -50,28 +213,250 @@ func logUpdate(format string, v ...interface{}) {
 	log.Printf("[UPDATE] "+format, v...)
 }
 
+func init() {
+	flag.StringVar(notifyFormat, "notification-format", "text", "Alias for -notify-format")
+	flag.DurationVar(notificationTimeout, "notify-timeout", 10*time.Second, "Alias for -notification-timeout")
+	flag.Var(&imagePrefixes, "image-prefix", "Repository prefix a container's image must start with to be eligible, e.g. ghcr.io/myorg/ (repeatable)")
+	flag.Var(&notifyHeaders, "notify-header", "Extra header for notification requests as Key=Value (repeatable)")
+	flag.Var(&eventHeaders, "event-header", "Extra header for -event-url requests as Key=Value (repeatable)")
+}
+
+// secondsDuration is a duration flag that also accepts a bare number of
+// seconds, as -interval used to be an integer.
+type secondsDuration time.Duration
+
+func (d *secondsDuration) String() string { return time.Duration(*d).String() }
+
+func (d *secondsDuration) Set(value string) error {
+	if secs, err := strconv.Atoi(value); err == nil {
+		*d = secondsDuration(time.Duration(secs) * time.Second)
+		return nil
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("%q is neither a duration nor a number of seconds", value)
+	}
+	*d = secondsDuration(parsed)
+	return nil
+}
+
+// secondsDurationFlag defines a flag like flag.Duration that also accepts a
+// bare number of seconds.
+func secondsDurationFlag(name string, value time.Duration, usage string) *time.Duration {
+	d := value
+	flag.Var((*secondsDuration)(&d), name, usage)
+	return &d
+}
+
+// flagWasSet reports whether the named flag was given on the command line.
+func flagWasSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
 func main() {
 	flag.Parse()
+	if err := setupLogging(); err != nil {
+		log.Fatal(err)
+	}
+	if (flagWasSet("verbose") || flagWasSet("quiet")) && !flagWasSet("log-level") {
+		logWarn("-verbose and -quiet are deprecated, use -log-level")
+	}
+
+	// The env file is loaded first, so everything below sees its variables.
+	if err := loadEnvFileFlag(*envFile, flagWasSet("env-file")); err != nil {
+		log.Fatalf("Error loading -env-file: %v", err)
+	}
+
+	// -enable-default is the inverse of -label-enable.
+	if flagWasSet("enable-default") {
+		if flagWasSet("label-enable") && *labelEnable == *enableDefault {
+			log.Fatalf("-enable-default=%v contradicts -label-enable=%v", *enableDefault, *labelEnable)
+		}
+		*labelEnable = !*enableDefault
+	}
+
+	if *interval <= 0 {
+		log.Fatalf("Invalid -interval %s: must be positive", *interval)
+	}
+	if err := compileNameFilters(*includeNames, *excludeNames, *nameFilter); err != nil {
+		log.Fatalf("Invalid name filter: %v", err)
+	}
+	allowedNames = parseContainerList(*containerList)
+	if *maxParallelRecreate < 1 {
+		log.Fatalf("Invalid -max-parallel-recreate %d: must be at least 1", *maxParallelRecreate)
+	}
+	if *dockerConfigPath != "" {
+		var err error
+		if dockerCredentials, err = loadDockerConfig(*dockerConfigPath); err != nil {
+			log.Fatalf("Error loading -docker-config: %v", err)
+		}
+		logInfo("Using registry credentials from %s", *dockerConfigPath)
+	}
+	if *verifySignatures {
+		if err := validateSignatureConfig(); err != nil {
+			log.Fatalf("Invalid -verify-signatures settings: %v", err)
+		}
+	}
+	if *cleanupMode != cleanupReplaced && *cleanupMode != cleanupPrune {
+		log.Fatalf("Invalid -cleanup-mode %q: must be %s or %s", *cleanupMode, cleanupReplaced, cleanupPrune)
+	}
+	if strategy, err := selectRestartStrategy(*restartStrategy); err != nil {
+		log.Fatalf("Invalid -restart-strategy: %v", err)
+	} else {
+		*restartStrategy = strategy
+	}
+	if *swarmMode {
+		if err := validateSwarmFlags(); err != nil {
+			log.Fatalf("Invalid -swarm settings: %v", err)
+		}
+	}
+	if *composeSafe && *pinDigest {
+		log.Fatalf("-pin-digest cannot be combined with -compose-safe, as Compose creates containers from the image named in the Compose file")
+	}
+	if err := compileRepoFilters(*includeRepos, *excludeRepos); err != nil {
+		log.Fatalf("Invalid repository filter: %v", err)
+	}
+	if *platformOverride != "" {
+		if err := validatePlatform(*platformOverride); err != nil {
+			log.Fatalf("Invalid -platform: %v", err)
+		}
+	}
+	if *registryMirrorSpec != "" {
+		var err error
+		if registryMirrors, err = parseRegistryMirrors(*registryMirrorSpec); err != nil {
+			log.Fatalf("Invalid -registry-mirror: %v", err)
+		}
+	}
+	if *tagMapSpec != "" {
+		var err error
+		if tagMapping, err = parseTagMap(*tagMapSpec); err != nil {
+			log.Fatalf("Invalid -tag-map: %v", err)
+		}
+	}
+	if *updateWindowSpec != "" {
+		var err error
+		if maintenanceWindow, err = parseUpdateWindow(*updateWindowSpec, *updateWindowTZ); err != nil {
+			log.Fatalf("Invalid -update-window: %v", err)
+		}
+		logInfo("Containers will only be recreated during %s", maintenanceWindow)
+	}
+
+	if *stateFile != "" {
+		var err error
+		if state, err = loadState(*stateFile); err != nil {
+			log.Fatalf("Error loading state file: %v", err)
+		}
+		logInfo("Loaded state for %d containers from %s", len(state.Containers), *stateFile)
+	}
+	if *rollback {
+		if *healthTimeout <= 0 {
+			logWarn("-rollback has no effect without -health-timeout")
+		}
+		if *rollbackHistory < 1 {
+			log.Fatalf("Invalid -rollback-history %d: must be at least 1", *rollbackHistory)
+		}
+	}
+	if *serveWebhook {
+		if *httpAddr == "" {
+			log.Fatalf("-serve-webhook needs -http-addr")
+		}
+		if os.Getenv("WEBHOOK_SECRET") == "" {
+			logWarn("WEBHOOK_SECRET is not set, webhook requests are not authenticated")
+		}
+	}
+	if *keepImages < 0 {
+		log.Fatalf("Invalid -keep-images %d: must not be negative", *keepImages)
+	}
+	if *keepImages > 0 {
+		if *cleanupMode == cleanupPrune {
+			log.Fatalf("-keep-images cannot be combined with -cleanup-mode %s, which removes the kept images once they are dangling", cleanupPrune)
+		}
+		if !*cleanup {
+			logWarn("-keep-images has no effect without -cleanup")
+		}
+	}
+	if historyLimit() > 0 && state == nil {
+		// Previous images, bad images and rollback targets are then only
+		// remembered until the puller restarts.
+		state = &stateStore{Containers: make(map[string]containerState)}
+	}
 
 	registryUser := os.Getenv("REGISTRY_USERNAME")
 	registryPass := os.Getenv("REGISTRY_PASSWORD")
 	registryURL := os.Getenv("REGISTRY_URL")
 	registryTag := os.Getenv("REGISTRY_TAG")
-	notificationURL := os.Getenv("NOTIFICATION_URL")
 
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	caFile := *registryCACert
+	if caFile == "" {
+		caFile = os.Getenv("REGISTRY_CA_CERT")
+	}
+	var err error
+	if registryTLS, err = loadRegistryTLS(caFile, *insecureRegistry); err != nil {
+		log.Fatalf("Invalid registry CA certificate: %v", err)
+	}
+	if *insecureRegistry {
+		logWarn("TLS verification is DISABLED for registry requests (-insecure-registry); do not use this outside a lab")
+	}
+	var notificationURLs []string
+	for _, u := range strings.Split(os.Getenv("NOTIFICATION_URL"), ",") {
+		if u = strings.TrimSpace(u); u == "" {
+			continue
+		}
+		if err := validateNotificationURL(u); err != nil {
+			log.Fatalf("Invalid NOTIFICATION_URL %q: %v", u, err)
+		}
+		notificationURLs = append(notificationURLs, u)
+	}
+
+	events, err := parseEventSet(*notifyOn)
+	if err != nil {
+		log.Fatalf("Invalid -notify-on: %v", err)
+	}
+
+	clientOpts, err := dockerClientOptions()
+	if err != nil {
+		log.Fatalf("Invalid Docker connection settings: %v", err)
+	}
+	cli, err := client.NewClientWithOpts(clientOpts...)
 	if err != nil {
 		log.Fatalf("Error creating Docker client: %v", err)
 	}
 	defer cli.Close()
 
+	pingCtx, cancel := withAPITimeout(context.Background())
+	_, err = cli.Ping(pingCtx)
+	cancel()
+	if err != nil {
+		log.Fatalf("Cannot reach the Docker daemon at %s: %v (check DOCKER_HOST or -docker-host and the socket permissions)", cli.DaemonHost(), err)
+	}
+	status.recordPing()
+	logVerbose("Connected to Docker daemon at %s", cli.DaemonHost())
+
+	if !*swarmMode {
+		// Service mode is opt-in, so a manager keeps updating its standalone
+		// containers unless told otherwise.
+		if active, manager, err := detectSwarm(cli, context.Background()); err != nil {
+			logVerbose("Could not detect Swarm mode: %v", err)
+		} else if active && manager {
+			logInfo("This node is a Swarm manager; pass -swarm to update services instead of standalone containers")
+		}
+	}
+
 	if registryURL == "https://registry-1.docker.io/v2/" && registryUser != "" && registryPass != "" {
 		authConfig := types.AuthConfig{
 			Username:      registryUser,
 			Password:      registryPass,
 			ServerAddress: "https://index.docker.io/v1/",
 		}
-		_, err = cli.RegistryLogin(context.Background(), authConfig)
+		loginCtx, cancel := withAPITimeout(context.Background())
+		_, err = cli.RegistryLogin(loginCtx, authConfig)
+		cancel()
 		if err != nil {
 			logError("Docker login failed: %v", err)
 		} else {
@@ -79,209 +464,806 @@ func main() {
 		}
 	}
 
-	logInfo("Starting puller service with interval: %ds", *interval)
+	var schedule cron.Schedule
+	if *once {
+		if flagWasSet("cron") || flagWasSet("interval") {
+			logWarn("-once given, ignoring -cron and -interval")
+		}
+		logInfo("Starting puller for a single check")
+	} else if *serveWebhook {
+		if flagWasSet("cron") || flagWasSet("interval") || *watchEvents {
+			logWarn("-serve-webhook given, ignoring -cron, -interval and -watch-events")
+		}
+		logInfo("Starting puller service driven by registry webhooks")
+	} else if *cronSpec != "" {
+		schedule, err = cron.ParseStandard(*cronSpec)
+		if err != nil {
+			log.Fatalf("Invalid cron expression %q: %v", *cronSpec, err)
+		}
+		if flagWasSet("interval") {
+			logWarn("Both -cron and -interval given, using cron schedule")
+		}
+		logInfo("Starting puller service with cron schedule: %s", *cronSpec)
+		status.setSchedule(0, *cronSpec)
+	} else {
+		logInfo("Starting puller service with interval: %s", *interval)
+		status.setSchedule(*interval, "")
+	}
 	logInfo("Cleanup enabled: %v", *cleanup)
 	logInfo("Label filtering enabled: %v", *labelEnable)
-	if *verbose {
-		logInfo("Verbose logging enabled")
+	logVerbose("Verbose logging enabled")
+	var notifier Notifier = NoopNotifier{}
+	switch *notifyFormat {
+	case "email":
+		cfg, err := loadSMTPConfig()
+		if err != nil {
+			log.Fatalf("Invalid email notification settings: %v", err)
+		}
+		emailNotifications = &emailBatcher{cfg: cfg}
+		notifier = emailNotifications
+		logInfo("Email notifications enabled: %s -> %s", cfg.host, strings.Join(cfg.to, ", "))
+		startNotifier()
+	default:
+		if _, err := newNotifier(*notifyFormat, "", *notificationToken); err != nil {
+			log.Fatalf("Invalid notification settings: %v", err)
+		}
+		if err := validateNotifyAuth(*notifyAuth); err != nil {
+			log.Fatalf("Invalid -notify-auth: %v", err)
+		}
+		var backends MultiNotifier
+		for _, u := range notificationURLs {
+			n, _ := newNotifier(*notifyFormat, u, *notificationToken)
+			backends = append(backends, queuedNotifier{next: n})
+			logInfo("Notifications enabled (%s): %s", *notifyFormat, u)
+		}
+		if len(backends) > 0 {
+			notifier = backends
+			notificationClient.Timeout = *notificationTimeout
+			startNotifier()
+		}
+	}
+	if *notifyDigest {
+		notificationDigest = &digestNotifier{next: notifier}
+		notifier = notificationDigest
+	}
+	if *notificationTemplate != "" {
+		tmpl, err := parseNotificationTemplate(*notificationTemplate)
+		if err != nil {
+			log.Fatalf("Invalid -notification-template: %v", err)
+		}
+		host, _ := os.Hostname()
+		notifier = templateNotifier{tmpl: tmpl, host: host, next: notifier}
+	}
+	if *notifyDedupe > 0 {
+		notifier = newDedupeNotifier(*notifyDedupe, notifier)
 	}
-	if *quiet {
-		logInfo("Quiet mode enabled - only errors and updates will be shown")
+	notifier = eventFilter{events: events, next: notifier}
+	if *eventURL != "" {
+		if err := validateNotificationURL(*eventURL); err != nil {
+			log.Fatalf("Invalid -event-url: %v", err)
+		}
+		if err := validateNotifyAuth(*eventAuth); err != nil {
+			log.Fatalf("Invalid -event-auth: %v", err)
+		}
+		// Structured events bypass -notify-on: the consumer filters them.
+		sink := EventWebhookNotifier{URL: *eventURL, Auth: *eventAuth, Headers: eventHeaders}
+		notifier = MultiNotifier{notifier, queuedNotifier{next: sink}}
+		notificationClient.Timeout = *notificationTimeout
+		if notifierDone == nil {
+			startNotifier()
+		}
+		logInfo("Structured events enabled: %s", *eventURL)
 	}
-	if notificationURL != "" {
-		logInfo("Notifications enabled: %s", notificationURL)
+	if *httpAddr != "" {
+		if *historySize < 1 {
+			log.Fatalf("Invalid -history-size %d: must be at least 1", *historySize)
+		}
+		history = newUpdateHistory(*historySize)
+		notifier = historyRecorder{history: history, next: notifier}
 	}
 	if registryTag != "" {
 		logInfo("Additional registry tag to check: %s", registryTag)
 	}
 
-	ticker := time.NewTicker(time.Duration(*interval) * time.Second)
-	defer ticker.Stop()
+	if *pullsPerMinute > 0 {
+		pullLimiter = rate.NewLimiter(rate.Limit(float64(*pullsPerMinute)/60), 1)
+		logInfo("Registry pulls limited to %d per minute", *pullsPerMinute)
+	}
 
-	if err := checkContainers(cli, registryURL, registryUser, registryPass, registryTag, notificationURL); err != nil {
-		logError("Error in initial check: %v", err)
-		notify(notificationURL, "Error in initial check: "+err.Error())
+	if *httpAddr != "" {
+		if err := startHTTPServer(*httpAddr, cli); err != nil {
+			log.Fatalf("Error starting HTTP server on %s: %v", *httpAddr, err)
+		}
+		logInfo("HTTP server listening on %s", *httpAddr)
 	}
 
-	for range ticker.C {
-		if err := checkContainers(cli, registryURL, registryUser, registryPass, registryTag, notificationURL); err != nil {
-			logError("Error in check cycle: %v", err)
-			notify(notificationURL, "Error in check cycle: "+err.Error())
+	consecutiveFailures := 0
+	cycleErrors := 0
+	check := func(phase string) {
+		status.startCycle()
+		pingCtx, cancel := withAPITimeout(context.Background())
+		if _, err := cli.Ping(pingCtx); err == nil {
+			status.recordPing()
+		}
+		cancel()
+
+		var err error
+		if *swarmMode {
+			authConfig := buildAuthConfig(registryURL, registryUser, registryPass)
+			var registry digestResolver
+			if *headCheck {
+				registry = newRegistryClient(authConfig)
+			}
+			err = checkServices(cli, cli, registry, authConfig, notifier)
+		} else {
+			err = checkContainers(cli, registryURL, registryUser, registryPass, registryTag, notifier)
+		}
+		status.finishCycle(err)
+		// Only the transitions between failing and healthy cycles are
+		// notified, so a daemon outage does not send one message per cycle.
+		if err != nil {
+			logError("Error in %s: %v", phase, err)
+			if cycleErrors == 0 {
+				notifyEvent(context.Background(), notifier, Event{Type: eventError, Message: "Error in " + phase + ": " + err.Error()})
+			}
+			cycleErrors++
+		} else if cycleErrors > 0 {
+			msg := fmt.Sprintf("Checks recovered after %d failed cycles", cycleErrors)
+			logInfo(msg)
+			// The recovery is selected with -notify-on=error like the failure
+			// it ends, but it is not an error: it is sent at info severity,
+			// which also keeps -notify-dedupe from suppressing it.
+			notifyEvent(context.Background(), notifier, Event{Type: eventError, Kind: kindCheckRecovered, Severity: severityInfo, Message: msg})
+			cycleErrors = 0
+		}
+		notificationDigest.flush()
+		emailNotifications.flush()
+
+		if !status.failed() {
+			consecutiveFailures = 0
+			return
+		}
+		consecutiveFailures++
+		if *exitOnError > 0 && !*once && consecutiveFailures >= *exitOnError {
+			logError("%d consecutive check cycles failed, exiting", consecutiveFailures)
+			flushNotifications(notificationFlushTimeout)
+			os.Exit(1)
 		}
 	}
-}
 
-func notify(url, message string) {
-	if url == "" {
+	if *once {
+		check("check")
+		flushNotifications(notificationFlushTimeout)
+		if code := onceExitCode(status); code != 0 {
+			os.Exit(code)
+		}
 		return
 	}
-	resp, err := http.Post(url, "text/plain", strings.NewReader(message))
-	if err != nil {
-		logError("Error sending notification: %v", err)
+
+	var trigger chan struct{}
+	if *watchEvents && !*serveWebhook {
+		trigger = make(chan struct{}, 1)
+		go watchDockerEvents(context.Background(), cli, trigger)
+		logInfo("Watching Docker events for container starts and image pulls")
+	}
+	// runForEvents checks only the containers and repositories named by the
+	// events that ended the wait.
+	runForEvents := func() {
+		targetContainers, targetRepos = takeEventTargets()
+		check("event-triggered check")
+		targetContainers, targetRepos = nil, nil
+	}
+
+	if *runOnStart {
+		if *startJitter > 0 {
+			delay := time.Duration(rand.Int63n(int64(*startJitter)))
+			logVerbose("Delaying initial check by %s", delay.Round(time.Second))
+			time.Sleep(delay)
+		}
+		check("initial check")
+	}
+
+	if *serveWebhook {
+		logInfo("Waiting for registry webhooks instead of polling")
+		for range webhookPushes.signal {
+			targetRepos = takePushes()
+			check("webhook-triggered check")
+			targetRepos = nil
+		}
+	}
+
+	if schedule != nil {
+		for {
+			next := schedule.Next(time.Now())
+			status.setNextCheck(next)
+			logVerbose("Next check scheduled at %s", next.Format(time.RFC3339))
+			if waitForCheck(time.Until(next), trigger) {
+				runForEvents()
+				continue
+			}
+			check("check cycle")
+		}
+	}
+
+	period := *interval
+	for {
+		delay := backoffDelay(period, cycleErrors, *maxBackoff)
+		if delay > period {
+			logVerbose("Backing off after %d failed cycles, next check in %s", cycleErrors, delay)
+		}
+		delay = jitter(delay, *intervalJitter)
+		status.setNextCheck(time.Now().Add(delay))
+		if waitForCheck(delay, trigger) {
+			runForEvents()
+			continue
+		}
+		check("check cycle")
+	}
+}
+
+// onceExitCode returns the exit code of a -once run: 1 when the cycle returned
+// an error or failed to check or update any container, 0 otherwise.
+func onceExitCode(s *statusTracker) int {
+	if s.failed() {
+		return 1
+	}
+	return 0
+}
+
+// deferForRateLimit reports a registry rate limit once, then only logs the
+// containers or services whose checks are deferred because of it.
+func deferForRateLimit(ctx context.Context, notifier Notifier, display string) {
+	if rateLimitAnnounced {
+		logVerbose("Deferring %s: rate limited by registry until %s", display, rateLimitedUntil.Format(time.RFC3339))
 		return
 	}
-	defer resp.Body.Close()
+	rateLimitAnnounced = true
+	logWarn("rate limited by registry, deferring remaining checks")
+	notifyEvent(ctx, notifier, Event{
+		Type:    eventError,
+		Message: fmt.Sprintf("Rate limited by registry, deferring checks until %s", rateLimitedUntil.Format(time.RFC3339)),
+	})
+}
 
-	if resp.StatusCode >= 400 {
-		logWarn("Notification failed with status: %d", resp.StatusCode)
-	} else {
-		logVerbose("Notification sent successfully")
+// gateUpdates holds back the updates that -pull-only, -update-delay, the
+// update window and -max-updates-per-cycle do not allow in this cycle,
+// passing their results to skip, and returns the updates to apply now.
+// Containers and Swarm services go through the same gates.
+func gateUpdates(ctx context.Context, pending []pendingUpdate, notifier Notifier, skip func(containerResult)) []pendingUpdate {
+	if *pullOnly {
+		for _, p := range pending {
+			if announcedImages[p.id] != p.result.NewImageID {
+				announcedImages[p.id] = p.result.NewImageID
+				msg := fmt.Sprintf("New image available for %s: %s (not applied, -pull-only)", p.name, p.newImage)
+				logInfo(msg)
+				event := p.event(eventUpdate, msg)
+				event.Kind = kindUpdateAvailable
+				notifyEvent(ctx, notifier, event)
+			}
+			skip(p.result)
+		}
+		pending = nil
+	}
+
+	now := clock()
+	if *updateDelay > 0 {
+		// A container that no longer has an update waiting, because the tag
+		// moved back or the check failed, starts over when one shows up.
+		waiting := make(map[string]bool, len(pending))
+		for _, p := range pending {
+			waiting[p.id] = true
+		}
+		for id := range detectedUpdates {
+			if !waiting[id] {
+				delete(detectedUpdates, id)
+			}
+		}
+		settled := pending[:0]
+		for _, p := range pending {
+			seen, ok := detectedUpdates[p.id]
+			if !ok || seen.imageID != p.result.NewImageID {
+				// A new image, or one that changed again during the delay,
+				// starts a new wait.
+				detectedUpdates[p.id] = detectedUpdate{imageID: p.result.NewImageID, at: now}
+				logInfo("New image for %s detected, applying it after %s if it does not change", displayName(p.name, p.labels), *updateDelay)
+				skip(p.result)
+				continue
+			}
+			if wait := seen.at.Add(*updateDelay).Sub(now); wait > 0 {
+				logVerbose("Update for %s waiting %s more for -update-delay", displayName(p.name, p.labels), wait.Round(time.Second))
+				skip(p.result)
+				continue
+			}
+			delete(detectedUpdates, p.id)
+			settled = append(settled, p)
+		}
+		pending = settled
+	}
+
+	inWindow := pending[:0]
+	for _, p := range pending {
+		window := windowFor(p.labels)
+		if window.contains(now) {
+			delete(deferredUpdates, p.id)
+			inWindow = append(inWindow, p)
+			continue
+		}
+		skip(p.result)
+		if deferredUpdates[p.id] {
+			logVerbose("Update for %s still waiting for update window %s", displayName(p.name, p.labels), window)
+			continue
+		}
+		deferredUpdates[p.id] = true
+		msg := fmt.Sprintf("Update available for %s, deferred until update window %s", p.name, window)
+		logInfo(msg)
+		event := p.event(eventUpdate, msg)
+		event.Kind = kindUpdateAvailable
+		notifyEvent(ctx, notifier, event)
+	}
+	pending = inWindow
+
+	budgeted := applyUpdateBudget(pending, *maxUpdatesPerCycle)
+	if len(budgeted) < len(pending) {
+		kept := make(map[string]bool, len(budgeted))
+		for _, p := range budgeted {
+			kept[p.id] = true
+		}
+		for _, p := range pending {
+			if !kept[p.id] {
+				skip(p.result)
+			}
+		}
+	}
+	return budgeted
+}
+
+// jitter shifts d by a random amount of up to spread in either direction,
+// never returning less than a second.
+func jitter(d, spread time.Duration) time.Duration {
+	if spread <= 0 {
+		return d
 	}
+	d += time.Duration(rand.Int63n(int64(2*spread)+1)) - spread
+	if d < time.Second {
+		return time.Second
+	}
+	return d
 }
 
-func checkContainers(cli *client.Client, registryURL, user, pass, registryTag, notificationURL string) error {
+// backoffDelay returns the wait before the next check: base, doubled for each
+// consecutive failed cycle and capped at limit. A limit not above base disables
+// the backoff.
+func backoffDelay(base time.Duration, failures int, limit time.Duration) time.Duration {
+	if failures == 0 || limit <= base {
+		return base
+	}
+	delay := base
+	for i := 0; i < failures && delay < limit; i++ {
+		delay *= 2
+	}
+	if delay > limit {
+		return limit
+	}
+	return delay
+}
+
+// containerName returns the display name of a container, falling back to the
+// short container ID when the API returns no names (e.g. while it is being
+// created or removed).
+func containerName(c types.Container) string {
+	if len(c.Names) > 0 && c.Names[0] != "" {
+		return strings.TrimPrefix(c.Names[0], "/")
+	}
+	if len(c.ID) > 12 {
+		return c.ID[:12]
+	}
+	return c.ID
+}
+
+func checkContainers(cli *client.Client, registryURL, user, pass, registryTag string, notifier Notifier) error {
 	ctx := context.Background()
+	if *cycleTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *cycleTimeout)
+		defer cancel()
+	}
+	started := time.Now()
+	report := newCycleReport()
+	notifyEvent(ctx, notifier, Event{Type: eventStart, Message: "Check started"})
 
 	opts := types.ContainerListOptions{All: true}
 	if *labelEnable {
-		opts.Filters = filters.NewArgs(filters.Arg("label", enableLabel+"=true"))
+		opts.Filters = filters.NewArgs(filters.Arg("label", *enableLabel+"=true"))
 	}
 
-	containers, err := cli.ContainerList(ctx, opts)
+	listCtx, cancel := withAPITimeout(ctx)
+	containers, err := cli.ContainerList(listCtx, opts)
+	cancel()
 	if err != nil {
 		return fmt.Errorf("error listing containers: %v", err)
 	}
+	containers = selectContainers(containers)
+	sortByUpdateOrder(containers)
 
 	eligibleContainers := 0
+	total := len(containers)
+	kept := containers[:0]
 	for _, c := range containers {
-		imageName := c.Image
+		imageName := floatingImage(c)
 
 		if strings.HasPrefix(imageName, "sha256:") {
-			imgInspect, _, err := cli.ImageInspectWithRaw(ctx, c.ImageID)
+			inspectCtx, cancel := withAPITimeout(ctx)
+			imgInspect, _, err := cli.ImageInspectWithRaw(inspectCtx, c.ImageID)
+			cancel()
 			if err == nil && len(imgInspect.RepoTags) > 0 {
 				imageName = imgInspect.RepoTags[0]
 				logVerbose("Resolved digest %s to tag %s", c.Image, imageName)
 			}
 		}
 
-		if strings.Contains(imageName, registryURL) || strings.Contains(imageName, user) {
+		if !matchesRepoFilters(imageName) {
+			logVerbose("Skipping %s: repository excluded by repo filters", imageName)
+			continue
+		}
+		// Explicit prefixes replace the registry and user heuristic below.
+		if len(imagePrefixes) > 0 && !hasImagePrefix(imageName) {
+			logVerbose("Skipping %s: image does not start with any -image-prefix", imageName)
+			continue
+		}
+		kept = append(kept, c)
+
+		// Containers named with -containers are always checked.
+		if allowedNames != nil || len(imagePrefixes) > 0 || strings.Contains(imageName, registryURL) || strings.Contains(imageName, user) {
 			eligibleContainers++
 		}
 	}
+	containers = kept
+	// Containers excluded by the repository and prefix filters count as
+	// skipped, like those that are checked and left alone.
+	excluded := total - len(kept)
 
-	logVerbose("Found %d total containers, %d eligible for updates", len(containers), eligibleContainers)
+	logVerbose("Found %d total containers, %d eligible for updates", total, eligibleContainers)
 	if eligibleContainers == 0 {
 		logVerbose("No eligible containers found, skipping check")
+		status.recordContainers(0, nil, 0)
+		if err := report.write(); err != nil {
+			logWarn("Failed to write report file: %v", err)
+		}
+		if err := report.writeSummary(0, 0, 0, excluded, 0, time.Since(started)); err != nil {
+			logWarn("Failed to write JSON summary: %v", err)
+		}
+		notifyEvent(ctx, notifier, Event{Type: eventComplete, Message: "Check completed: no eligible containers"})
+		sendCycleSummary(ctx, notifier, 0, 0, excluded, 0, time.Since(started))
 		return nil
 	}
 
-	var authConfig types.AuthConfig
-	if user != "" && pass != "" {
-		authConfig = types.AuthConfig{
-			Username:      user,
-			Password:      pass,
-			ServerAddress: registryURL,
-		}
-		if registryURL == "" || registryURL == "docker.io" || registryURL == "https://docker.io" || registryURL == "https://registry-1.docker.io/v2/" {
-			authConfig.ServerAddress = "https://index.docker.io/v1/"
-		}
-	} else {
-		authConfig = types.AuthConfig{}
+	authConfig := buildAuthConfig(registryURL, user, pass)
+
+	cache := newPullCache()
+	var registry, tagLister *registryClient
+	if *headCheck {
+		registry = newRegistryClient(authConfig)
 	}
 
 	updatedContainers := 0
-	skippedContainers := 0
+	skippedContainers := excluded
+	failedContainers := 0
+	var pending []pendingUpdate
+	// skip counts a container that was checked but is not updated in this
+	// cycle, because it is up to date, pinned or its update was deferred.
+	skip := func(result containerResult) {
+		skippedContainers++
+		result.Action = actionSkipped
+		report.add(result)
+	}
+	var updatedNames []string
 
-	for _, c := range containers {
-		image := c.Image
-		name := strings.TrimPrefix(c.Names[0], "/")
+	var cycleErr error
+	for i, c := range containers {
+		if ctx.Err() != nil {
+			cycleErr = fmt.Errorf("cycle timeout of %s exceeded, %d containers left unchecked", *cycleTimeout, len(containers)-i)
+			break
+		}
+		image := floatingImage(c)
+		name := containerName(c)
+		display := displayName(name, c.Labels)
+
+		if rateLimited() {
+			deferForRateLimit(ctx, notifier, display)
+			skip(containerResult{Name: name, Image: image, OldImageID: c.ImageID})
+			continue
+		}
 
 		if strings.HasPrefix(image, "sha256:") {
-			imgInspect, _, err := cli.ImageInspectWithRaw(ctx, c.ImageID)
+			inspectCtx, cancel := withAPITimeout(ctx)
+			imgInspect, _, err := cli.ImageInspectWithRaw(inspectCtx, c.ImageID)
+			cancel()
 			if err == nil && len(imgInspect.RepoTags) > 0 {
 				image = imgInspect.RepoTags[0]
 				logVerbose("Resolved digest %s to tag %s", c.Image, image)
 			}
 		}
 
-		imgInspect, _, err := cli.ImageInspectWithRaw(ctx, c.ImageID)
+		if repo, pinned := digestPinnedRepo(image); pinned {
+			if !*updatePinned {
+				logVerbose("Skipping %s: image %s is pinned by digest (set -update-pinned to follow its tag)", display, image)
+				skip(containerResult{Name: name, Image: image, OldImageID: c.ImageID})
+				continue
+			}
+			image = repo
+		}
+
+		inspectCtx, cancel := withPullTimeout(ctx)
+		imgInspect, _, err := cli.ImageInspectWithRaw(inspectCtx, c.ImageID)
+		cancel()
 		if err != nil {
-			logError("Error inspecting image for %s: %v", name, err)
+			logError("Error inspecting image for %s: %v", display, err)
+			failedContainers++
+			report.add(containerResult{Name: name, Image: image, OldImageID: c.ImageID, Action: actionError, Error: err.Error()})
+			if *failFast {
+				cycleErr = fmt.Errorf("aborting cycle after %s failed: %w", display, err)
+				break
+			}
 			continue
 		}
-		platform := fmt.Sprintf("%s/%s", imgInspect.Os, imgInspect.Architecture)
+		platform := resolvePlatform(c.Labels, fmt.Sprintf("%s/%s", imgInspect.Os, imgInspect.Architecture))
+
+		if pattern := versionPattern(c.Labels); pattern != "" {
+			if tagLister == nil {
+				tagLister = registry
+				if tagLister == nil {
+					tagLister = newRegistryClient(authConfig)
+				}
+			}
+			ref, newID, err := checkPatternUpdate(cli, ctx, tagLister, image, pattern, platform, c.ImageID, authConfig, cache)
+			if err == nil {
+				result := containerResult{Name: name, Image: image, OldImageID: c.ImageID, NewImageID: newID}
+				if ref != "" && state.isBad(name, newID) {
+					logVerbose("Not updating %s to %s: the image failed its health check before", display, ref)
+					ref = ""
+				}
+				if ref == "" {
+					state.record(name, c.ImageID, imgInspect.Created, "")
+					logVerbose("No updates needed for %s", display)
+					skip(result)
+					continue
+				}
+				pending = append(pending, pendingUpdate{id: c.ID, name: name, labels: c.Labels, oldImage: c.ImageID, newImage: ref, result: result, recreateAs: ref})
+				continue
+			}
+			logWarn("Version pattern check for %s failed, checking its tag instead: %v", display, err)
+		}
 
 		tagsToCheck := []string{"latest"}
 		if registryTag != "" {
 			tagsToCheck = append(tagsToCheck, registryTag)
 		}
+		runningTag := imageTag(image)
+		mappedTag, mapped := tagMapping[runningTag]
+		if mapped {
+			tagsToCheck = []string{mappedTag}
+		}
 
 		needsUpdate := false
+		rateLimitHit := false
+		newImage, newImageID := "", ""
+		var lastErr error
+		pullFailed := false
+		retagFailed := false
+		seenDigest := ""
 		for _, tag := range tagsToCheck {
-			imageWithTag := image
-			if !strings.Contains(image, ":") {
-				imageWithTag = image + ":" + tag
-			} else {
-				parts := strings.Split(image, ":")
-				imageWithTag = parts[0] + ":" + tag
+			imageWithTag, err := replaceTag(image, tag)
+			if err != nil {
+				logError("Error checking %s (%s): %v", display, tag, err)
+				pullFailed = true
+				lastErr = err
+				continue
 			}
 
 			if registryURL == "https://registry-1.docker.io/v2/" && user != "" {
 				if !strings.HasPrefix(imageWithTag, "docker.io/") {
-					repo := strings.Split(imageWithTag, ":")[0]
+					repo := imageRepo(imageWithTag)
 					imageWithTag = fmt.Sprintf("docker.io/%s/%s:%s", user, strings.TrimPrefix(repo, user+"/"), tag)
 				}
 			}
 
-			logVerbose("Checking container %s with tag %s", name, tag)
-			updated, err := pullImageAndCheckUpdate(cli, ctx, imageWithTag, authConfig, platform, name, notificationURL, c.ImageID)
+			if registry != nil {
+				running := append(repoDigests(imgInspect.RepoDigests), state.knownDigest(name, c.ImageID))
+				digest, changed, err := checkRegistryDigest(ctx, registry, imageWithTag, running)
+				cache.setDigest(imageWithTag, digest)
+				if errors.Is(err, errRateLimited) {
+					rateLimitHit = true
+					break
+				}
+				if err != nil {
+					logVerbose("Manifest check failed for %s, falling back to pull: %v", imageWithTag, err)
+				} else if !changed {
+					logVerbose("Manifest digest for %s unchanged, skipping pull", imageWithTag)
+					seenDigest = digest
+					continue
+				}
+			}
+
+			logVerbose("Checking container %s with tag %s", display, tag)
+			pulledID, updated, err := pullImageAndCheckUpdate(cli, ctx, imageWithTag, authConfig, platform, name, c.ImageID, cache)
+			if errors.Is(err, errRateLimited) {
+				rateLimitHit = true
+				break
+			}
 			if err != nil {
-				logError("Error pulling %s (%s): %v", name, tag, err)
+				logError("Error pulling %s (%s): %v", display, tag, err)
+				pullFailed = true
+				lastErr = err
+				continue
+			}
+			if updated && state.isBad(name, pulledID) {
+				logVerbose("Not updating %s to %s: the image failed its health check before", display, imageWithTag)
 				continue
 			}
 			if updated {
-				needsUpdate = true
-
-				if registryTag != "" && tag == registryTag {
-					baseRepo := strings.Split(imageWithTag, ":")[0]
-
-					err := cli.ImageTag(ctx, imageWithTag, baseRepo+":latest")
-					if err != nil {
-						logWarn("Failed to retag %s as latest: %v", imageWithTag, err)
-					} else {
-						logUpdate("Retagged %s as latest", imageWithTag)
-
-						_, err := cli.ImageRemove(ctx, imageWithTag, types.ImageRemoveOptions{Force: true, PruneChildren: true})
-						if err != nil {
-							logWarn("Failed to remove old tag %s: %v", imageWithTag, err)
-						} else {
-							logUpdate("Removed old tag %s", imageWithTag)
-						}
+				var retagErr error
+				if mapped {
+					// The container is recreated from its running tag, so that
+					// tag has to follow the checked one.
+					var target string
+					if target, retagErr = replaceTag(imageWithTag, runningTag); retagErr == nil {
+						retagErr = retagImage(cli, ctx, imageWithTag, target)
 					}
+				} else if registryTag != "" && tag == registryTag {
+					retagErr = retagAsLatest(cli, ctx, imageWithTag)
 				}
+				if retagErr != nil {
+					msg := fmt.Sprintf("Aborting update of %s: %v", name, retagErr)
+					logError(msg)
+					notifyEvent(ctx, notifier, Event{Type: eventError, Container: name, NewImage: imageWithTag, Message: msg})
+					retagFailed = true
+					lastErr = retagErr
+					break
+				}
+				needsUpdate = true
+				newImage, newImageID = imageWithTag, pulledID
 				break
 			}
 		}
 
+		result := containerResult{Name: name, Image: image, OldImageID: c.ImageID, NewImageID: newImageID}
+		if rateLimitHit && !needsUpdate {
+			deferForRateLimit(ctx, notifier, display)
+			skip(result)
+			continue
+		}
+		if retagFailed || (pullFailed && !needsUpdate) {
+			failedContainers++
+			result.Action, result.Error = actionError, lastErr.Error()
+			report.add(result)
+			if *failFast {
+				cycleErr = fmt.Errorf("aborting cycle after %s failed: %w", display, lastErr)
+				break
+			}
+		}
+		if retagFailed {
+			continue
+		}
 		if !needsUpdate {
-			logVerbose("No updates needed for %s", name)
+			state.record(name, c.ImageID, imgInspect.Created, seenDigest)
+			logVerbose("No updates needed for %s", display)
+			if !pullFailed {
+				skip(result)
+			}
 			continue
 		}
 
-		logUpdate("Updating container %s with new image", name)
+		pending = append(pending, pendingUpdate{id: c.ID, name: name, labels: c.Labels, oldImage: c.ImageID, newImage: newImage, result: result})
+	}
 
-		if err := recreateContainer(cli, ctx, c.ID, name, notificationURL); err != nil {
-			logError("Error recreating container %s: %v", name, err)
-			continue
+	if *failFast && cycleErr != nil {
+		// Nothing is recreated in a cycle aborted by -fail-fast.
+		for _, p := range pending {
+			skip(p.result)
 		}
+		pending = nil
+	}
+
+	budgeted := gateUpdates(ctx, pending, notifier, skip)
 
-		msg := fmt.Sprintf("Successfully updated %s", name)
+	if *verifySignatures {
+		verified := budgeted[:0]
+		for _, p := range budgeted {
+			if rejectedImages[p.id] == p.result.NewImageID {
+				logVerbose("Not updating %s to %s: its signature did not verify", displayName(p.name, p.labels), p.newImage)
+				skip(p.result)
+				continue
+			}
+			if err := verifySignature(cli, ctx, p.newImage); err != nil {
+				rejectedImages[p.id] = p.result.NewImageID
+				msg := fmt.Sprintf("Not updating %s: signature verification of %s failed: %v", p.name, p.newImage, err)
+				logError(msg)
+				notifyEvent(ctx, notifier, p.event(eventError, msg))
+				skip(p.result)
+				continue
+			}
+			delete(rejectedImages, p.id)
+			verified = append(verified, p)
+		}
+		budgeted = verified
+	}
+
+	// Recreations may run in parallel, so everything they share below is
+	// guarded by mu.
+	var mu sync.Mutex
+	runRecreations(orderByDependencies(budgeted), *maxParallelRecreate, func(p pendingUpdate) bool {
+		display := displayName(p.name, p.labels)
+		logUpdate("Updating container %s with new image", display)
+
+		// A recreation that has started must not be cut short by the cycle
+		// timeout, or the container could be left removed.
+		if err := updateContainer(cli, context.WithoutCancel(ctx), p); err != nil {
+			if errors.Is(err, errAutoRemove) {
+				logWarn("Skipping %s: it was started with --rm and recreating it as a long-lived container is not supported", display)
+				mu.Lock()
+				skip(p.result)
+				mu.Unlock()
+				return true
+			}
+			msg := fmt.Sprintf("Error recreating container %s: %v", p.name, err)
+			logError(msg)
+			notifyEvent(ctx, notifier, p.event(eventError, msg))
+			var healthErr *healthCheckError
+			if *rollback && errors.As(err, &healthErr) {
+				rollbackUpdate(cli, context.WithoutCancel(ctx), p, healthErr, notifier)
+			}
+			p.result.Action, p.result.Error = actionError, err.Error()
+			report.add(p.result)
+			mu.Lock()
+			defer mu.Unlock()
+			failedContainers++
+			if *failFast {
+				if cycleErr == nil {
+					cycleErr = fmt.Errorf("aborting cycle after %s failed: %w", display, err)
+				}
+				return false
+			}
+			return true
+		}
+		p.result.Action = actionUpdated
+		report.add(p.result)
+		// The replaced image stays as a rollback target or kept image; only
+		// images that drop out of the history can be cleaned up.
+		replaced := []string{p.oldImage}
+		if limit := historyLimit(); limit > 0 {
+			replaced = state.pushHistory(p.name, p.oldImage, limit)
+		}
+
+		msg := fmt.Sprintf("Successfully updated %s", p.name)
 		logUpdate(msg)
-		notify(notificationURL, msg)
+		notifyEvent(ctx, notifier, p.event(eventUpdate, msg))
+		mu.Lock()
 		updatedContainers++
+		updatedNames = append(updatedNames, p.name)
+		mu.Unlock()
 
 		if *cleanup {
-			logVerbose("Cleaning up old images")
-			pruned, err := cli.ImagesPrune(ctx, filters.NewArgs())
-			if err != nil {
-				msg := fmt.Sprintf("Error pruning old images: %v", err)
+			if err := cleanupImages(cli, ctx, replaced); err != nil {
+				msg := fmt.Sprintf("Error cleaning up old images: %v", err)
 				logWarn(msg)
-				notify(notificationURL, msg)
-			} else if len(pruned.ImagesDeleted) > 0 {
-				logInfo("Cleaned up %d images, reclaimed %d bytes", len(pruned.ImagesDeleted), pruned.SpaceReclaimed)
+				notifyEvent(ctx, notifier, Event{Type: eventError, Message: msg})
 			}
 		}
+		return true
+	})
+
+	if err := state.save(); err != nil {
+		logWarn("Failed to save state file: %v", err)
+	}
+	if err := report.write(); err != nil {
+		logWarn("Failed to write report file: %v", err)
 	}
+	if err := report.writeSummary(eligibleContainers, len(containers), updatedContainers, skippedContainers, failedContainers, time.Since(started)); err != nil {
+		logWarn("Failed to write JSON summary: %v", err)
+	}
+	status.recordContainers(eligibleContainers, updatedNames, failedContainers)
+	notifyEvent(ctx, notifier, Event{Type: eventComplete, Message: fmt.Sprintf("Check completed: %d eligible, %d updated", eligibleContainers, updatedContainers)})
+	sendCycleSummary(ctx, notifier, eligibleContainers, updatedContainers, skippedContainers, failedContainers, time.Since(started))
 
 	if eligibleContainers > 0 {
 		if updatedContainers > 0 {
@@ -291,67 +1273,405 @@ func checkContainers(cli *client.Client, registryURL, user, pass, registryTag, n
 		}
 	}
 
-	return nil
+	return cycleErr
+}
+
+// Strategies selectable with -restart-strategy.
+const (
+	strategyRecreate = "recreate"
+	strategyRestart  = "restart"
+)
+
+// selectRestartStrategy returns the strategy used for -restart-strategy.
+// Docker fixes the image of a container when it is created, so restarting the
+// same container can never switch it to the pulled image: restart is accepted
+// but falls back to recreate, which is logged once.
+func selectRestartStrategy(strategy string) (string, error) {
+	switch strategy {
+	case strategyRecreate:
+		return strategyRecreate, nil
+	case strategyRestart:
+		logInfo("-restart-strategy %s cannot switch a container to a new image, as Docker fixes the image when the container is created; containers are recreated instead", strategyRestart)
+		return strategyRecreate, nil
+	}
+	return "", fmt.Errorf("%q must be %s or %s", strategy, strategyRecreate, strategyRestart)
 }
 
-func recreateContainer(cli *client.Client, ctx context.Context, containerID, name, notificationURL string) error {
-	inspect, err := cli.ContainerInspect(ctx, containerID)
+// updateContainer moves a container onto its pulled image.
+func updateContainer(cli *client.Client, ctx context.Context, p pendingUpdate) error {
+	if *composeSafe && p.labels[composeServiceLabel] != "" {
+		if p.recreateAs == "" {
+			return composeRecreate(cli, ctx, p.id, p.name, p.labels)
+		}
+		// The Compose file still names the old tag, so Compose would not
+		// switch to the version found through the pattern label.
+		logInfo("Recreating %s directly: its new tag %s is not in the Compose file", p.name, p.recreateAs)
+	}
+	return recreateContainer(cli, ctx, p.id, p.name, p.recreateAs)
+}
+
+// recreateContainer replaces a container with a new one created from the same
+// configuration, using image instead of the configured image when it is set.
+func recreateContainer(cli *client.Client, ctx context.Context, containerID, name, image string) error {
+	callCtx, cancel := withAPITimeout(ctx)
+	inspect, err := cli.ContainerInspect(callCtx, containerID)
+	cancel()
 	if err != nil {
 		return fmt.Errorf("inspect failed: %w", err)
 	}
+	previousImage := inspect.Config.Image
+	if tag := inspect.Config.Labels[pinTagLabel]; tag != "" {
+		previousImage = tag
+	}
+	if image == "" {
+		image = previousImage
+	}
+	inspect.Config.Image = image
+	if *pinDigest {
+		if pinned, err := pinnedReference(cli, ctx, image); err != nil {
+			logWarn("Cannot pin %s to a digest, using %s: %v", name, image, err)
+			delete(inspect.Config.Labels, pinTagLabel)
+		} else {
+			if inspect.Config.Labels == nil {
+				inspect.Config.Labels = make(map[string]string)
+			}
+			inspect.Config.Labels[pinTagLabel] = image
+			inspect.Config.Image = pinned
+		}
+	} else {
+		delete(inspect.Config.Labels, pinTagLabel)
+	}
+	if inspect.HostConfig.AutoRemove {
+		return errAutoRemove
+	}
+
+	// The old container is only stopped once the image the new one is
+	// created from is known to be there.
+	callCtx, cancel = withAPITimeout(ctx)
+	_, _, err = cli.ImageInspectWithRaw(callCtx, inspect.Config.Image)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("image %s is not available, leaving the container untouched: %w", inspect.Config.Image, err)
+	}
 
-	timeout := 10
-	if err := cli.ContainerStop(ctx, containerID, container.StopOptions{Timeout: &timeout}); err != nil {
-		return fmt.Errorf("stop failed: %w", err)
+	if err := runPreUpdateHook(cli, ctx, inspect, name); err != nil {
+		return err
 	}
 
-	if err := cli.ContainerRemove(ctx, containerID, types.ContainerRemoveOptions{}); err != nil {
-		return fmt.Errorf("remove failed: %w", err)
+	stopOpts := container.StopOptions{}
+	grace := defaultStopGrace
+	if timeout := stopTimeoutFor(inspect.Config.Labels); timeout > 0 {
+		stopOpts.Timeout = &timeout
+		grace = time.Duration(timeout) * time.Second
+	}
+	// The daemon waits out the grace period before killing the container,
+	// so the stop call gets that much on top of -api-timeout.
+	callCtx, cancel = withAPITimeout(ctx, grace)
+	err = cli.ContainerStop(callCtx, containerID, stopOpts)
+	cancel()
+	if err != nil {
+		logWarn("Stopping %s failed, killing it: %v", name, err)
+		callCtx, cancel = withAPITimeout(ctx)
+		killErr := cli.ContainerKill(callCtx, containerID, "SIGKILL")
+		cancel()
+		if killErr != nil && !errdefs.IsConflict(killErr) {
+			return fmt.Errorf("stop failed: %w (kill failed too: %v)", err, killErr)
+		}
+		logInfo("Killed %s after it failed to stop", name)
 	}
 
+	callCtx, cancel = withAPITimeout(ctx)
+	err = cli.ContainerRemove(callCtx, containerID, types.ContainerRemoveOptions{})
+	cancel()
+	if err != nil {
+		if !inspect.State.Running {
+			return fmt.Errorf("remove failed: %w", err)
+		}
+		// The old container still exists, so it is put back into service
+		// instead of being left stopped.
+		callCtx, cancel = withAPITimeout(ctx)
+		startErr := cli.ContainerStart(callCtx, containerID, types.ContainerStartOptions{})
+		cancel()
+		if startErr != nil {
+			return fmt.Errorf("remove failed: %w (restarting the old container failed too: %v)", err, startErr)
+		}
+		logWarn("Restarted the old container %s after it could not be removed", name)
+		return fmt.Errorf("remove failed, old container restarted: %w", err)
+	}
+
+	preserveAnonymousVolumes(inspect.HostConfig, inspect.Mounts)
+
+	primary, extra := splitNetworks(inspect.HostConfig.NetworkMode, inspect.NetworkSettings.Networks)
+	endpoints := map[string]*network.EndpointSettings{}
+	if primary != "" {
+		endpoints[primary] = endpointConfig(inspect.NetworkSettings.Networks[primary], inspect.ID)
+	}
+
+	callCtx, cancel = withAPITimeout(ctx)
 	resp, err := cli.ContainerCreate(
-		ctx,
+		callCtx,
 		inspect.Config,
 		inspect.HostConfig,
-		&network.NetworkingConfig{EndpointsConfig: inspect.NetworkSettings.Networks},
+		&network.NetworkingConfig{EndpointsConfig: endpoints},
 		nil,
 		name,
 	)
+	cancel()
 	if err != nil {
 		return fmt.Errorf("create failed: %w", err)
 	}
+	// Starting the new container must not trigger a -watch-events check.
+	noteOwnEvent(resp.ID)
+
+	// Docker only attaches one network at create time, the rest have to be
+	// connected explicitly to keep their aliases and IP configuration.
+	for _, netName := range extra {
+		callCtx, cancel := withAPITimeout(ctx)
+		err := cli.NetworkConnect(callCtx, netName, resp.ID, endpointConfig(inspect.NetworkSettings.Networks[netName], inspect.ID))
+		cancel()
+		if err != nil {
+			logError("Failed to reconnect %s to network %s: %v", name, netName, err)
+		} else {
+			logVerbose("Reconnected %s to network %s", name, netName)
+		}
+	}
 
-	if err := cli.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
+	callCtx, cancel = withAPITimeout(ctx)
+	err = verifyHostConfig(cli, callCtx, resp.ID, inspect.HostConfig, inspect.Config.Labels)
+	cancel()
+	if err != nil {
+		logWarn("Recreated container %s differs from the original: %v", name, err)
+	}
+
+	if !inspect.State.Running && !*startStopped {
+		logInfo("Container %s was %s before the update, leaving it stopped", name, inspect.State.Status)
+		return nil
+	}
+
+	callCtx, cancel = withAPITimeout(ctx)
+	err = cli.ContainerStart(callCtx, resp.ID, types.ContainerStartOptions{})
+	cancel()
+	if err != nil {
 		return fmt.Errorf("start failed: %w", err)
 	}
 
+	if *healthTimeout > 0 && hasHealthcheck(inspect.Config) {
+		if err := waitForHealthy(cli, ctx, resp.ID, *healthTimeout); err != nil {
+			return &healthCheckError{containerID: resp.ID, previousImage: previousImage, previousImageID: inspect.Image, err: err}
+		}
+		logVerbose("Container %s is healthy", name)
+	}
+
+	runPostUpdateHook(cli, ctx, resp.ID, name, inspect.Config.Labels)
 	return nil
 }
 
-func pullImageAndCheckUpdate(cli *client.Client, ctx context.Context, image string, authConfig types.AuthConfig, platform, name, notificationURL string, currentImgID string) (bool, error) {
-	opts := types.ImagePullOptions{}
-	if authConfig.Username != "" && authConfig.Password != "" {
-		opts.RegistryAuth = encodeAuth(authConfig)
+// stopTimeoutFor returns the stop timeout in seconds for a container, taken
+// from its stop timeout label or the -stop-timeout flag. Zero means the
+// Docker default should be used.
+func stopTimeoutFor(labels map[string]string) int {
+	if v, ok := labels[stopTimeoutLabel]; ok {
+		timeout, err := strconv.Atoi(strings.TrimSpace(v))
+		if err == nil && timeout >= 0 {
+			return timeout
+		}
+		logWarn("Invalid %s label %q, using -stop-timeout", stopTimeoutLabel, v)
+	}
+	return *stopTimeout
+}
+
+func hasHealthcheck(cfg *container.Config) bool {
+	return cfg != nil && cfg.Healthcheck != nil && len(cfg.Healthcheck.Test) > 0 && cfg.Healthcheck.Test[0] != "NONE"
+}
+
+// waitForHealthy polls the container until Docker reports it healthy. It
+// fails early if the container turns unhealthy or stops running.
+func waitForHealthy(cli *client.Client, ctx context.Context, containerID string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		callCtx, cancel := withAPITimeout(ctx)
+		inspect, err := cli.ContainerInspect(callCtx, containerID)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("inspect failed: %w", err)
+		}
+		if inspect.State == nil || !inspect.State.Running {
+			return fmt.Errorf("container is not running")
+		}
+		if inspect.State.Health != nil {
+			switch inspect.State.Health.Status {
+			case types.Healthy:
+				return nil
+			case types.Unhealthy:
+				return fmt.Errorf("container reported unhealthy")
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("not healthy after %s", timeout)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(healthPollInterval):
+		}
+	}
+}
+
+// splitNetworks picks the network to attach at create time (the container's
+// network mode when it is one of its networks) and returns the remaining
+// networks in a stable order.
+func splitNetworks(mode container.NetworkMode, networks map[string]*network.EndpointSettings) (string, []string) {
+	names := make([]string, 0, len(networks))
+	for n := range networks {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		return "", nil
+	}
+
+	primary := names[0]
+	want := string(mode)
+	if mode.IsDefault() {
+		want = "bridge"
+	}
+	if _, ok := networks[want]; ok {
+		primary = want
+	}
+
+	extra := make([]string, 0, len(names)-1)
+	for _, n := range names {
+		if n != primary {
+			extra = append(extra, n)
+		}
+	}
+	return primary, extra
+}
+
+// endpointConfig returns the writable part of an inspected endpoint: static
+// IPv4/IPv6 addresses, aliases, links and driver options. The addresses and
+// IDs the daemon assigned are left out, as passing them back makes it try to
+// reuse them, and so is the alias Docker adds for the old container's
+// short ID.
+func endpointConfig(es *network.EndpointSettings, oldID string) *network.EndpointSettings {
+	if es == nil {
+		return nil
+	}
+	cfg := &network.EndpointSettings{
+		Links:      es.Links,
+		DriverOpts: es.DriverOpts,
 	}
-	opts.Platform = platform
+	if es.IPAMConfig != nil {
+		ipam := *es.IPAMConfig
+		cfg.IPAMConfig = &ipam
+	}
+	for _, alias := range es.Aliases {
+		if len(oldID) >= 12 && alias == oldID[:12] {
+			continue
+		}
+		cfg.Aliases = append(cfg.Aliases, alias)
+	}
+	return cfg
+}
 
-	resp, err := cli.ImagePull(ctx, image, opts)
+// preserveAnonymousVolumes adds the anonymous volumes of the old container to
+// hc.Mounts by name, so the recreated container reuses them instead of
+// starting with new, empty volumes. Binds, explicit mounts and tmpfs are
+// carried over as they are and their targets are left alone.
+func preserveAnonymousVolumes(hc *container.HostConfig, mounts []types.MountPoint) {
+	// Volumes inherited through --volumes-from would be mounted twice.
+	if len(hc.VolumesFrom) > 0 {
+		return
+	}
+
+	targets := make(map[string]bool)
+	for _, b := range hc.Binds {
+		if parts := strings.Split(b, ":"); len(parts) >= 2 {
+			targets[path.Clean(parts[1])] = true
+		}
+	}
+	for _, m := range hc.Mounts {
+		targets[path.Clean(m.Target)] = true
+	}
+	for t := range hc.Tmpfs {
+		targets[path.Clean(t)] = true
+	}
+
+	for _, mp := range mounts {
+		if mp.Type != mount.TypeVolume || mp.Name == "" || targets[path.Clean(mp.Destination)] {
+			continue
+		}
+		hc.Mounts = append(hc.Mounts, mount.Mount{
+			Type:     mount.TypeVolume,
+			Source:   mp.Name,
+			Target:   mp.Destination,
+			ReadOnly: !mp.RW,
+		})
+		targets[path.Clean(mp.Destination)] = true
+		logVerbose("Keeping anonymous volume %s at %s", mp.Name, mp.Destination)
+	}
+}
+
+// verifyHostConfig checks that the recreated container kept the restart
+// policy, auto-remove and privileged settings and the Compose labels of the
+// container it replaces. A lost restart policy is restored; other differences
+// are reported.
+func verifyHostConfig(cli *client.Client, ctx context.Context, containerID string, want *container.HostConfig, wantLabels map[string]string) error {
+	created, err := cli.ContainerInspect(ctx, containerID)
 	if err != nil {
-		return false, fmt.Errorf("error pulling image: %v", err)
+		return err
 	}
-	defer resp.Close()
-	_, _ = io.Copy(io.Discard, resp)
+	got := created.HostConfig
 
-	newImg, _, err := cli.ImageInspectWithRaw(ctx, image)
+	if got.RestartPolicy != want.RestartPolicy {
+		logVerbose("Restoring restart policy %q on %s", want.RestartPolicy.Name, containerID)
+		if _, err := cli.ContainerUpdate(ctx, containerID, container.UpdateConfig{RestartPolicy: want.RestartPolicy}); err != nil {
+			return fmt.Errorf("restore restart policy: %w", err)
+		}
+	}
+	if got.AutoRemove != want.AutoRemove {
+		return fmt.Errorf("auto-remove is %v, expected %v", got.AutoRemove, want.AutoRemove)
+	}
+	if got.Privileged != want.Privileged {
+		return fmt.Errorf("privileged is %v, expected %v", got.Privileged, want.Privileged)
+	}
+	for key, value := range wantLabels {
+		if strings.HasPrefix(key, composeLabelPrefix) && created.Config.Labels[key] != value {
+			return fmt.Errorf("label %s is %q, expected %q", key, created.Config.Labels[key], value)
+		}
+	}
+	return nil
+}
+
+// pullImageAndCheckUpdate pulls image and reports the pulled image ID and
+// whether it is newer than the image the container currently runs.
+func pullImageAndCheckUpdate(cli *client.Client, ctx context.Context, image string, authConfig types.AuthConfig, platform, name, currentImgID string, cache *pullCache) (string, bool, error) {
+	newImg, err := cache.pull(image, platform, func() (types.ImageInspect, error) {
+		return pullImage(cli, ctx, image, authConfig, platform)
+	}, func(src string) error {
+		return cli.ImageTag(ctx, src, image)
+	})
 	if err != nil {
-		return false, fmt.Errorf("inspect pulled image: %w", err)
+		return "", false, err
 	}
 
-	localImg, _, err := cli.ImageInspectWithRaw(ctx, currentImgID)
+	inspectCtx, cancel := withPullTimeout(ctx)
+	localImg, _, err := cli.ImageInspectWithRaw(inspectCtx, currentImgID)
+	timedOut := inspectCtx.Err() != nil
+	cancel()
 	if err != nil {
+		// A timeout must count as a failed check, not as "no update".
+		if timedOut {
+			return "", false, fmt.Errorf("inspect current image: %w", err)
+		}
 		logWarn("Failed to inspect current image: %v", err)
 	}
 
+	if newImg.ID != currentImgID && sameImageContent(localImg, newImg) {
+		logVerbose("image ID changed but layers identical, skipping recreate for %s", name)
+		return newImg.ID, false, nil
+	}
+
 	// Digest diferente, mas só atualiza se a data for mais nova
 	if newImg.ID != currentImgID {
 		if localImg.Created != "" && newImg.Created != "" {
@@ -360,15 +1680,185 @@ func pullImageAndCheckUpdate(cli *client.Client, ctx context.Context, image stri
 			if err1 == nil && err2 == nil {
 				if remoteTime.After(localTime) {
 					logVerbose("Image %s has newer push date (remote: %s > local: %s)", name, remoteTime, localTime)
-					return true, nil
+					return newImg.ID, true, nil
 				}
 				logVerbose("Remote image for %s is not newer (remote: %s <= local: %s)", name, remoteTime, localTime)
-				return false, nil
+				return newImg.ID, false, nil
 			}
 		}
 	}
 
-	return false, nil
+	return newImg.ID, false, nil
+}
+
+// sameImageContent reports whether two images have identical layers (by
+// DiffID) and the same runtime configuration apart from labels, in which case
+// recreating a container would change nothing.
+func sameImageContent(a, b types.ImageInspect) bool {
+	if len(a.RootFS.Layers) == 0 || len(a.RootFS.Layers) != len(b.RootFS.Layers) {
+		return false
+	}
+	for i := range a.RootFS.Layers {
+		if a.RootFS.Layers[i] != b.RootFS.Layers[i] {
+			return false
+		}
+	}
+	if a.Config == nil || b.Config == nil {
+		return a.Config == b.Config
+	}
+	ca, cb := *a.Config, *b.Config
+	ca.Labels, cb.Labels = nil, nil
+	ca.Image, cb.Image = "", ""
+	ca.Hostname, cb.Hostname = "", ""
+	return reflect.DeepEqual(ca, cb)
+}
+
+// retagAsLatest points the repository's :latest tag at the freshly pulled
+// image and drops the temporary tag it was pulled under. It fails unless
+// :latest is verified to resolve to the pulled image, since the container is
+// recreated from its :latest reference.
+func retagAsLatest(cli *client.Client, ctx context.Context, imageWithTag string) error {
+	latest, err := replaceTag(imageWithTag, "latest")
+	if err != nil {
+		return err
+	}
+	if err := retagImage(cli, ctx, imageWithTag, latest); err != nil {
+		return err
+	}
+
+	// The pulled image stays reachable through :latest, so failing to drop
+	// the extra tag is harmless and only logged.
+	removeCtx, cancel := withAPITimeout(ctx)
+	defer cancel()
+	if _, err := cli.ImageRemove(removeCtx, imageWithTag, types.ImageRemoveOptions{Force: true, PruneChildren: true}); err != nil {
+		logWarn("Failed to remove old tag %s: %v", imageWithTag, err)
+	} else {
+		logUpdate("Removed old tag %s", imageWithTag)
+	}
+	return nil
+}
+
+// retagImage tags the image src refers to as target and verifies that target
+// now resolves to it.
+func retagImage(cli *client.Client, ctx context.Context, src, target string) error {
+	ctx, cancel := withAPITimeout(ctx)
+	defer cancel()
+	pulled, _, err := cli.ImageInspectWithRaw(ctx, src)
+	if err != nil {
+		return fmt.Errorf("inspect %s: %w", src, err)
+	}
+	if err := cli.ImageTag(ctx, src, target); err != nil {
+		return fmt.Errorf("retag %s as %s: %w", src, target, err)
+	}
+	tagged, _, err := cli.ImageInspectWithRaw(ctx, target)
+	if err != nil {
+		return fmt.Errorf("inspect %s after retag: %w", target, err)
+	}
+	if tagged.ID != pulled.ID {
+		return fmt.Errorf("%s resolves to %s instead of pulled image %s", target, tagged.ID, pulled.ID)
+	}
+	logUpdate("Retagged %s as %s", src, target)
+	return nil
+}
+
+// buildAuthConfig returns the credentials used for registry pulls, taken from
+// -auth-command when set and otherwise from the static ones, mapping
+// Docker Hub URLs to the index server address the daemon expects.
+func buildAuthConfig(registryURL, user, pass string) types.AuthConfig {
+	server := registryURL
+	if registryURL == "" || registryURL == "docker.io" || registryURL == "https://docker.io" || registryURL == "https://registry-1.docker.io/v2/" {
+		server = "https://index.docker.io/v1/"
+	}
+	if *authCommand != "" {
+		auth, err := authFromCommand(server)
+		if err != nil {
+			logWarn("-auth-command failed, pulling anonymously: %v", err)
+			return types.AuthConfig{}
+		}
+		return auth
+	}
+	if user == "" || pass == "" {
+		return types.AuthConfig{}
+	}
+	return types.AuthConfig{
+		Username:      user,
+		Password:      pass,
+		ServerAddress: server,
+	}
+}
+
+// pullImage pulls image for platform and returns the inspected result.
+func pullImage(cli *client.Client, ctx context.Context, image string, authConfig types.AuthConfig, platform string) (types.ImageInspect, error) {
+	ctx, cancel := withPullTimeout(ctx)
+	defer cancel()
+
+	// Through a mirror the image is pulled under the mirror's name and then
+	// tagged with the original reference, which is what the container is
+	// recreated from.
+	source := image
+	mirrored, viaMirror := mirrorReference(image)
+	if viaMirror {
+		logVerbose("Pulling %s through mirror as %s", image, mirrored)
+		source = mirrored
+	}
+
+	// Credentials are resolved for every pull, as short-lived tokens may
+	// expire while a cycle is running. A mirror only gets its own
+	// -docker-config credentials, never those of the source registry.
+	registryAuth := func() string {
+		auth := authFor(image, currentAuth(authConfig))
+		if viaMirror {
+			auth = authFor(mirrored, types.AuthConfig{})
+		}
+		if hasCredentials(auth) {
+			return encodeAuth(auth)
+		}
+		return ""
+	}
+	opts := types.ImagePullOptions{RegistryAuth: registryAuth(), Platform: platform}
+
+	resp, err := pullWithRetry(ctx, cli, source, opts)
+	if err != nil && !viaMirror && isAuthError(err) && expireCredentials() {
+		logVerbose("Pull of %s was rejected, retrying with refreshed credentials: %v", image, err)
+		opts.RegistryAuth = registryAuth()
+		resp, err = pullWithRetry(ctx, cli, source, opts)
+	}
+	// Registries can reject a pull before it starts or, like Docker Hub's
+	// rate limit, in the middle of the progress stream.
+	pullFailed := func(err error) error {
+		if isRateLimitError(err) {
+			noteRateLimit(time.Now().Add(rateLimitBackoff))
+			return fmt.Errorf("%w: %v", errRateLimited, err)
+		}
+		return fmt.Errorf("error pulling image: %v", err)
+	}
+	if err != nil {
+		return types.ImageInspect{}, pullFailed(err)
+	}
+	defer resp.Close()
+	streamErr := consumePullProgress(source, resp)
+	noteOwnEvent(repositoryName(source))
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return types.ImageInspect{}, fmt.Errorf("pull of %s timed out after %s", source, *pullTimeout)
+	}
+	if streamErr != nil {
+		return types.ImageInspect{}, pullFailed(streamErr)
+	}
+
+	if viaMirror {
+		if err := cli.ImageTag(ctx, mirrored, image); err != nil {
+			return types.ImageInspect{}, fmt.Errorf("tag %s as %s: %w", mirrored, image, err)
+		}
+		if _, err := cli.ImageRemove(ctx, mirrored, types.ImageRemoveOptions{}); err != nil {
+			logVerbose("Failed to remove mirror tag %s: %v", mirrored, err)
+		}
+	}
+
+	newImg, _, err := cli.ImageInspectWithRaw(ctx, image)
+	if err != nil {
+		return types.ImageInspect{}, fmt.Errorf("inspect pulled image: %w", err)
+	}
+	return newImg, nil
 }
 
 func encodeAuth(auth types.AuthConfig) string {
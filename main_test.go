@@ -0,0 +1,586 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+)
+
+const (
+	oldImageID = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	newImageID = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+)
+
+// testContainer returns a running container of image, as inspected.
+func testContainer(id, name, image, imageID string) types.ContainerJSON {
+	return types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:         id,
+			Name:       "/" + name,
+			Image:      imageID,
+			State:      &types.ContainerState{Running: true, Status: "running"},
+			HostConfig: &container.HostConfig{},
+		},
+		Config: &container.Config{Image: image, Labels: map[string]string{}},
+	}
+}
+
+func TestRecreateKeepsRestartPolicy(t *testing.T) {
+	d, cli := newFakeDocker(t)
+	d.addImage(newImageID, "2024-02-01T00:00:00Z", "nginx:latest")
+	c := testContainer("old", "web", "nginx:latest", oldImageID)
+	c.HostConfig.RestartPolicy = container.RestartPolicy{Name: "unless-stopped"}
+	d.addContainer(c)
+
+	if err := recreateContainer(cli, context.Background(), "old", "web", ""); err != nil {
+		t.Fatalf("recreateContainer: %v", err)
+	}
+	if len(d.created) != 1 {
+		t.Fatalf("created %d containers, want 1", len(d.created))
+	}
+	if got := d.created[0].HostConfig.RestartPolicy.Name; got != "unless-stopped" {
+		t.Errorf("recreated with restart policy %q, want unless-stopped", got)
+	}
+	recreated := d.container("web")
+	if recreated == nil || recreated.ID == "old" || !recreated.State.Running {
+		t.Fatalf("web was not recreated and started: %+v", recreated)
+	}
+	if recreated.Image != newImageID {
+		t.Errorf("recreated from %s, want %s", recreated.Image, newImageID)
+	}
+}
+
+// withUpdate sets up a running container "web" on nginx:latest for which the
+// registry serves a newer image.
+func withUpdate(t *testing.T) (*fakeDocker, *client.Client) {
+	t.Helper()
+	d, cli := newFakeDocker(t)
+	d.addImage(oldImageID, "2024-01-01T00:00:00Z", "nginx:latest")
+	d.addImage(newImageID, "2024-02-01T00:00:00Z")
+	d.publish("nginx:latest", newImageID)
+	d.addContainer(testContainer("old", "web", "nginx:latest", oldImageID))
+	return d, cli
+}
+
+func TestContainerNameWithoutNames(t *testing.T) {
+	id := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	tests := []struct {
+		name      string
+		container types.Container
+		want      string
+	}{
+		{"named", types.Container{ID: id, Names: []string{"/web"}}, "web"},
+		{"nil names", types.Container{ID: id}, "0123456789ab"},
+		{"empty names", types.Container{ID: id, Names: []string{}}, "0123456789ab"},
+		{"empty first name", types.Container{ID: id, Names: []string{""}}, "0123456789ab"},
+		{"short id", types.Container{ID: "abc"}, "abc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := containerName(tt.container); got != tt.want {
+				t.Errorf("containerName() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// A listing with a nameless container must not bring the filters down.
+	selected := selectContainers([]types.Container{{ID: id, Image: "nginx", State: "running"}})
+	if len(selected) != 1 {
+		t.Errorf("nameless container was dropped: %v", selected)
+	}
+}
+
+func TestOnceExitCode(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(d *fakeDocker)
+		want  int
+	}{
+		{"clean cycle", func(d *fakeDocker) {}, 0},
+		{"failed update", func(d *fakeDocker) { d.fail("POST /containers/create", http.StatusInternalServerError) }, 1},
+		{"failed pull", func(d *fakeDocker) { d.fail("POST /images/create", http.StatusNotFound) }, 1},
+		{"failed cycle", func(d *fakeDocker) { d.fail("GET /containers/json", http.StatusInternalServerError) }, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := status
+			status = &statusTracker{}
+			defer func() { status = old }()
+
+			d, cli := withUpdate(t)
+			tt.setup(d)
+			status.startCycle()
+			status.finishCycle(checkContainers(cli, "", "", "", "", NoopNotifier{}))
+			if got := onceExitCode(status); got != tt.want {
+				t.Errorf("exit code %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecreateReconnectsAllNetworks(t *testing.T) {
+	d, cli := newFakeDocker(t)
+	d.addImage(oldImageID, "2024-01-01T00:00:00Z", "nginx:latest")
+	c := testContainer("0123456789abcdef", "web", "nginx:latest", oldImageID)
+	c.HostConfig.NetworkMode = "frontend"
+	c.NetworkSettings = &types.NetworkSettings{Networks: map[string]*network.EndpointSettings{
+		"frontend": {NetworkID: "net1", Aliases: []string{"web", "0123456789ab"}, IPAddress: "172.20.0.5"},
+		"backend": {
+			NetworkID:  "net2",
+			Aliases:    []string{"web-internal"},
+			IPAMConfig: &network.EndpointIPAMConfig{IPv4Address: "10.10.0.20"},
+			IPAddress:  "10.10.0.20",
+		},
+	}}
+	d.addContainer(c)
+
+	if err := recreateContainer(cli, context.Background(), c.ID, "web", ""); err != nil {
+		t.Fatalf("recreateContainer: %v", err)
+	}
+
+	endpoints := d.created[0].NetworkingConfig.EndpointsConfig
+	if len(endpoints) != 1 || endpoints["frontend"] == nil {
+		t.Fatalf("created with networks %v, want only frontend", endpoints)
+	}
+	if got := endpoints["frontend"].Aliases; !reflect.DeepEqual(got, []string{"web"}) {
+		t.Errorf("frontend aliases = %v, want [web] without the old short ID", got)
+	}
+
+	newID := d.container("web").ID
+	backend := d.connected["backend "+newID]
+	if backend == nil {
+		t.Fatalf("backend was not reconnected, connected: %v", d.connected)
+	}
+	if !reflect.DeepEqual(backend.Aliases, []string{"web-internal"}) {
+		t.Errorf("backend aliases = %v, want [web-internal]", backend.Aliases)
+	}
+	if backend.IPAMConfig == nil || backend.IPAMConfig.IPv4Address != "10.10.0.20" {
+		t.Errorf("backend IPAM config = %+v, want the static address", backend.IPAMConfig)
+	}
+	if backend.IPAddress != "" || backend.NetworkID != "" {
+		t.Errorf("backend endpoint carries daemon-assigned fields: %+v", backend)
+	}
+	if connect, start := d.callIndex("POST /networks/backend/connect"), d.callIndex("POST /containers/"+newID+"/start"); connect < 0 || connect > start {
+		t.Errorf("backend connected at call %d, container started at call %d; want connect first", connect, start)
+	}
+}
+
+func TestEndpointConfig(t *testing.T) {
+	if endpointConfig(nil, "0123456789abcdef") != nil {
+		t.Error("endpointConfig(nil) is not nil")
+	}
+
+	inspected := &network.EndpointSettings{
+		IPAMConfig: &network.EndpointIPAMConfig{
+			IPv4Address:  "10.10.0.20",
+			IPv6Address:  "fd00:10::20",
+			LinkLocalIPs: []string{"fe80::20"},
+		},
+		Links:               []string{"db:database"},
+		Aliases:             []string{"web", "0123456789ab"},
+		DriverOpts:          map[string]string{"com.example.opt": "1"},
+		NetworkID:           "net1",
+		EndpointID:          "ep1",
+		Gateway:             "10.10.0.1",
+		IPAddress:           "10.10.0.20",
+		IPPrefixLen:         24,
+		IPv6Gateway:         "fd00:10::1",
+		GlobalIPv6Address:   "fd00:10::20",
+		GlobalIPv6PrefixLen: 64,
+		MacAddress:          "02:42:0a:0a:00:14",
+	}
+	got := endpointConfig(inspected, "0123456789abcdef")
+	want := &network.EndpointSettings{
+		IPAMConfig: &network.EndpointIPAMConfig{
+			IPv4Address:  "10.10.0.20",
+			IPv6Address:  "fd00:10::20",
+			LinkLocalIPs: []string{"fe80::20"},
+		},
+		Links:      []string{"db:database"},
+		Aliases:    []string{"web"},
+		DriverOpts: map[string]string{"com.example.opt": "1"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("endpointConfig =\n%+v\nwant only the writable fields\n%+v", got, want)
+	}
+	if got.IPAMConfig == inspected.IPAMConfig {
+		t.Error("the IPAM config is shared with the inspected endpoint")
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	base, limit := time.Minute, 10*time.Minute
+
+	// Drive a run of failing cycles followed by a successful one, the way
+	// the check loop counts them.
+	outcomes := []bool{false, false, false, false, false, true, false}
+	want := []time.Duration{
+		2 * time.Minute, 4 * time.Minute, 8 * time.Minute, limit, limit,
+		base,
+		2 * time.Minute,
+	}
+	failures := 0
+	for i, ok := range outcomes {
+		if ok {
+			failures = 0
+		} else {
+			failures++
+		}
+		if got := backoffDelay(base, failures, limit); got != want[i] {
+			t.Errorf("cycle %d (%d failures): delay %s, want %s", i+1, failures, got, want[i])
+		}
+	}
+
+	if got := backoffDelay(base, 0, limit); got != base {
+		t.Errorf("healthy delay = %s, want %s", got, base)
+	}
+	if got := backoffDelay(base, 5, 0); got != base {
+		t.Errorf("disabled backoff delay = %s, want %s", got, base)
+	}
+	if got := backoffDelay(base, 1000, limit); got != limit {
+		t.Errorf("long outage delay = %s, want the %s cap", got, limit)
+	}
+}
+
+func TestRecreateKeepsMounts(t *testing.T) {
+	d, cli := newFakeDocker(t)
+	d.addImage(oldImageID, "2024-01-01T00:00:00Z", "postgres:16")
+	anonymous := "4f1d4cb3e7a2d9c6a8b5e0f1d2c3b4a5968778695a4b3c2d1e0f9a8b7c6d5e4f"
+	c := testContainer("old", "db", "postgres:16", oldImageID)
+	c.HostConfig.Binds = []string{"/srv/db/conf:/etc/postgresql:ro"}
+	c.HostConfig.Mounts = []mount.Mount{{Type: mount.TypeVolume, Source: "pgdata", Target: "/var/lib/postgresql/data"}}
+	c.HostConfig.Tmpfs = map[string]string{"/run": "size=64m"}
+	c.Mounts = []types.MountPoint{
+		{Type: mount.TypeBind, Source: "/srv/db/conf", Destination: "/etc/postgresql"},
+		{Type: mount.TypeVolume, Name: "pgdata", Destination: "/var/lib/postgresql/data", RW: true},
+		{Type: mount.TypeVolume, Name: anonymous, Destination: "/backups", RW: true},
+		{Type: mount.TypeVolume, Name: "archive", Destination: "/archive/"},
+	}
+	d.addContainer(c)
+
+	if err := recreateContainer(cli, context.Background(), "old", "db", ""); err != nil {
+		t.Fatalf("recreateContainer: %v", err)
+	}
+	hc := d.created[0].HostConfig
+	if !reflect.DeepEqual(hc.Binds, c.HostConfig.Binds) {
+		t.Errorf("binds = %v, want %v", hc.Binds, c.HostConfig.Binds)
+	}
+	if !reflect.DeepEqual(hc.Tmpfs, c.HostConfig.Tmpfs) {
+		t.Errorf("tmpfs = %v, want %v", hc.Tmpfs, c.HostConfig.Tmpfs)
+	}
+	// The named volume is kept once; the anonymous and the read-only
+	// volumes the daemon reported are added by name at their targets.
+	want := []mount.Mount{
+		{Type: mount.TypeVolume, Source: "pgdata", Target: "/var/lib/postgresql/data"},
+		{Type: mount.TypeVolume, Source: anonymous, Target: "/backups"},
+		{Type: mount.TypeVolume, Source: "archive", Target: "/archive/", ReadOnly: true},
+	}
+	if !reflect.DeepEqual(hc.Mounts, want) {
+		t.Errorf("mounts = %+v, want %+v", hc.Mounts, want)
+	}
+}
+
+func TestSameImageContent(t *testing.T) {
+	image := func(labels map[string]string, cmd string, layers ...string) types.ImageInspect {
+		img := types.ImageInspect{Config: &container.Config{Labels: labels, Cmd: []string{cmd}}}
+		img.RootFS.Layers = layers
+		return img
+	}
+	base := image(map[string]string{"build": "1"}, "nginx", "sha256:aaa", "sha256:bbb")
+	tests := []struct {
+		name  string
+		other types.ImageInspect
+		want  bool
+	}{
+		{"only labels differ", image(map[string]string{"build": "2"}, "nginx", "sha256:aaa", "sha256:bbb"), true},
+		{"changed layer", image(nil, "nginx", "sha256:aaa", "sha256:ccc"), false},
+		{"extra layer", image(nil, "nginx", "sha256:aaa", "sha256:bbb", "sha256:ccc"), false},
+		{"changed command", image(map[string]string{"build": "1"}, "httpd", "sha256:aaa", "sha256:bbb"), false},
+		{"no layers", image(nil, "nginx"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sameImageContent(base, tt.other); got != tt.want {
+				t.Errorf("sameImageContent() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPullSkipsImageWithSameLayers(t *testing.T) {
+	d, cli := withUpdate(t)
+	// The registry serves a new image ID for the same content, e.g. an
+	// index instead of the platform manifest.
+	d.mu.Lock()
+	img := d.images[newImageID]
+	img.RootFS.Layers = d.images[oldImageID].RootFS.Layers
+	d.images[newImageID] = img
+	d.mu.Unlock()
+
+	id, update, err := pullImageAndCheckUpdate(cli, context.Background(), "nginx:latest", types.AuthConfig{}, "", "web", oldImageID, newPullCache())
+	if err != nil {
+		t.Fatalf("pullImageAndCheckUpdate: %v", err)
+	}
+	if update {
+		t.Error("identical layers reported as an update")
+	}
+	if id != newImageID {
+		t.Errorf("pulled image %s, want %s", id, newImageID)
+	}
+}
+
+// readSummary runs a check cycle with -summary-json and returns its summary.
+func readSummary(t *testing.T, cli *client.Client) cycleSummary {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "summary.json")
+	old := *summaryJSON
+	*summaryJSON = path
+	defer func() { *summaryJSON = old }()
+
+	if err := checkContainers(cli, "", "", "", "", NoopNotifier{}); err != nil {
+		t.Fatalf("checkContainers: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var summary cycleSummary
+	if err := json.Unmarshal(data, &summary); err != nil {
+		t.Fatalf("summary %q: %v", data, err)
+	}
+	return summary
+}
+
+func TestCheckCountsSkippedContainers(t *testing.T) {
+	if err := compileRepoFilters("", "*/internal-*"); err != nil {
+		t.Fatal(err)
+	}
+	defer compileRepoFilters("", "")
+
+	d, cli := withUpdate(t)
+	d.addImage("sha256:redis", "2024-01-01T00:00:00Z", "redis:7")
+	d.publish("redis:latest", "sha256:redis")
+	d.addContainer(testContainer("cache-id", "cache", "redis:7", "sha256:redis"))
+	d.addImage("sha256:tools", "2024-01-01T00:00:00Z", "myorg/internal-tools:2")
+	d.addContainer(testContainer("tools-id", "tools", "myorg/internal-tools:2", "sha256:tools"))
+
+	// web is updated, cache is up to date and tools is excluded.
+	summary := readSummary(t, cli)
+	if summary.Checked != 2 || summary.Updated != 1 || summary.Skipped != 2 || summary.Errors != 0 {
+		t.Errorf("checked/updated/skipped/errors = %d/%d/%d/%d, want 2/1/2/0",
+			summary.Checked, summary.Updated, summary.Skipped, summary.Errors)
+	}
+}
+
+func TestCheckCountsExcludedContainersWithoutEligible(t *testing.T) {
+	if err := compileRepoFilters("", "*/internal-*"); err != nil {
+		t.Fatal(err)
+	}
+	defer compileRepoFilters("", "")
+
+	d, cli := newFakeDocker(t)
+	d.addImage("sha256:tools", "2024-01-01T00:00:00Z", "myorg/internal-tools:2")
+	d.addContainer(testContainer("tools-id", "tools", "myorg/internal-tools:2", "sha256:tools"))
+	d.addContainer(testContainer("db-id", "db", "myorg/internal-db:1", "sha256:tools"))
+
+	summary := readSummary(t, cli)
+	if summary.Checked != 0 || summary.Updated != 0 || summary.Skipped != 2 {
+		t.Errorf("checked/updated/skipped = %d/%d/%d, want 0/0/2", summary.Checked, summary.Updated, summary.Skipped)
+	}
+}
+
+func TestRecreateKeepsStoppedContainersStopped(t *testing.T) {
+	for _, start := range []bool{false, true} {
+		d, cli := newFakeDocker(t)
+		d.addImage(oldImageID, "2024-01-01T00:00:00Z", "nginx:latest")
+		c := testContainer("old", "web", "nginx:latest", oldImageID)
+		c.State = &types.ContainerState{Status: "exited", ExitCode: 0}
+		d.addContainer(c)
+
+		*startStopped = start
+		err := recreateContainer(cli, context.Background(), "old", "web", "")
+		*startStopped = false
+		if err != nil {
+			t.Fatalf("-start-stopped=%v: recreateContainer: %v", start, err)
+		}
+		recreated := d.container("web")
+		if recreated == nil || recreated.ID == "old" {
+			t.Fatalf("-start-stopped=%v: web was not recreated", start)
+		}
+		if recreated.State.Running != start {
+			t.Errorf("-start-stopped=%v: recreated container running = %v", start, recreated.State.Running)
+		}
+	}
+}
+
+func TestSelectRestartStrategy(t *testing.T) {
+	tests := []struct {
+		strategy string
+		want     string
+		notice   bool
+		wantErr  bool
+	}{
+		{strategy: strategyRecreate, want: strategyRecreate},
+		{strategy: strategyRestart, want: strategyRecreate, notice: true},
+		{strategy: "in-place", wantErr: true},
+		{strategy: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		logs := captureLog(t, levelInfo)
+		got, err := selectRestartStrategy(tt.strategy)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: err = %v, wantErr %v", tt.strategy, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.strategy, got, tt.want)
+		}
+		if notice := strings.Contains(logs.String(), "recreated instead"); notice != tt.notice {
+			t.Errorf("%q: fallback notice logged = %v, want %v: %q", tt.strategy, notice, tt.notice, logs.String())
+		}
+	}
+}
+
+func TestRestartStrategyFallsBackToRecreate(t *testing.T) {
+	d, cli := withUpdate(t)
+	captureLog(t, levelInfo)
+	old := *restartStrategy
+	t.Cleanup(func() { *restartStrategy = old })
+	strategy, err := selectRestartStrategy(strategyRestart)
+	if err != nil {
+		t.Fatalf("selectRestartStrategy: %v", err)
+	}
+	*restartStrategy = strategy
+
+	d.publish("nginx:latest", newImageID)
+	if _, err := pullImage(cli, context.Background(), "nginx:latest", types.AuthConfig{}, ""); err != nil {
+		t.Fatalf("pullImage: %v", err)
+	}
+	if err := updateContainer(cli, context.Background(), pendingUpdate{id: "old", name: "web", labels: map[string]string{}}); err != nil {
+		t.Fatalf("updateContainer: %v", err)
+	}
+	if c := d.container("web"); c == nil || c.ID == "old" || c.Image != newImageID {
+		t.Errorf("web was not recreated on the new image: %+v", c)
+	}
+	if d.called("POST /containers/old/restart") {
+		t.Error("container restarted in place instead of recreated")
+	}
+}
+
+func TestUpdateContainerRecreates(t *testing.T) {
+	d, cli := withUpdate(t)
+	d.publish("nginx:latest", newImageID)
+	if _, err := pullImage(cli, context.Background(), "nginx:latest", types.AuthConfig{}, ""); err != nil {
+		t.Fatalf("pullImage: %v", err)
+	}
+	if err := updateContainer(cli, context.Background(), pendingUpdate{id: "old", name: "web", labels: map[string]string{}}); err != nil {
+		t.Fatalf("updateContainer: %v", err)
+	}
+	if c := d.container("web"); c == nil || c.ID == "old" || c.Image != newImageID {
+		t.Errorf("web was not recreated on the new image: %+v", c)
+	}
+}
+
+func TestSecondsDurationFlag(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want time.Duration
+	}{
+		{"30", 30 * time.Second},
+		{"3600", time.Hour},
+		{"90s", 90 * time.Second},
+		{"6h", 6 * time.Hour},
+		{"1h30m", 90 * time.Minute},
+	}
+	for _, tt := range tests {
+		fs := flag.NewFlagSet("puller", flag.ContinueOnError)
+		d := 30 * time.Second
+		fs.Var((*secondsDuration)(&d), "interval", "")
+		if err := fs.Parse([]string{"-interval", tt.arg}); err != nil {
+			t.Errorf("-interval %s: %v", tt.arg, err)
+			continue
+		}
+		if d != tt.want {
+			t.Errorf("-interval %s = %s, want %s", tt.arg, d, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"", "6 hours", "1.5", "h"} {
+		d := secondsDuration(0)
+		if err := d.Set(bad); err == nil {
+			t.Errorf("Set(%q) succeeded with %s", bad, time.Duration(d))
+		}
+	}
+}
+
+func TestRecreateRecoversFromStopAndRemoveFailures(t *testing.T) {
+	update := pendingUpdate{id: "old", name: "web", labels: map[string]string{}}
+	pulled := func(t *testing.T) (*fakeDocker, *client.Client) {
+		t.Helper()
+		d, cli := withUpdate(t)
+		if _, err := pullImage(cli, context.Background(), "nginx:latest", types.AuthConfig{}, ""); err != nil {
+			t.Fatalf("pullImage: %v", err)
+		}
+		return d, cli
+	}
+
+	t.Run("stop fails, kill succeeds", func(t *testing.T) {
+		d, cli := pulled(t)
+		d.fail("POST /containers/old/stop", 500)
+		if err := updateContainer(cli, context.Background(), update); err != nil {
+			t.Fatalf("updateContainer: %v", err)
+		}
+		if !d.called("POST /containers/old/kill") {
+			t.Error("the container was not killed after stop failed")
+		}
+		if c := d.container("web"); c == nil || c.ID == "old" || c.Image != newImageID {
+			t.Errorf("web was not recreated on the new image: %+v", c)
+		}
+	})
+
+	t.Run("stop and kill fail", func(t *testing.T) {
+		d, cli := pulled(t)
+		d.fail("POST /containers/old/stop", 500)
+		d.fail("POST /containers/old/kill", 500)
+		if err := updateContainer(cli, context.Background(), update); err == nil {
+			t.Fatal("updateContainer succeeded although the container could not be stopped")
+		}
+		if d.called("DELETE /containers/old") {
+			t.Error("the container was removed although it could not be stopped")
+		}
+		if c := d.container("web"); c == nil || c.ID != "old" {
+			t.Errorf("the old container is gone: %+v", c)
+		}
+	})
+
+	t.Run("remove fails", func(t *testing.T) {
+		d, cli := pulled(t)
+		d.fail("DELETE /containers/old", 500)
+		if err := updateContainer(cli, context.Background(), update); err == nil {
+			t.Fatal("updateContainer succeeded although the container could not be removed")
+		}
+		if d.callIndex("POST /containers/old/start") < d.callIndex("POST /containers/old/stop") {
+			t.Error("the old container was not restarted after it could not be removed")
+		}
+		c := d.container("web")
+		if c == nil || c.ID != "old" || !c.State.Running {
+			t.Errorf("the old container was left stopped: %+v", c)
+		}
+		if len(d.created) != 0 {
+			t.Errorf("a replacement was created next to the old container: %+v", d.created)
+		}
+	})
+}
@@ -0,0 +1,595 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	notificationTitle        = "Docker Puller"
+	notificationAttempts     = 2
+	notificationFlushTimeout = 30 * time.Second
+)
+
+var (
+	notificationClient     = &http.Client{Timeout: 10 * time.Second}
+	notificationRetryDelay = time.Second
+	notifications          = make(chan queuedNotification, 64)
+	notifierDone           chan struct{}
+)
+
+// Notification events selectable with -notify-on.
+const (
+	eventStart    = "start"
+	eventComplete = "complete"
+	eventUpdate   = "update"
+	eventError    = "error"
+	eventRollback = "rollback"
+)
+
+// Notification severities, from routine to critical.
+const (
+	severityInfo    = "info"
+	severityUpdate  = "update"
+	severityWarning = "warning"
+	severityError   = "error"
+)
+
+// severityRank orders severities from routine to critical.
+var severityRank = map[string]int{
+	severityInfo:    0,
+	severityUpdate:  1,
+	severityWarning: 2,
+	severityError:   3,
+}
+
+// eventSet is the set of events that trigger a notification.
+type eventSet map[string]bool
+
+// parseEventSet parses a comma-separated list of notification events.
+func parseEventSet(list string) (eventSet, error) {
+	events := make(eventSet)
+	for _, ev := range strings.Split(list, ",") {
+		ev = strings.ToLower(strings.TrimSpace(ev))
+		switch ev {
+		case "":
+		case eventStart, eventComplete, eventUpdate, eventError, eventRollback:
+			events[ev] = true
+		default:
+			return nil, fmt.Errorf("unknown notification event %q", ev)
+		}
+	}
+	return events, nil
+}
+
+// Event describes something worth notifying about. Container and the image
+// fields are empty for events that are not about a single container.
+type Event struct {
+	Type      string
+	Container string
+	OldImage  string
+	NewImage  string
+	Message   string
+	// Kind overrides the event name sent to -event-url, for events whose
+	// Type alone is ambiguous.
+	Kind string
+	// Time is set by notifyEvent when the event is raised.
+	Time time.Time
+	// Severity tells receivers how urgent the event is. notifyEvent derives
+	// it from the event type unless it is set.
+	Severity string
+}
+
+// eventSeverity returns the severity of an event that does not set one.
+func eventSeverity(event Event) string {
+	switch {
+	case event.Type == eventError:
+		return severityError
+	case event.Type == eventRollback:
+		return severityWarning
+	case event.Type == eventUpdate:
+		return severityUpdate
+	}
+	return severityInfo
+}
+
+// levelPrefix returns the message prefixed with its severity, for
+// plain-text backends.
+func levelPrefix(event Event) string {
+	if event.Severity == "" {
+		return event.Message
+	}
+	return "[" + strings.ToUpper(event.Severity) + "] " + event.Message
+}
+
+// eventSummary is the per-cycle heartbeat enabled with -notify-summary. It is
+// not selectable with -notify-on.
+const eventSummary = "summary"
+
+// Notifier delivers events to a notification backend.
+type Notifier interface {
+	Notify(ctx context.Context, event Event) error
+}
+
+// notifyEvent sends event through n, logging delivery failures.
+func notifyEvent(ctx context.Context, n Notifier, event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if event.Severity == "" {
+		event.Severity = eventSeverity(event)
+	}
+	if err := n.Notify(ctx, event); err != nil {
+		logWarn("Notification failed: %v", err)
+	}
+}
+
+// sendCycleSummary sends a per-cycle heartbeat when -notify-summary is set.
+func sendCycleSummary(ctx context.Context, n Notifier, checked, updated, skipped, failed int, took time.Duration) {
+	if !*notifySummary {
+		return
+	}
+	notifyEvent(ctx, n, Event{
+		Type: eventSummary,
+		Message: fmt.Sprintf("Check summary: %d checked, %d updated, %d skipped, %d failed in %s",
+			checked, updated, skipped, failed, took.Round(time.Millisecond)),
+	})
+}
+
+// queuedNotification is a pending delivery to a single backend.
+type queuedNotification struct {
+	notifier Notifier
+	event    Event
+}
+
+// validateNotificationURL checks that raw is an absolute http or https URL.
+func validateNotificationURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("scheme must be http or https, got %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("missing host")
+	}
+	return nil
+}
+
+// startNotifier starts the goroutine delivering queued notifications.
+func startNotifier() {
+	notifierDone = make(chan struct{})
+	go func() {
+		defer close(notifierDone)
+		for q := range notifications {
+			deliverNotification(q.notifier, q.event)
+		}
+	}()
+}
+
+// flushNotifications stops accepting notifications and waits up to timeout
+// for queued ones to be delivered. It must only be called before exiting.
+func flushNotifications(timeout time.Duration) {
+	if notifierDone == nil {
+		return
+	}
+	close(notifications)
+	select {
+	case <-notifierDone:
+	case <-time.After(timeout):
+		logWarn("Timed out delivering pending notifications")
+	}
+}
+
+// retryableError marks notification failures worth another attempt, such as
+// network errors, timeouts and 5xx responses.
+type retryableError struct{ err error }
+
+func (e retryableError) Error() string { return e.err.Error() }
+func (e retryableError) Unwrap() error { return e.err }
+
+// newNotifier returns the HTTP notifier for format, posting to url.
+func newNotifier(format, url, token string) (Notifier, error) {
+	switch format {
+	case "text":
+		return WebhookNotifier{URL: url}, nil
+	case "gotify":
+		if token == "" {
+			return nil, fmt.Errorf("gotify requires -notification-token")
+		}
+		return GotifyNotifier{URL: url, Token: token}, nil
+	case "ntfy":
+		return NtfyNotifier{URL: url, Token: token}, nil
+	}
+	return nil, fmt.Errorf("unknown notification format %q", format)
+}
+
+// NoopNotifier discards every event. It is used when no notification
+// backend is configured.
+type NoopNotifier struct{}
+
+func (NoopNotifier) Notify(context.Context, Event) error { return nil }
+
+// MultiNotifier fans an event out to several notifiers, returning the
+// combined errors of those that failed.
+type MultiNotifier []Notifier
+
+func (m MultiNotifier) Notify(ctx context.Context, event Event) error {
+	var errs []error
+	for _, n := range m {
+		if err := n.Notify(ctx, event); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// eventFilter passes on only the events selected with -notify-on. Cycle
+// summaries are gated by -notify-summary instead and always pass.
+type eventFilter struct {
+	events eventSet
+	next   Notifier
+}
+
+func (f eventFilter) Notify(ctx context.Context, event Event) error {
+	if event.Type != eventSummary && !f.events[event.Type] {
+		return nil
+	}
+	return f.next.Notify(ctx, event)
+}
+
+// templateData is the data available to -notification-template.
+type templateData struct {
+	Event     string
+	Severity  string
+	Container string
+	OldImage  string
+	NewImage  string
+	Message   string
+	Host      string
+}
+
+// parseNotificationTemplate parses text and renders it once against a sample
+// update so references to unknown fields fail at startup.
+func parseNotificationTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("notification").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	sample := templateData{Event: eventUpdate, Severity: severityUpdate, Container: "web", OldImage: "sha256:old", NewImage: "nginx:latest", Message: "Successfully updated web", Host: "host"}
+	if err := tmpl.Execute(io.Discard, sample); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// templateNotifier rewrites event messages with -notification-template
+// before passing them on. Events that fail to render keep their message.
+type templateNotifier struct {
+	tmpl *template.Template
+	host string
+	next Notifier
+}
+
+func (t templateNotifier) Notify(ctx context.Context, event Event) error {
+	var buf bytes.Buffer
+	err := t.tmpl.Execute(&buf, templateData{
+		Event:     event.Type,
+		Severity:  event.Severity,
+		Container: event.Container,
+		OldImage:  event.OldImage,
+		NewImage:  event.NewImage,
+		Message:   event.Message,
+		Host:      t.host,
+	})
+	if err != nil {
+		logWarn("Rendering notification template failed, sending the plain message: %v", err)
+	} else {
+		event.Message = buf.String()
+	}
+	return t.next.Notify(ctx, event)
+}
+
+// dedupeNotifier suppresses error-severity events identical to one sent
+// within the window. Once the window has passed, the next repeat is sent as
+// a reminder with the number of suppressed copies.
+type dedupeNotifier struct {
+	window time.Duration
+	next   Notifier
+
+	mu   sync.Mutex
+	seen map[[sha256.Size]byte]*dedupeEntry
+}
+
+type dedupeEntry struct {
+	sent       time.Time
+	suppressed int
+}
+
+func newDedupeNotifier(window time.Duration, next Notifier) *dedupeNotifier {
+	return &dedupeNotifier{window: window, next: next, seen: make(map[[sha256.Size]byte]*dedupeEntry)}
+}
+
+func (d *dedupeNotifier) Notify(ctx context.Context, event Event) error {
+	if event.Severity != severityError {
+		return d.next.Notify(ctx, event)
+	}
+	key := sha256.Sum256([]byte(event.Container + "\x00" + event.Message))
+	now := time.Now()
+
+	d.mu.Lock()
+	for k, e := range d.seen {
+		// Entries are kept for two windows so a persistent failure is
+		// still recognized when its reminder is due.
+		if now.Sub(e.sent) > 2*d.window {
+			delete(d.seen, k)
+		}
+	}
+	entry, ok := d.seen[key]
+	if ok && now.Sub(entry.sent) < d.window {
+		entry.suppressed++
+		d.mu.Unlock()
+		logVerbose("Suppressed repeated notification: %s", event.Message)
+		return nil
+	}
+	if ok && entry.suppressed > 0 {
+		event.Message = fmt.Sprintf("Still failing (%d repeats suppressed): %s", entry.suppressed, event.Message)
+	}
+	d.seen[key] = &dedupeEntry{sent: now}
+	d.mu.Unlock()
+
+	return d.next.Notify(ctx, event)
+}
+
+// digestNotifier collects the events of a check cycle for -notify-digest
+// and sends them on as one event when the cycle ends.
+type digestNotifier struct {
+	next   Notifier
+	mu     sync.Mutex
+	events []Event
+}
+
+// notificationDigest is set with -notify-digest.
+var notificationDigest *digestNotifier
+
+func (d *digestNotifier) Notify(_ context.Context, event Event) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.events = append(d.events, event)
+	return nil
+}
+
+// flush sends the collected events as a single notification with the
+// highest severity among them. It is safe to call on a nil digest.
+func (d *digestNotifier) flush() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	events := d.events
+	d.events = nil
+	d.mu.Unlock()
+	if len(events) == 0 {
+		return
+	}
+	if len(events) == 1 {
+		notifyEvent(context.Background(), d.next, events[0])
+		return
+	}
+
+	digest := Event{Type: eventSummary, Severity: severityInfo}
+	updated, failed := 0, 0
+	lines := make([]string, 0, len(events))
+	for _, event := range events {
+		switch {
+		case event.Type == eventUpdate && event.Kind == "":
+			updated++
+		case event.Severity == severityError:
+			failed++
+		}
+		if severityRank[event.Severity] > severityRank[digest.Severity] {
+			digest.Severity = event.Severity
+		}
+		lines = append(lines, levelPrefix(event))
+	}
+	digest.Message = fmt.Sprintf("Check cycle: %d updated, %d failed\n%s", updated, failed, strings.Join(lines, "\n"))
+	notifyEvent(context.Background(), d.next, digest)
+}
+
+// queuedNotifier hands events to the delivery goroutine so the check loop
+// never blocks on a slow notification endpoint. Events are dropped if the
+// queue is full.
+type queuedNotifier struct {
+	next Notifier
+}
+
+func (q queuedNotifier) Notify(_ context.Context, event Event) error {
+	select {
+	case notifications <- queuedNotification{notifier: q.next, event: event}:
+		return nil
+	default:
+		return fmt.Errorf("notification queue full, dropping message: %s", event.Message)
+	}
+}
+
+// deliverNotification sends event through n, retrying retryable failures.
+func deliverNotification(n Notifier, event Event) {
+	for attempt := 1; ; attempt++ {
+		err := n.Notify(context.Background(), event)
+		if err == nil {
+			logVerbose("Notification sent successfully")
+			return
+		}
+		var retryable retryableError
+		if !errors.As(err, &retryable) || attempt >= notificationAttempts {
+			logError("Notification failed after %d attempt(s): %v", attempt, err)
+			return
+		}
+		logVerbose("Notification attempt %d failed, retrying: %v", attempt, err)
+		time.Sleep(notificationRetryDelay)
+	}
+}
+
+// headerList collects repeated -notify-header or -event-header Key=Value
+// flags.
+type headerList []string
+
+func (h *headerList) String() string { return strings.Join(*h, ",") }
+
+func (h *headerList) Set(value string) error {
+	key, _, ok := strings.Cut(value, "=")
+	if !ok || strings.TrimSpace(key) == "" {
+		return fmt.Errorf("header %q must be Key=Value", value)
+	}
+	*h = append(*h, value)
+	return nil
+}
+
+// validateNotifyAuth checks that auth is empty, a bearer token or user:pass.
+func validateNotifyAuth(auth string) error {
+	if auth == "" {
+		return nil
+	}
+	if scheme, token, ok := strings.Cut(auth, " "); ok && strings.EqualFold(scheme, "Bearer") {
+		if strings.TrimSpace(token) == "" {
+			return fmt.Errorf("bearer token is empty")
+		}
+		return nil
+	}
+	if user, _, ok := strings.Cut(auth, ":"); !ok || user == "" {
+		return fmt.Errorf(`expected "Bearer <token>" or "user:pass"`)
+	}
+	return nil
+}
+
+// applyAuth sets auth, as accepted by validateNotifyAuth, and the Key=Value
+// headers on req. They take precedence over headers set by the backend.
+func applyAuth(req *http.Request, auth string, headers []string) {
+	if auth != "" {
+		if scheme, token, ok := strings.Cut(auth, " "); ok && strings.EqualFold(scheme, "Bearer") {
+			req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(token))
+		} else {
+			user, pass, _ := strings.Cut(auth, ":")
+			req.SetBasicAuth(user, pass)
+		}
+	}
+	for _, h := range headers {
+		key, value, _ := strings.Cut(h, "=")
+		req.Header.Set(strings.TrimSpace(key), strings.TrimSpace(value))
+	}
+}
+
+// doNotificationRequest sends req with the -notify-auth credentials and
+// -notify-header headers.
+func doNotificationRequest(req *http.Request) error {
+	applyAuth(req, *notifyAuth, notifyHeaders)
+	return sendNotificationRequest(req)
+}
+
+// sendNotificationRequest sends req and classifies the outcome, always
+// draining and closing the response body.
+func sendNotificationRequest(req *http.Request) error {
+	resp, err := notificationClient.Do(req)
+	if err != nil {
+		return retryableError{fmt.Errorf("error sending notification: %w", err)}
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 500 {
+		return retryableError{fmt.Errorf("status %d", resp.StatusCode)}
+	}
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// WebhookNotifier posts the plain message, prefixed with its severity, to a
+// generic webhook.
+type WebhookNotifier struct {
+	URL string
+}
+
+func (n WebhookNotifier) Notify(ctx context.Context, event Event) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, strings.NewReader(levelPrefix(event)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	return doNotificationRequest(req)
+}
+
+// gotifyPriority maps severities to Gotify message priorities (0-10).
+var gotifyPriority = map[string]int{
+	severityInfo:    2,
+	severityUpdate:  5,
+	severityWarning: 7,
+	severityError:   8,
+}
+
+// GotifyNotifier posts to a Gotify server's /message endpoint using an
+// application token.
+type GotifyNotifier struct {
+	URL   string
+	Token string
+}
+
+func (n GotifyNotifier) Notify(ctx context.Context, event Event) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"title":    notificationTitle,
+		"message":  event.Message,
+		"priority": gotifyPriority[event.Severity],
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(n.URL, "/")+"/message", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gotify-Key", n.Token)
+	return doNotificationRequest(req)
+}
+
+// ntfyPriority maps severities to ntfy priorities.
+var ntfyPriority = map[string]string{
+	severityInfo:    "low",
+	severityUpdate:  "default",
+	severityWarning: "high",
+	severityError:   "urgent",
+}
+
+// NtfyNotifier publishes to an ntfy topic URL, passing the title and
+// priority as headers.
+type NtfyNotifier struct {
+	URL   string
+	Token string
+}
+
+func (n NtfyNotifier) Notify(ctx context.Context, event Event) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, strings.NewReader(event.Message))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Title", notificationTitle)
+	req.Header.Set("Priority", ntfyPriority[event.Severity])
+	req.Header.Set("Tags", event.Severity)
+	if n.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+n.Token)
+	}
+	return doNotificationRequest(req)
+}
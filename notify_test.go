@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// withNotificationQueue runs the delivery goroutine on a fresh queue for the
+// duration of a test, with short timeouts.
+func withNotificationQueue(t *testing.T, timeout time.Duration) {
+	t.Helper()
+	oldQueue, oldClient, oldDelay := notifications, notificationClient, notificationRetryDelay
+	notifications = make(chan queuedNotification, 64)
+	notificationClient = &http.Client{Timeout: timeout}
+	notificationRetryDelay = 10 * time.Millisecond
+	startNotifier()
+	t.Cleanup(func() {
+		flushNotifications(5 * time.Second)
+		notifications, notificationClient, notificationRetryDelay = oldQueue, oldClient, oldDelay
+		notifierDone = nil
+	})
+}
+
+func TestQueuedNotifierDoesNotBlockOnHangingEndpoint(t *testing.T) {
+	var requests atomic.Int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(release) })
+	withNotificationQueue(t, 100*time.Millisecond)
+
+	n := queuedNotifier{next: WebhookNotifier{URL: srv.URL}}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		notifyEvent(context.Background(), n, Event{Type: eventUpdate, Message: "Successfully updated web"})
+	}
+	if took := time.Since(start); took > 50*time.Millisecond {
+		t.Fatalf("queueing notifications took %s, the check loop must not wait for the endpoint", took)
+	}
+
+	// Every event is attempted twice and each attempt gives up after the
+	// notification timeout.
+	deadline := time.Now().Add(5 * time.Second)
+	for requests.Load() < 6 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := requests.Load(); got != 6 {
+		t.Errorf("endpoint received %d requests, want 6 (2 attempts for 3 events)", got)
+	}
+}
+
+func TestDeliverNotificationRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		want     int32
+	}{
+		{"success", []int{http.StatusOK}, 1},
+		{"server error is retried", []int{http.StatusBadGateway, http.StatusOK}, 2},
+		{"attempts are limited", []int{http.StatusInternalServerError, http.StatusInternalServerError, http.StatusOK}, 2},
+		{"client error is not retried", []int{http.StatusBadRequest, http.StatusOK}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := int(requests.Add(1))
+				w.WriteHeader(tt.statuses[n-1])
+			}))
+			defer srv.Close()
+			oldDelay := notificationRetryDelay
+			notificationRetryDelay = time.Millisecond
+			defer func() { notificationRetryDelay = oldDelay }()
+
+			deliverNotification(WebhookNotifier{URL: srv.URL}, Event{Type: eventError, Message: "boom"})
+			if got := requests.Load(); got != tt.want {
+				t.Errorf("requests = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateNotificationURL(t *testing.T) {
+	tests := []struct {
+		url   string
+		valid bool
+	}{
+		{"https://hooks.example.com/notify", true},
+		{"http://localhost:8080/hook?token=abc", true},
+		{"http://10.0.0.5", true},
+		{"hooks.example.com/notify", false},
+		{"ftp://example.com/notify", false},
+		{"https://", false},
+		{"https:///path", false},
+		{"://missing-scheme", false},
+		{"", false},
+		{"http://exa mple.com", false},
+	}
+	for _, tt := range tests {
+		err := validateNotificationURL(tt.url)
+		if (err == nil) != tt.valid {
+			t.Errorf("validateNotificationURL(%q) = %v, want valid=%v", tt.url, err, tt.valid)
+		}
+	}
+}
+
+// recordingNotifier keeps the events it receives.
+type recordingNotifier struct {
+	events []Event
+}
+
+func (r *recordingNotifier) Notify(_ context.Context, event Event) error {
+	r.events = append(r.events, event)
+	return nil
+}
+
+func TestNotifyOnCompleteSendsOneNotificationPerCycle(t *testing.T) {
+	d, cli := withUpdate(t)
+	for _, name := range []string{"api", "worker"} {
+		d.addContainer(testContainer(name+"-old", name, "nginx:latest", oldImageID))
+	}
+	events, err := parseEventSet("complete")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &recordingNotifier{}
+
+	if err := checkContainers(cli, "", "", "", "", eventFilter{events: events, next: rec}); err != nil {
+		t.Fatalf("checkContainers: %v", err)
+	}
+	if len(d.created) != 3 {
+		t.Fatalf("updated %d containers, want 3", len(d.created))
+	}
+	if len(rec.events) != 1 {
+		t.Fatalf("got %d notifications, want exactly one: %+v", len(rec.events), rec.events)
+	}
+	if got := rec.events[0]; got.Type != eventComplete || !strings.Contains(got.Message, "3 updated") {
+		t.Errorf("notification = %q %q, want the completion of a cycle with 3 updates", got.Type, got.Message)
+	}
+}
+
+// capturedRequest is a notification request as received by a test server.
+type capturedRequest struct {
+	method, path string
+	header       http.Header
+	body         string
+}
+
+// captureServer records the requests it receives and answers with status.
+func captureServer(t *testing.T, status int) (*httptest.Server, chan capturedRequest) {
+	t.Helper()
+	requests := make(chan capturedRequest, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- capturedRequest{method: r.Method, path: r.URL.Path, header: r.Header, body: string(body)}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, requests
+}
+
+func TestGotifyWireFormat(t *testing.T) {
+	srv, requests := captureServer(t, http.StatusOK)
+	n := GotifyNotifier{URL: srv.URL + "/", Token: "app-token"}
+	if err := n.Notify(context.Background(), Event{Type: eventError, Severity: severityError, Message: "Error recreating web"}); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	req := <-requests
+	if req.method != http.MethodPost || req.path != "/message" {
+		t.Errorf("request = %s %s, want POST /message", req.method, req.path)
+	}
+	if got := req.header.Get("X-Gotify-Key"); got != "app-token" {
+		t.Errorf("X-Gotify-Key = %q", got)
+	}
+	var body struct {
+		Title    string `json:"title"`
+		Message  string `json:"message"`
+		Priority int    `json:"priority"`
+	}
+	if err := json.Unmarshal([]byte(req.body), &body); err != nil {
+		t.Fatalf("body %q: %v", req.body, err)
+	}
+	if body.Title != notificationTitle || body.Message != "Error recreating web" || body.Priority != 8 {
+		t.Errorf("body = %+v", body)
+	}
+}
+
+func TestNtfyWireFormat(t *testing.T) {
+	srv, requests := captureServer(t, http.StatusOK)
+	n := NtfyNotifier{URL: srv.URL + "/puller", Token: "tk_123"}
+	if err := n.Notify(context.Background(), Event{Type: eventUpdate, Severity: severityUpdate, Message: "Successfully updated web"}); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	req := <-requests
+	if req.path != "/puller" || req.body != "Successfully updated web" {
+		t.Errorf("request = %s %q", req.path, req.body)
+	}
+	for header, want := range map[string]string{
+		"Title":         notificationTitle,
+		"Priority":      "default",
+		"Tags":          severityUpdate,
+		"Authorization": "Bearer tk_123",
+	} {
+		if got := req.header.Get(header); got != want {
+			t.Errorf("%s = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestNewNotifierRequiresGotifyToken(t *testing.T) {
+	if _, err := newNotifier("gotify", "https://gotify.example.com", ""); err == nil {
+		t.Error("gotify without a token accepted")
+	}
+	if _, err := newNotifier("slack", "https://hooks.example.com", ""); err == nil {
+		t.Error("unknown format accepted")
+	}
+}
+
+func TestMultiNotifierAggregatesErrors(t *testing.T) {
+	ok, okRequests := captureServer(t, http.StatusOK)
+	broken, _ := captureServer(t, http.StatusInternalServerError)
+	rejected, _ := captureServer(t, http.StatusForbidden)
+
+	m := MultiNotifier{
+		WebhookNotifier{URL: broken.URL},
+		WebhookNotifier{URL: ok.URL},
+		WebhookNotifier{URL: rejected.URL},
+	}
+	err := m.Notify(context.Background(), Event{Type: eventUpdate, Message: "Successfully updated web"})
+	if err == nil {
+		t.Fatal("Notify succeeded although two backends failed")
+	}
+	for _, status := range []string{"500", "403"} {
+		if !strings.Contains(err.Error(), status) {
+			t.Errorf("error %q does not mention the %s failure", err, status)
+		}
+	}
+	// A failing backend does not keep the event from the others.
+	if len(okRequests) != 1 {
+		t.Errorf("working backend received %d requests, want 1", len(okRequests))
+	}
+
+	if err := (MultiNotifier{WebhookNotifier{URL: ok.URL}, NoopNotifier{}}).Notify(context.Background(), Event{Type: eventUpdate}); err != nil {
+		t.Errorf("Notify with only working backends: %v", err)
+	}
+	if err := (MultiNotifier{}).Notify(context.Background(), Event{Type: eventUpdate}); err != nil {
+		t.Errorf("empty MultiNotifier: %v", err)
+	}
+}
+
+func TestDedupeOnlySuppressesErrors(t *testing.T) {
+	rec := &recordingNotifier{}
+	n := newDedupeNotifier(time.Hour, rec)
+
+	failure := Event{Type: eventError, Message: "Error in check cycle: daemon unreachable"}
+	recovery := Event{Type: eventError, Kind: kindCheckRecovered, Severity: severityInfo, Message: "Checks recovered after 1 failed cycles"}
+	for i := 0; i < 2; i++ {
+		notifyEvent(context.Background(), n, failure)
+		notifyEvent(context.Background(), n, recovery)
+	}
+
+	var failures, recoveries int
+	for _, event := range rec.events {
+		switch {
+		case event.Kind == kindCheckRecovered:
+			recoveries++
+			if event.Severity != severityInfo {
+				t.Errorf("recovery sent with severity %q, want info", event.Severity)
+			}
+		case event.Severity == severityError:
+			failures++
+		}
+	}
+	if failures != 1 {
+		t.Errorf("sent %d identical failures, want 1", failures)
+	}
+	if recoveries != 2 {
+		t.Errorf("sent %d recoveries, want 2: recoveries must not be deduplicated", recoveries)
+	}
+}
+
+func TestNotificationTemplate(t *testing.T) {
+	tmpl, err := parseNotificationTemplate(`[{{.Host}}] {{.Event}} {{.Container}}: {{.OldImage}} -> {{.NewImage}} ({{.Severity}})`)
+	if err != nil {
+		t.Fatalf("parseNotificationTemplate: %v", err)
+	}
+	rec := &recordingNotifier{}
+	n := templateNotifier{tmpl: tmpl, host: "docker-01", next: rec}
+	notifyEvent(context.Background(), n, Event{
+		Type:      eventUpdate,
+		Container: "web",
+		OldImage:  oldImageID,
+		NewImage:  "nginx:1.25",
+		Message:   "Successfully updated web",
+	})
+	want := "[docker-01] update web: " + oldImageID + " -> nginx:1.25 (update)"
+	if len(rec.events) != 1 || rec.events[0].Message != want {
+		t.Fatalf("rendered %+v, want message %q", rec.events, want)
+	}
+	if rec.events[0].Container != "web" || rec.events[0].Type != eventUpdate {
+		t.Errorf("event fields changed by rendering: %+v", rec.events[0])
+	}
+}
+
+func TestNotificationTemplateFallsBackToMessage(t *testing.T) {
+	// The out-of-range index is only evaluated for errors, so the template
+	// passes the startup check against a sample update.
+	tmpl, err := parseNotificationTemplate(`{{if eq .Event "error"}}{{index .Message 99}}{{else}}{{.Message}}{{end}}`)
+	if err != nil {
+		t.Fatalf("parseNotificationTemplate: %v", err)
+	}
+	rec := &recordingNotifier{}
+	notifyEvent(context.Background(), templateNotifier{tmpl: tmpl, next: rec}, Event{Type: eventError, Message: "Error recreating web"})
+	if len(rec.events) != 1 || rec.events[0].Message != "Error recreating web" {
+		t.Errorf("sent %+v, want the plain message", rec.events)
+	}
+}
+
+func TestParseNotificationTemplateRejectsBadTemplates(t *testing.T) {
+	for _, text := range []string{
+		"{{.Container",
+		"{{.Unknown}}",
+		"{{template \"missing\"}}",
+	} {
+		if _, err := parseNotificationTemplate(text); err == nil {
+			t.Errorf("parseNotificationTemplate(%q) succeeded", text)
+		}
+	}
+}
+
+func TestNotifyDigestSendsOneNotificationPerCycle(t *testing.T) {
+	d, cli := withUpdate(t)
+	for _, name := range []string{"api", "worker"} {
+		d.addContainer(testContainer(name+"-old", name, "nginx:latest", oldImageID))
+	}
+	events, err := parseEventSet("update,error")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &recordingNotifier{}
+	digest := &digestNotifier{next: rec}
+	notifier := eventFilter{events: events, next: digest}
+
+	if err := checkContainers(cli, "", "", "", "", notifier); err != nil {
+		t.Fatalf("checkContainers: %v", err)
+	}
+	if len(rec.events) != 0 {
+		t.Fatalf("%d notifications sent before the flush, want none", len(rec.events))
+	}
+	digest.flush()
+
+	if len(rec.events) != 1 {
+		t.Fatalf("got %d notifications, want exactly one digest: %+v", len(rec.events), rec.events)
+	}
+	got := rec.events[0]
+	if got.Type != eventSummary {
+		t.Errorf("digest type = %q, want %q", got.Type, eventSummary)
+	}
+	if !strings.HasPrefix(got.Message, "Check cycle: 3 updated, 0 failed\n") {
+		t.Errorf("digest message does not summarize the cycle:\n%s", got.Message)
+	}
+	for _, name := range []string{"web", "api", "worker"} {
+		if !strings.Contains(got.Message, "Successfully updated "+name) {
+			t.Errorf("digest message is missing the update of %s:\n%s", name, got.Message)
+		}
+	}
+
+	// An empty cycle sends nothing.
+	digest.flush()
+	if len(rec.events) != 1 {
+		t.Errorf("flushing an empty digest sent %d more notifications", len(rec.events)-1)
+	}
+}
+
+func TestEventWebhookSendsOnlyItsOwnCredentials(t *testing.T) {
+	oldAuth, oldHeaders := *notifyAuth, notifyHeaders
+	*notifyAuth, notifyHeaders = "Bearer notify-token", headerList{"X-Notify=secret"}
+	t.Cleanup(func() { *notifyAuth, notifyHeaders = oldAuth, oldHeaders })
+
+	srv, requests := captureServer(t, http.StatusOK)
+	event := Event{Type: eventUpdate, Container: "web", Message: "Updated web"}
+
+	if err := (WebhookNotifier{URL: srv.URL}).Notify(context.Background(), event); err != nil {
+		t.Fatalf("webhook Notify: %v", err)
+	}
+	req := <-requests
+	if got := req.header.Get("Authorization"); got != "Bearer notify-token" {
+		t.Errorf("webhook Authorization = %q, want the -notify-auth token", got)
+	}
+	if got := req.header.Get("X-Notify"); got != "secret" {
+		t.Errorf("webhook X-Notify = %q, want secret", got)
+	}
+
+	sink := EventWebhookNotifier{URL: srv.URL, Auth: "events:pass", Headers: []string{"X-Events=1"}}
+	if err := sink.Notify(context.Background(), event); err != nil {
+		t.Fatalf("event Notify: %v", err)
+	}
+	req = <-requests
+	if user, pass, ok := (&http.Request{Header: req.header}).BasicAuth(); !ok || user != "events" || pass != "pass" {
+		t.Errorf("event Authorization = %q, want basic auth for events", req.header.Get("Authorization"))
+	}
+	if got := req.header.Get("X-Events"); got != "1" {
+		t.Errorf("event X-Events = %q, want 1", got)
+	}
+	if got := req.header.Get("X-Notify"); got != "" {
+		t.Errorf("event request leaked -notify-header X-Notify = %q", got)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/docker/docker/api/types"
+)
+
+var (
+	dependsOnLabel = "puller.update.depends-on"
+	orderLabel     = "puller.update.order"
+)
+
+// defaultUpdateOrder is used for containers without an order label, placing
+// them between explicitly early and explicitly late containers.
+const defaultUpdateOrder = 50
+
+// updateOrder returns the priority from the order label; lower runs first.
+func updateOrder(labels map[string]string) int {
+	v, ok := labels[orderLabel]
+	if !ok {
+		return defaultUpdateOrder
+	}
+	order, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil {
+		logWarn("Invalid %s label %q, using default order %d", orderLabel, v, defaultUpdateOrder)
+		return defaultUpdateOrder
+	}
+	return order
+}
+
+// sortByUpdateOrder sorts containers by ascending order label, keeping the
+// listing order for containers with the same priority.
+func sortByUpdateOrder(containers []types.Container) {
+	orders := make(map[string]int, len(containers))
+	for _, c := range containers {
+		orders[c.ID] = updateOrder(c.Labels)
+	}
+	sort.SliceStable(containers, func(i, j int) bool {
+		return orders[containers[i].ID] < orders[containers[j].ID]
+	})
+}
+
+// pendingUpdate is a container whose image changed and that is waiting to be
+// recreated in the current cycle.
+type pendingUpdate struct {
+	id       string
+	name     string
+	labels   map[string]string
+	oldImage string
+	newImage string
+	result   containerResult
+	// recreateAs replaces the configured image of the container when set,
+	// for updates that move it to a different tag.
+	recreateAs string
+}
+
+// event returns a notification event about this container's update.
+func (p pendingUpdate) event(eventType, message string) Event {
+	return Event{Type: eventType, Container: p.name, OldImage: p.oldImage, NewImage: p.newImage, Message: message}
+}
+
+// dependencies returns the container names listed in the depends-on label.
+func (p pendingUpdate) dependencies() []string {
+	var deps []string
+	for _, d := range strings.Split(p.labels[dependsOnLabel], ",") {
+		if d = strings.TrimPrefix(strings.TrimSpace(d), "/"); d != "" {
+			deps = append(deps, d)
+		}
+	}
+	return deps
+}
+
+// orderByDependencies sorts pending updates so that containers listed in a
+// depends-on label are recreated before the containers that depend on them.
+// Dependencies outside the pending set are ignored. The original order is kept
+// among independent containers, and returned unchanged if a cycle is found.
+func orderByDependencies(pending []pendingUpdate) []pendingUpdate {
+	index := make(map[string]int, len(pending))
+	for i, p := range pending {
+		index[p.name] = i
+	}
+
+	inDegree := make([]int, len(pending))
+	dependents := make([][]int, len(pending))
+	for i, p := range pending {
+		for _, dep := range p.dependencies() {
+			j, ok := index[dep]
+			if !ok || j == i {
+				continue
+			}
+			inDegree[i]++
+			dependents[j] = append(dependents[j], i)
+		}
+	}
+
+	ordered := make([]pendingUpdate, 0, len(pending))
+	done := make([]bool, len(pending))
+	for len(ordered) < len(pending) {
+		next := -1
+		for i := range pending {
+			if !done[i] && inDegree[i] == 0 {
+				next = i
+				break
+			}
+		}
+		if next == -1 {
+			logWarn("Dependency cycle detected between containers, recreating in original order")
+			return pending
+		}
+		done[next] = true
+		ordered = append(ordered, pending[next])
+		for _, d := range dependents[next] {
+			inDegree[d]--
+		}
+	}
+	return ordered
+}
+
+// applyUpdateBudget caps the number of containers recreated in one cycle.
+// Containers are chosen by name so the same ones win on every cycle; the rest
+// are picked up again by later checks. A budget of 0 means unlimited.
+func applyUpdateBudget(pending []pendingUpdate, budget int) []pendingUpdate {
+	if budget <= 0 || len(pending) <= budget {
+		return pending
+	}
+
+	byName := append([]pendingUpdate(nil), pending...)
+	sort.SliceStable(byName, func(i, j int) bool { return byName[i].name < byName[j].name })
+	allowed := make(map[string]bool, budget)
+	for _, p := range byName[:budget] {
+		allowed[p.id] = true
+	}
+
+	selected := make([]pendingUpdate, 0, budget)
+	for _, p := range pending {
+		if allowed[p.id] {
+			selected = append(selected, p)
+		}
+	}
+	logInfo("update budget exhausted, deferring %d containers", len(pending)-budget)
+	return selected
+}
+
+// runRecreations calls apply for the pending updates in order, with up to
+// limit calls running at once. An update waits until the updates it depends
+// on have finished. Once apply returns false no further updates are started.
+func runRecreations(ordered []pendingUpdate, limit int, apply func(pendingUpdate) bool) {
+	slots := make(chan struct{}, limit)
+	finished := make(map[string]chan struct{}, len(ordered))
+	var wg sync.WaitGroup
+	var stopped atomic.Bool
+	for _, p := range ordered {
+		// Only dependencies started earlier are waited for; after a
+		// dependency cycle the later ones are never started first.
+		for _, dep := range p.dependencies() {
+			if done, ok := finished[dep]; ok {
+				<-done
+			}
+		}
+		select {
+		case slots <- struct{}{}:
+		default:
+			logVerbose("Recreating %s waits for a free slot (-max-parallel-recreate %d)", p.name, limit)
+			slots <- struct{}{}
+		}
+		if stopped.Load() {
+			<-slots
+			break
+		}
+
+		done := make(chan struct{})
+		finished[p.name] = done
+		wg.Add(1)
+		go func(p pendingUpdate) {
+			defer wg.Done()
+			defer close(done)
+			defer func() { <-slots }()
+			if !apply(p) {
+				stopped.Store(true)
+			}
+		}(p)
+	}
+	wg.Wait()
+}
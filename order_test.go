@@ -0,0 +1,194 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func pendingNamed(name, dependsOn string) pendingUpdate {
+	p := pendingUpdate{id: "id-" + name, name: name, labels: map[string]string{}}
+	if dependsOn != "" {
+		p.labels[dependsOnLabel] = dependsOn
+	}
+	return p
+}
+
+func pendingNames(pending []pendingUpdate) []string {
+	names := make([]string, 0, len(pending))
+	for _, p := range pending {
+		names = append(names, p.name)
+	}
+	return names
+}
+
+func TestOrderByDependencies(t *testing.T) {
+	tests := []struct {
+		name    string
+		pending []pendingUpdate
+		want    []string
+	}{
+		{
+			name: "chain of three",
+			pending: []pendingUpdate{
+				pendingNamed("web", "api"),
+				pendingNamed("api", "db"),
+				pendingNamed("db", ""),
+			},
+			want: []string{"db", "api", "web"},
+		},
+		{
+			name: "independent containers keep their order",
+			pending: []pendingUpdate{
+				pendingNamed("b", ""),
+				pendingNamed("a", ""),
+				pendingNamed("c", "b"),
+			},
+			want: []string{"b", "a", "c"},
+		},
+		{
+			name: "dependencies outside the set are ignored",
+			pending: []pendingUpdate{
+				pendingNamed("web", "cache, /db"),
+				pendingNamed("db", ""),
+			},
+			want: []string{"db", "web"},
+		},
+		{
+			name: "cycle falls back to the original order",
+			pending: []pendingUpdate{
+				pendingNamed("a", "c"),
+				pendingNamed("b", "a"),
+				pendingNamed("c", "b"),
+				pendingNamed("d", ""),
+			},
+			want: []string{"a", "b", "c", "d"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := pendingNames(orderByDependencies(tt.pending))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("orderByDependencies() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunRecreationsWaitsForDependencies(t *testing.T) {
+	ordered := orderByDependencies([]pendingUpdate{
+		pendingNamed("web", "api"),
+		pendingNamed("api", "db"),
+		pendingNamed("db", ""),
+	})
+
+	var mu sync.Mutex
+	var recreated []string
+	runRecreations(ordered, 3, func(p pendingUpdate) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		recreated = append(recreated, p.name)
+		return true
+	})
+	if want := []string{"db", "api", "web"}; !reflect.DeepEqual(recreated, want) {
+		t.Errorf("recreated %v, want %v", recreated, want)
+	}
+}
+
+func TestApplyUpdateBudget(t *testing.T) {
+	captureLog(t, levelInfo)
+	orders := [][]string{
+		{"e", "c", "a", "d", "b"},
+		{"a", "b", "c", "d", "e"},
+		{"d", "b", "e", "a", "c"},
+	}
+	for _, names := range orders {
+		var pending []pendingUpdate
+		for _, name := range names {
+			pending = append(pending, pendingNamed(name, ""))
+		}
+		got := pendingNames(applyUpdateBudget(pending, 2))
+		sort.Strings(got)
+		if want := []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: selected %v, want %v", names, got, want)
+		}
+	}
+	if got := applyUpdateBudget([]pendingUpdate{pendingNamed("a", "")}, 0); len(got) != 1 {
+		t.Errorf("budget 0 selected %v, want everything", pendingNames(got))
+	}
+}
+
+func TestCheckRecreatesWithinBudget(t *testing.T) {
+	old := *maxUpdatesPerCycle
+	*maxUpdatesPerCycle = 2
+	defer func() { *maxUpdatesPerCycle = old }()
+
+	for run := 0; run < 2; run++ {
+		logs := captureLog(t, levelInfo)
+		d, cli := newFakeDocker(t)
+		d.addImage(oldImageID, "2024-01-01T00:00:00Z", "nginx:latest")
+		d.addImage(newImageID, "2024-02-01T00:00:00Z")
+		d.publish("nginx:latest", newImageID)
+		for _, name := range []string{"e", "c", "a", "d", "b"} {
+			d.addContainer(testContainer("id-"+name, name, "nginx:latest", oldImageID))
+		}
+
+		if err := checkContainers(cli, "", "", "", "", NoopNotifier{}); err != nil {
+			t.Fatalf("run %d: checkContainers: %v", run, err)
+		}
+		var recreated []string
+		for _, c := range d.created {
+			recreated = append(recreated, c.Name)
+		}
+		sort.Strings(recreated)
+		if want := []string{"a", "b"}; !reflect.DeepEqual(recreated, want) {
+			t.Errorf("run %d: recreated %v, want %v", run, recreated, want)
+		}
+		if !strings.Contains(logs.String(), "update budget exhausted, deferring 3 containers") {
+			t.Errorf("run %d: deferred count not logged: %q", run, logs.String())
+		}
+	}
+}
+
+func TestRunRecreationsStopsAfterFailure(t *testing.T) {
+	ordered := []pendingUpdate{pendingNamed("a", ""), pendingNamed("b", ""), pendingNamed("c", "")}
+	var applied []string
+	runRecreations(ordered, 1, func(p pendingUpdate) bool {
+		applied = append(applied, p.name)
+		return p.name != "a"
+	})
+	if want := []string{"a"}; !reflect.DeepEqual(applied, want) {
+		t.Errorf("applied %v, want %v", applied, want)
+	}
+}
+
+func TestCheckFailFastStopsRecreating(t *testing.T) {
+	for _, failFastOn := range []bool{false, true} {
+		old := *failFast
+		*failFast = failFastOn
+		d, cli := newFakeDocker(t)
+		d.addImage(oldImageID, "2024-01-01T00:00:00Z", "nginx:latest")
+		d.addImage(newImageID, "2024-02-01T00:00:00Z")
+		d.publish("nginx:latest", newImageID)
+		for _, name := range []string{"a", "b", "c"} {
+			d.addContainer(testContainer("id-"+name, name, "nginx:latest", oldImageID))
+		}
+		d.fail("POST /containers/create", http.StatusInternalServerError)
+
+		err := checkContainers(cli, "", "", "", "", NoopNotifier{})
+		*failFast = old
+		if failFastOn && err == nil {
+			t.Error("-fail-fast: cycle with a failed recreation was not aborted")
+		}
+		want := 3
+		if failFastOn {
+			want = 1
+		}
+		if n := d.count("POST /containers/create"); n != want {
+			t.Errorf("-fail-fast=%v: attempted %d recreations, want %d", failFastOn, n, want)
+		}
+	}
+}
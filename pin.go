@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+// pinTagLabel records the floating tag of a container that -pin-digest
+// created from a digest reference, so later checks still follow the tag.
+const pinTagLabel = "puller.pin.tag"
+
+// floatingImage returns the image reference whose updates c follows: the
+// tag it was pinned from, or its configured image.
+func floatingImage(c types.Container) string {
+	if tag := c.Labels[pinTagLabel]; tag != "" {
+		return tag
+	}
+	return c.Image
+}
+
+// pinnedReference returns image qualified with the registry digest of the
+// local image it resolves to, e.g. nginx:latest@sha256:.... An image pulled
+// through -registry-mirror only has a digest under the mirror's name, which
+// is the same manifest the origin serves.
+func pinnedReference(cli *client.Client, ctx context.Context, image string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", fmt.Errorf("parse reference %q: %w", image, err)
+	}
+	named = reference.TagNameOnly(named)
+	names := map[string]bool{named.Name(): true}
+	if mirrored, ok := mirrorReference(named.String()); ok {
+		if m, err := reference.ParseNormalizedNamed(mirrored); err == nil {
+			names[m.Name()] = true
+		}
+	}
+
+	callCtx, cancel := withAPITimeout(ctx)
+	inspect, _, err := cli.ImageInspectWithRaw(callCtx, image)
+	cancel()
+	if err != nil {
+		return "", err
+	}
+	for _, rd := range inspect.RepoDigests {
+		digested, err := reference.ParseNormalizedNamed(rd)
+		if err != nil || !names[digested.Name()] {
+			continue
+		}
+		d, ok := digested.(reference.Digested)
+		if !ok {
+			continue
+		}
+		pinned, err := reference.WithDigest(named, d.Digest())
+		if err != nil {
+			return "", err
+		}
+		return reference.FamiliarString(pinned), nil
+	}
+	return "", fmt.Errorf("image has no registry digest for %s", reference.FamiliarName(named))
+}
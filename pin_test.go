@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestPinnedReference(t *testing.T) {
+	tests := []struct {
+		name        string
+		mirrors     string
+		repoDigests []string
+		want        string
+	}{
+		{"origin digest", "", []string{"nginx@" + pinnedDigest}, "nginx:latest@" + pinnedDigest},
+		{"pulled through mirror", "mirror.local", []string{"mirror.local/library/nginx@" + pinnedDigest}, "nginx:latest@" + pinnedDigest},
+		{"mirror digest without -registry-mirror", "", []string{"mirror.local/library/nginx@" + pinnedDigest}, ""},
+		{"digest of another repository", "mirror.local", []string{"myorg/nginx@" + pinnedDigest}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withMirrors(t, tt.mirrors)
+			d, cli := newFakeDocker(t)
+			d.addImage(newImageID, "2024-02-01T00:00:00Z", "nginx:latest")
+			img := d.images[newImageID]
+			img.RepoDigests = tt.repoDigests
+			d.images[newImageID] = img
+
+			got, err := pinnedReference(cli, context.Background(), "nginx:latest")
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("pinnedReference = %q, want an error", got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("pinnedReference = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckPinsRecreatedContainerToDigest(t *testing.T) {
+	old := *pinDigest
+	*pinDigest = true
+	defer func() { *pinDigest = old }()
+
+	d, cli := withUpdate(t)
+	d.mu.Lock()
+	img := d.images[newImageID]
+	img.RepoDigests = []string{"nginx@" + pinnedDigest}
+	d.images[newImageID] = img
+	d.mu.Unlock()
+
+	if err := checkContainers(cli, "", "", "", "", NoopNotifier{}); err != nil {
+		t.Fatalf("checkContainers: %v", err)
+	}
+	recreated := d.container("web")
+	if recreated == nil || recreated.ID == "old" {
+		t.Fatal("web was not recreated")
+	}
+	if want := "nginx:latest@" + pinnedDigest; recreated.Config.Image != want {
+		t.Errorf("recreated from %q, want %q", recreated.Config.Image, want)
+	}
+	if recreated.Image != newImageID {
+		t.Errorf("recreated on %s, want %s", recreated.Image, newImageID)
+	}
+	if tag := recreated.Config.Labels[pinTagLabel]; tag != "nginx:latest" {
+		t.Errorf("%s label = %q, want nginx:latest", pinTagLabel, tag)
+	}
+
+	// The next cycle follows the floating tag and finds nothing new.
+	if err := checkContainers(cli, "", "", "", "", NoopNotifier{}); err != nil {
+		t.Fatalf("second checkContainers: %v", err)
+	}
+	if len(d.created) != 1 {
+		t.Errorf("recreated %d times, want once", len(d.created))
+	}
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"golang.org/x/time/rate"
+)
+
+// progressLogInterval throttles verbose pull progress lines.
+const progressLogInterval = 5 * time.Second
+
+// pullMessage is a single entry of the JSON progress stream returned by ImagePull.
+type pullMessage struct {
+	ID          string `json:"id"`
+	Status      string `json:"status"`
+	Error       string `json:"error"`
+	ErrorDetail struct {
+		Message string `json:"message"`
+	} `json:"errorDetail"`
+	ProgressDetail struct {
+		Current int64 `json:"current"`
+		Total   int64 `json:"total"`
+	} `json:"progressDetail"`
+}
+
+var (
+	platformLabel = "puller.update.platform"
+	// platformAliasLabel is a shorter spelling of platformLabel, which wins
+	// when both are set.
+	platformAliasLabel = "puller.platform"
+	platformPattern    = regexp.MustCompile(`^[a-z0-9_]+/[a-z0-9_]+(/[a-z0-9_.]+)?$`)
+)
+
+// validatePlatform checks that p has the os/arch[/variant] form.
+func validatePlatform(p string) error {
+	if !platformPattern.MatchString(p) {
+		return fmt.Errorf("platform %q must look like os/arch[/variant], e.g. linux/arm64", p)
+	}
+	return nil
+}
+
+// resolvePlatform picks the platform to pull: the container's platform label,
+// then the -platform flag, then the platform of the running image.
+func resolvePlatform(labels map[string]string, inspected string) string {
+	for _, label := range []string{platformLabel, platformAliasLabel} {
+		p, ok := labels[label]
+		if !ok {
+			continue
+		}
+		err := validatePlatform(p)
+		if err == nil {
+			return p
+		}
+		logWarn("Ignoring %s label: %v", label, err)
+	}
+	if *platformOverride != "" {
+		return *platformOverride
+	}
+	return inspected
+}
+
+// withPullTimeout bounds a single pull or inspect by -pull-timeout.
+func withPullTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if *pullTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, *pullTimeout)
+}
+
+// pullCache remembers the images pulled during a single check cycle, so
+// containers sharing an image reference only cause one pull. When the
+// manifest digest of a reference is known (with -head-check), references
+// resolving to an already pulled digest are tagged locally instead of pulled
+// again. A new cache is created for every cycle so results are never stale;
+// a nil cache disables caching.
+type pullCache struct {
+	results  map[string]pullResult
+	digests  map[string]string
+	byDigest map[string]digestResult
+}
+
+type pullResult struct {
+	image types.ImageInspect
+	err   error
+}
+
+// digestResult is a successful pull of a manifest digest under image.
+type digestResult struct {
+	image  string
+	result types.ImageInspect
+}
+
+func newPullCache() *pullCache {
+	return &pullCache{
+		results:  make(map[string]pullResult),
+		digests:  make(map[string]string),
+		byDigest: make(map[string]digestResult),
+	}
+}
+
+// setDigest records the manifest digest the registry reported for image.
+func (c *pullCache) setDigest(image, digest string) {
+	if c != nil && digest != "" {
+		c.digests[image] = digest
+	}
+}
+
+// pull returns the cached result for image and platform, calling fetch on
+// the first request. If another reference with the same manifest digest was
+// already pulled, link is called with that reference to tag it as image.
+func (c *pullCache) pull(image, platform string, fetch func() (types.ImageInspect, error), link func(src string) error) (types.ImageInspect, error) {
+	if c == nil {
+		return fetch()
+	}
+	key := image + "|" + platform
+	if r, ok := c.results[key]; ok {
+		logVerbose("Reusing pull result for %s from this cycle", image)
+		return r.image, r.err
+	}
+
+	digestKey := ""
+	if digest := c.digests[image]; digest != "" {
+		digestKey = digest + "|" + platform
+		if d, ok := c.byDigest[digestKey]; ok {
+			err := link(d.image)
+			if err == nil {
+				logVerbose("Reusing %s for %s, both resolve to %s", d.image, image, digest)
+				c.results[key] = pullResult{image: d.result}
+				return d.result, nil
+			}
+			logVerbose("Could not reuse %s for %s, pulling: %v", d.image, image, err)
+		}
+	}
+
+	img, err := fetch()
+	c.results[key] = pullResult{image: img, err: err}
+	if err == nil && digestKey != "" {
+		c.byDigest[digestKey] = digestResult{image: image, result: img}
+	}
+	return img, err
+}
+
+// registryMirrors maps a registry domain to the mirror its images are
+// pulled from, as configured with -registry-mirror.
+var registryMirrors map[string]string
+
+// parseRegistryMirrors parses -registry-mirror: either a single mirror host
+// used for docker.io, or comma-separated source=mirror pairs.
+func parseRegistryMirrors(spec string) (map[string]string, error) {
+	mirrors := make(map[string]string)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		source, mirror, ok := strings.Cut(entry, "=")
+		if !ok {
+			source, mirror = "docker.io", entry
+		}
+		source = strings.TrimSpace(source)
+		mirror = strings.TrimSuffix(strings.TrimSpace(mirror), "/")
+		mirror = strings.TrimPrefix(strings.TrimPrefix(mirror, "https://"), "http://")
+		if source == "" || mirror == "" {
+			return nil, fmt.Errorf("entry %q must be source=mirror", entry)
+		}
+		if source == "index.docker.io" || source == "registry-1.docker.io" {
+			source = "docker.io"
+		}
+		mirrors[source] = mirror
+	}
+	return mirrors, nil
+}
+
+// mirrorReference returns the reference image is pulled from when its
+// registry has a mirror, e.g. nginx:1.25 becomes
+// mirror.local/library/nginx:1.25.
+func mirrorReference(image string) (string, bool) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", false
+	}
+	mirror, ok := registryMirrors[reference.Domain(named)]
+	if !ok {
+		return "", false
+	}
+	ref := mirror + "/" + reference.Path(named)
+	if tagged, ok := named.(reference.Tagged); ok {
+		ref += ":" + tagged.Tag()
+	}
+	if digested, ok := named.(reference.Digested); ok {
+		ref += "@" + digested.Digest().String()
+	}
+	return ref, true
+}
+
+// pullLimiter throttles registry pulls when -pulls-per-minute is set.
+var pullLimiter *rate.Limiter
+
+// waitForPullSlot blocks until the pull limiter allows another registry
+// operation, so throttling delays checks instead of failing them.
+func waitForPullSlot(ctx context.Context, image string) error {
+	if pullLimiter == nil {
+		return nil
+	}
+	r := pullLimiter.Reserve()
+	delay := r.Delay()
+	if delay <= 0 {
+		return nil
+	}
+
+	logVerbose("Throttling pull of %s for %s", image, delay.Round(time.Millisecond))
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		r.Cancel()
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// pullWithRetry calls ImagePull, retrying transient failures with exponential
+// backoff. Permanent failures such as bad credentials or unknown images are
+// returned immediately.
+func pullWithRetry(ctx context.Context, cli *client.Client, image string, opts types.ImagePullOptions) (io.ReadCloser, error) {
+	delay := *pullRetryDelay
+	for attempt := 1; ; attempt++ {
+		if err := waitForPullSlot(ctx, image); err != nil {
+			return nil, err
+		}
+		resp, err := cli.ImagePull(ctx, image, opts)
+		if err == nil {
+			return resp, nil
+		}
+		if attempt >= *pullRetries || !isRetryablePullError(ctx, err) {
+			return nil, err
+		}
+
+		logVerbose("Pull of %s failed (attempt %d/%d), retrying in %s: %v", image, attempt, *pullRetries, delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
+// isAuthError reports whether a pull was rejected for its credentials.
+func isAuthError(err error) bool {
+	if errdefs.IsUnauthorized(err) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "unauthorized") || strings.Contains(msg, "authentication required") ||
+		strings.Contains(msg, "no basic auth credentials")
+}
+
+// rateLimitBackoff is how long pulls are deferred after a rate limit when
+// the registry does not say when to retry.
+const rateLimitBackoff = time.Hour
+
+// errRateLimited marks checks that were stopped by a registry rate limit.
+var errRateLimited = errors.New("rate limited by registry")
+
+var (
+	// rateLimitedUntil is when pulls may resume after a rate limit.
+	rateLimitedUntil time.Time
+	// rateLimitAnnounced is set once the current rate limit was reported.
+	rateLimitAnnounced bool
+)
+
+// noteRateLimit defers all pulls until the given time.
+func noteRateLimit(until time.Time) {
+	if until.After(rateLimitedUntil) {
+		rateLimitedUntil = until
+		rateLimitAnnounced = false
+	}
+}
+
+// rateLimited reports whether pulls are currently deferred.
+func rateLimited() bool {
+	return time.Now().Before(rateLimitedUntil)
+}
+
+// isRateLimitError reports whether a pull failed because of a registry rate
+// limit (HTTP 429).
+func isRateLimitError(err error) bool {
+	if errors.Is(err, errRateLimited) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "toomanyrequests") || strings.Contains(msg, "rate limit") ||
+		strings.Contains(msg, "too many requests")
+}
+
+// parseRateLimitRemaining parses a RateLimit-Remaining header as sent by
+// Docker Hub, e.g. "76;w=21600".
+func parseRateLimitRemaining(header string) (int, bool) {
+	value, _, _ := strings.Cut(header, ";")
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// isRetryablePullError distinguishes transient registry or network failures
+// from errors that will not go away by trying again.
+func isRetryablePullError(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	// Retrying within seconds cannot outlast a registry rate limit window;
+	// those are deferred to a later cycle instead.
+	if isRateLimitError(err) {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	if errdefs.IsUnauthorized(err) || errdefs.IsForbidden(err) || errdefs.IsNotFound(err) || errdefs.IsInvalidParameter(err) {
+		return false
+	}
+	for _, permanent := range []string{"unauthorized", "denied", "not found", "manifest unknown", "authentication required"} {
+		if strings.Contains(msg, permanent) {
+			return false
+		}
+	}
+	return true
+}
+
+// consumePullProgress drains a pull response and returns the first error the
+// daemon reported in the stream, such as a rate limit hit after the pull
+// started. In verbose mode it also periodically logs a per-layer summary.
+func consumePullProgress(image string, r io.Reader) error {
+	verbose := logEnabled(levelVerbose)
+	var pullErr error
+	layers := make(map[string]pullMessage)
+	var order []string
+	lastLog := time.Now()
+	dec := json.NewDecoder(r)
+	for {
+		var msg pullMessage
+		if err := dec.Decode(&msg); err != nil {
+			if err != io.EOF {
+				logVerbose("Stopped reading pull progress for %s: %v", image, err)
+				_, _ = io.Copy(io.Discard, r)
+			}
+			break
+		}
+		if msg.Error != "" || msg.ErrorDetail.Message != "" {
+			text := msg.ErrorDetail.Message
+			if text == "" {
+				text = msg.Error
+			}
+			logVerbose("Pull %s reported an error: %s", image, text)
+			if pullErr == nil {
+				pullErr = errors.New(text)
+			}
+			continue
+		}
+		if !verbose {
+			continue
+		}
+		if msg.ID == "" || strings.HasPrefix(msg.Status, "Pulling from") {
+			if msg.Status != "" {
+				logVerbose("Pull %s: %s", image, msg.Status)
+			}
+			continue
+		}
+		if _, seen := layers[msg.ID]; !seen {
+			order = append(order, msg.ID)
+		}
+		layers[msg.ID] = msg
+
+		if time.Since(lastLog) >= progressLogInterval {
+			logVerbose("Pull %s: %s", image, summarizeLayers(layers, order))
+			lastLog = time.Now()
+		}
+	}
+	if len(layers) > 0 {
+		logVerbose("Pull %s finished: %s", image, summarizeLayers(layers, order))
+	}
+	return pullErr
+}
+
+// summarizeLayers condenses per-layer pull states into one log line.
+func summarizeLayers(layers map[string]pullMessage, order []string) string {
+	counts := make(map[string]int)
+	var statuses []string
+	var current, total int64
+	for _, id := range order {
+		msg := layers[id]
+		status := msg.Status
+		if status == "Downloading" {
+			current += msg.ProgressDetail.Current
+			total += msg.ProgressDetail.Total
+		}
+		if counts[status] == 0 {
+			statuses = append(statuses, status)
+		}
+		counts[status]++
+	}
+
+	parts := make([]string, 0, len(statuses))
+	for _, status := range statuses {
+		part := fmt.Sprintf("%d %s", counts[status], strings.ToLower(status))
+		if status == "Downloading" && total > 0 {
+			part += fmt.Sprintf(" (%.1f/%.1f MB)", float64(current)/1e6, float64(total)/1e6)
+		}
+		parts = append(parts, part)
+	}
+	return fmt.Sprintf("%d layers: %s", len(order), strings.Join(parts, ", "))
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+)
+
+func TestResolvePlatformReachesPull(t *testing.T) {
+	tests := []struct {
+		name     string
+		labels   map[string]string
+		override string
+		want     string
+	}{
+		{name: "inspected", want: "linux/amd64"},
+		{name: "label", labels: map[string]string{platformLabel: "linux/arm64"}, want: "linux/arm64"},
+		{name: "alias label", labels: map[string]string{platformAliasLabel: "linux/arm/v7"}, want: "linux/arm/v7"},
+		{name: "flag", override: "linux/arm64", want: "linux/arm64"},
+		{name: "label over flag", labels: map[string]string{platformLabel: "linux/arm/v7"}, override: "linux/arm64", want: "linux/arm/v7"},
+		{name: "invalid label", labels: map[string]string{platformLabel: "arm64"}, want: "linux/amd64"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			captureLog(t, levelError)
+			old := *platformOverride
+			*platformOverride = tt.override
+			defer func() { *platformOverride = old }()
+
+			d, cli := newFakeDocker(t)
+			d.addImage(oldImageID, "2024-01-01T00:00:00Z", "nginx:latest")
+			d.publish("nginx:latest", oldImageID)
+			c := testContainer("old", "web", "nginx:latest", oldImageID)
+			for k, v := range tt.labels {
+				c.Config.Labels[k] = v
+			}
+			d.addContainer(c)
+
+			if err := checkContainers(cli, "", "", "", "", NoopNotifier{}); err != nil {
+				t.Fatalf("checkContainers: %v", err)
+			}
+			d.mu.Lock()
+			got, pulled := d.platforms[normalizeRef("nginx:latest")]
+			d.mu.Unlock()
+			if !pulled {
+				t.Fatal("nginx:latest was not pulled")
+			}
+			if got != tt.want {
+				t.Errorf("pulled platform %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPullCacheSharesPullsWithinCycle(t *testing.T) {
+	d, cli := withUpdate(t)
+	d.addContainer(testContainer("api-id", "api", "nginx:latest", oldImageID))
+	d.addContainer(testContainer("admin-id", "admin", "nginx:latest", oldImageID))
+
+	for cycle := 1; cycle <= 2; cycle++ {
+		if err := checkContainers(cli, "", "", "", "", NoopNotifier{}); err != nil {
+			t.Fatalf("cycle %d: checkContainers: %v", cycle, err)
+		}
+		if n := d.count("POST /images/create"); n != cycle {
+			t.Errorf("after cycle %d: %d pulls, want %d", cycle, n, cycle)
+		}
+	}
+	if len(d.created) != 3 {
+		t.Errorf("recreated %d containers, want all 3", len(d.created))
+	}
+}
+
+// withMirrors sets -registry-mirror for the duration of a test.
+func withMirrors(t *testing.T, spec string) {
+	t.Helper()
+	mirrors, err := parseRegistryMirrors(spec)
+	if err != nil {
+		t.Fatalf("parseRegistryMirrors(%q): %v", spec, err)
+	}
+	old := registryMirrors
+	registryMirrors = mirrors
+	t.Cleanup(func() { registryMirrors = old })
+}
+
+// withDockerConfig uses auths as the -docker-config credentials for the
+// duration of a test.
+func withDockerConfig(t *testing.T, auths map[string]dockerConfigAuth) {
+	t.Helper()
+	old := dockerCredentials
+	dockerCredentials = &dockerConfig{Auths: auths, cached: make(map[string]cachedCredentials)}
+	t.Cleanup(func() { dockerCredentials = old })
+}
+
+func TestMirrorReference(t *testing.T) {
+	tests := []struct {
+		spec, image string
+		want        string
+	}{
+		{"mirror.local", "docker.io/library/nginx", "mirror.local/library/nginx"},
+		{"mirror.local", "nginx:1.25", "mirror.local/library/nginx:1.25"},
+		{"https://mirror.local/", "myorg/api:2", "mirror.local/myorg/api:2"},
+		{"mirror.local", "ghcr.io/myorg/api:2", ""},
+		{"ghcr.io=ghcr-cache:5000, index.docker.io=mirror.local", "ghcr.io/myorg/api:2", "ghcr-cache:5000/myorg/api:2"},
+		{"ghcr.io=ghcr-cache:5000, index.docker.io=mirror.local", "redis", "mirror.local/library/redis"},
+	}
+	for _, tt := range tests {
+		withMirrors(t, tt.spec)
+		got, ok := mirrorReference(tt.image)
+		if got != tt.want || ok != (tt.want != "") {
+			t.Errorf("-registry-mirror %q: mirrorReference(%q) = %q, %v, want %q", tt.spec, tt.image, got, ok, tt.want)
+		}
+	}
+
+	if _, err := parseRegistryMirrors("docker.io="); err == nil {
+		t.Error("entry without a mirror accepted")
+	}
+}
+
+// decodeAuth decodes an X-Registry-Auth header.
+func decodeAuth(t *testing.T, header string) types.AuthConfig {
+	t.Helper()
+	var auth types.AuthConfig
+	if header == "" {
+		return auth
+	}
+	data, err := base64.URLEncoding.DecodeString(header)
+	if err != nil {
+		t.Fatalf("decode X-Registry-Auth: %v", err)
+	}
+	if err := json.Unmarshal(data, &auth); err != nil {
+		t.Fatalf("decode X-Registry-Auth: %v", err)
+	}
+	return auth
+}
+
+func TestPullThroughMirror(t *testing.T) {
+	withMirrors(t, "mirror.local")
+	hub := types.AuthConfig{Username: "alice", Password: "hub-secret", ServerAddress: dockerHubServer}
+
+	t.Run("mirror credentials", func(t *testing.T) {
+		withDockerConfig(t, map[string]dockerConfigAuth{"mirror.local": {Username: "cache", Password: "cache-secret"}})
+		d, cli := withUpdate(t)
+		d.publish("mirror.local/library/nginx:latest", newImageID)
+
+		img, err := pullImage(cli, context.Background(), "nginx:latest", hub, "")
+		if err != nil {
+			t.Fatalf("pullImage: %v", err)
+		}
+		if img.ID != newImageID {
+			t.Errorf("pulled %s, want %s", img.ID, newImageID)
+		}
+		header, pulled := d.pullAuth["mirror.local/library/nginx:latest"]
+		if !pulled {
+			t.Fatalf("image was not pulled from the mirror, pulls: %v", d.pullAuth)
+		}
+		if _, ok := d.pullAuth["docker.io/library/nginx:latest"]; ok {
+			t.Error("image was also pulled from docker.io")
+		}
+		if auth := decodeAuth(t, header); auth.Username != "cache" || auth.Password != "cache-secret" {
+			t.Errorf("mirror pull sent credentials %q, want the mirror's", auth.Username)
+		}
+		// The container keeps using the original reference.
+		if id := d.tags["docker.io/library/nginx:latest"]; id != newImageID {
+			t.Errorf("nginx:latest points at %s, want %s", id, newImageID)
+		}
+		if _, ok := d.tags["mirror.local/library/nginx:latest"]; ok {
+			t.Error("the mirror tag was left behind")
+		}
+	})
+
+	t.Run("source credentials stay with the source", func(t *testing.T) {
+		withDockerConfig(t, map[string]dockerConfigAuth{"https://index.docker.io/v1/": {Username: "alice", Password: "hub-secret"}})
+		d, cli := withUpdate(t)
+		d.publish("mirror.local/library/nginx:latest", newImageID)
+
+		if _, err := pullImage(cli, context.Background(), "nginx:latest", hub, ""); err != nil {
+			t.Fatalf("pullImage: %v", err)
+		}
+		if header := d.pullAuth["mirror.local/library/nginx:latest"]; header != "" {
+			t.Errorf("mirror pull sent credentials %q, want none", decodeAuth(t, header).Username)
+		}
+	})
+}
+
+func TestIsRateLimitError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{errRateLimited, true},
+		{fmt.Errorf("pull nginx: %w", errRateLimited), true},
+		{errors.New("toomanyrequests: You have reached your pull rate limit"), true},
+		{errors.New("Error response from daemon: Too Many Requests"), true},
+		{errors.New("manifest for nginx:missing not found"), false},
+		{errors.New("unauthorized: authentication required"), false},
+	}
+	for _, tt := range tests {
+		if got := isRateLimitError(tt.err); got != tt.want {
+			t.Errorf("isRateLimitError(%q) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestParseRateLimitRemaining(t *testing.T) {
+	tests := []struct {
+		header string
+		want   int
+		ok     bool
+	}{
+		{"76;w=21600", 76, true},
+		{"0", 0, true},
+		{" 12 ;w=21600", 12, true},
+		{"", 0, false},
+		{"unlimited", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseRateLimitRemaining(tt.header)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseRateLimitRemaining(%q) = %d, %v, want %d, %v", tt.header, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// captureLog collects log output at level for the duration of a test.
+func captureLog(t *testing.T, level int) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	oldLevel, oldFlags, oldOutput := currentLevel, log.Flags(), log.Writer()
+	currentLevel = level
+	log.SetFlags(0)
+	log.SetOutput(&buf)
+	t.Cleanup(func() {
+		currentLevel = oldLevel
+		log.SetFlags(oldFlags)
+		log.SetOutput(oldOutput)
+	})
+	return &buf
+}
+
+const cannedPull = `{"status":"Pulling from library/nginx","id":"latest"}
+{"status":"Pulling fs layer","progressDetail":{},"id":"a2abf6c4d29d"}
+{"status":"Downloading","progressDetail":{"current":1024,"total":31357311},"id":"a2abf6c4d29d"}
+{"status":"Download complete","progressDetail":{},"id":"a2abf6c4d29d"}
+{"status":"Pull complete","progressDetail":{},"id":"a2abf6c4d29d"}
+{"status":"Digest: sha256:4c0fdaa8b6341bfdeca5f18f7837462c80cff90527ee35ef185571e1c327beac"}
+{"status":"Status: Downloaded newer image for nginx:latest"}
+`
+
+func TestConsumePullProgress(t *testing.T) {
+	t.Run("verbose", func(t *testing.T) {
+		logs := captureLog(t, levelVerbose)
+		if err := consumePullProgress("nginx:latest", strings.NewReader(cannedPull)); err != nil {
+			t.Fatalf("consumePullProgress: %v", err)
+		}
+		for _, want := range []string{
+			"[VERBOSE] Pull nginx:latest: Pulling from library/nginx",
+			"[VERBOSE] Pull nginx:latest: Status: Downloaded newer image for nginx:latest",
+			"[VERBOSE] Pull nginx:latest finished: 1 layers: 1 pull complete",
+		} {
+			if !strings.Contains(logs.String(), want) {
+				t.Errorf("log is missing %q:\n%s", want, logs)
+			}
+		}
+	})
+
+	t.Run("quiet", func(t *testing.T) {
+		logs := captureLog(t, levelInfo)
+		if err := consumePullProgress("nginx:latest", strings.NewReader(cannedPull)); err != nil {
+			t.Fatalf("consumePullProgress: %v", err)
+		}
+		if logs.Len() != 0 {
+			t.Errorf("progress logged below verbose:\n%s", logs)
+		}
+	})
+
+	t.Run("error in stream", func(t *testing.T) {
+		captureLog(t, levelInfo)
+		stream := `{"status":"Pulling from library/nginx","id":"latest"}
+{"errorDetail":{"message":"toomanyrequests: You have reached your pull rate limit."},"error":"toomanyrequests: You have reached your pull rate limit."}
+{"error":"a later error"}
+`
+		err := consumePullProgress("nginx:latest", strings.NewReader(stream))
+		if err == nil || !strings.Contains(err.Error(), "toomanyrequests") {
+			t.Fatalf("consumePullProgress = %v, want the first stream error", err)
+		}
+	})
+}
+
+func TestPullRateLimitedInStream(t *testing.T) {
+	withRateLimitState(t)
+	d, cli := withUpdate(t)
+	d.streams["docker.io/library/nginx:latest"] = `{"status":"Pulling from library/nginx","id":"latest"}
+{"errorDetail":{"message":"toomanyrequests: You have reached your pull rate limit."},"error":"toomanyrequests: You have reached your pull rate limit."}
+`
+	_, err := pullImage(cli, context.Background(), "nginx:latest", types.AuthConfig{}, "")
+	if !errors.Is(err, errRateLimited) {
+		t.Fatalf("pullImage = %v, want errRateLimited", err)
+	}
+	if !rateLimited() {
+		t.Error("pulls are not deferred after an in-stream rate limit")
+	}
+}
+
+func TestPullRefreshesExpiredToken(t *testing.T) {
+	// Every run of the auth command issues a new token; the registry only
+	// accepts the second, as the first expires during the cycle.
+	runs := withAuthCommand(t, "", 0)
+	*authCommand = `echo run >> '` + runs + `'; echo "{\"username\":\"AWS\",\"password\":\"token-$(wc -l < '` + runs + `' | tr -d ' ')\"}"`
+	d, cli := withUpdate(t)
+	d.password = "token-2"
+
+	authConfig := buildAuthConfig("registry.example.com", "", "")
+	if authConfig.Password != "token-1" {
+		t.Fatalf("cycle started with %q, want token-1", authConfig.Password)
+	}
+	img, err := pullImage(cli, context.Background(), "nginx:latest", authConfig, "")
+	if err != nil {
+		t.Fatalf("pullImage: %v", err)
+	}
+	if img.ID != newImageID {
+		t.Errorf("pulled %s, want %s", img.ID, newImageID)
+	}
+	if n := commandRuns(t, runs); n != 2 {
+		t.Errorf("auth command ran %d times, want 2", n)
+	}
+	if got := pullPassword(d.pullAuth["docker.io/library/nginx:latest"]); got != "token-2" {
+		t.Errorf("the retried pull sent %q, want the refreshed token-2", got)
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types"
+)
+
+var manifestMediaTypes = []string{
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.oci.image.index.v1+json",
+}
+
+// registryClient talks to the registry v2 HTTP API directly, which lets us
+// resolve a tag to its manifest digest without pulling any layers. A client
+// lives for one check cycle, so its digest cache never outlives it.
+type registryClient struct {
+	http    *http.Client
+	auth    types.AuthConfig
+	tokens  map[string]string
+	digests map[string]string
+}
+
+// registryTLS is the TLS configuration for direct registry requests, set from
+// -ca-cert and -insecure-registry. Nil means the system defaults.
+var registryTLS *tls.Config
+
+// loadRegistryTLS builds the registry TLS configuration, adding the PEM
+// bundle at caFile to the system roots.
+func loadRegistryTLS(caFile string, insecure bool) (*tls.Config, error) {
+	if caFile == "" && !insecure {
+		return nil, nil
+	}
+	cfg := &tls.Config{InsecureSkipVerify: insecure}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+func newRegistryClient(auth types.AuthConfig) *registryClient {
+	c := &http.Client{Timeout: 30 * time.Second}
+	if registryTLS != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = registryTLS
+		c.Transport = transport
+	}
+	return &registryClient{
+		http:    c,
+		auth:    auth,
+		tokens:  make(map[string]string),
+		digests: make(map[string]string),
+	}
+}
+
+// registryHost maps an image reference domain to the host serving its v2 API.
+func registryHost(domain string) string {
+	if domain == "docker.io" || domain == "index.docker.io" {
+		return "registry-1.docker.io"
+	}
+	return domain
+}
+
+// repositoryLocation returns the host serving named's v2 API and the
+// repository path on it. Images of a registry with a -registry-mirror are
+// looked up on the mirror, where they are also pulled from.
+func repositoryLocation(named reference.Named) (string, string) {
+	if mirrored, ok := mirrorReference(named.String()); ok {
+		if m, err := reference.ParseNormalizedNamed(mirrored); err == nil {
+			named = m
+		}
+	}
+	return registryHost(reference.Domain(named)), reference.Path(named)
+}
+
+// credentialsFor returns the -docker-config credentials for host, or the
+// configured credentials only when they belong to host, so they are never
+// sent to an unrelated registry or token realm.
+func (r *registryClient) credentialsFor(host string) (string, string, bool) {
+	if dockerCredentials != nil {
+		if auth, ok := dockerCredentials.lookup(host); ok && auth.Username != "" && auth.Password != "" {
+			return auth.Username, auth.Password, true
+		}
+	}
+	if r.auth.Username == "" || r.auth.Password == "" {
+		return "", "", false
+	}
+	server := r.auth.ServerAddress
+	if u, err := url.Parse(server); err == nil && u.Host != "" {
+		server = u.Host
+	}
+	server, _, _ = strings.Cut(server, "/")
+	if registryHost(server) == host {
+		return r.auth.Username, r.auth.Password, true
+	}
+	return "", "", false
+}
+
+// manifestDigest returns the Docker-Content-Digest the registry reports for
+// image, using a HEAD request so no manifest body or layers are transferred.
+func (r *registryClient) manifestDigest(ctx context.Context, image string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", fmt.Errorf("parse reference %q: %w", image, err)
+	}
+	named = reference.TagNameOnly(named)
+	tagged, ok := named.(reference.Tagged)
+	if !ok {
+		return "", fmt.Errorf("reference %q has no tag", image)
+	}
+
+	if digest, ok := r.digests[named.String()]; ok {
+		return digest, nil
+	}
+
+	host, repo := repositoryLocation(named)
+	manifestURL := fmt.Sprintf("https://%s/v2/%s/manifests/%s", host, repo, tagged.Tag())
+
+	resp, err := r.do(ctx, http.MethodHead, manifestURL, host, repo)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		until := time.Now().Add(rateLimitBackoff)
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			until = time.Now().Add(time.Duration(secs) * time.Second)
+		}
+		noteRateLimit(until)
+		return "", errRateLimited
+	}
+	if remaining, ok := parseRateLimitRemaining(resp.Header.Get("RateLimit-Remaining")); ok {
+		logVerbose("Registry %s allows %d more pulls in the current window", host, remaining)
+		if remaining == 0 {
+			noteRateLimit(time.Now().Add(rateLimitBackoff))
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("manifest request returned status %d", resp.StatusCode)
+	}
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", fmt.Errorf("registry did not return a Docker-Content-Digest header")
+	}
+	r.digests[named.String()] = digest
+	return digest, nil
+}
+
+// listTags returns all tags of image's repository, following the registry's
+// pagination links.
+func (r *registryClient) listTags(ctx context.Context, image string) ([]string, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return nil, fmt.Errorf("parse reference %q: %w", image, err)
+	}
+	host, repo := repositoryLocation(named)
+
+	var tags []string
+	next := fmt.Sprintf("https://%s/v2/%s/tags/list?n=1000", host, repo)
+	for next != "" {
+		resp, err := r.do(ctx, http.MethodGet, next, host, repo)
+		if err != nil {
+			return nil, err
+		}
+		var body struct {
+			Tags []string `json:"tags"`
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("tag list request returned status %d", resp.StatusCode)
+		} else if decodeErr := json.NewDecoder(resp.Body).Decode(&body); decodeErr != nil {
+			err = fmt.Errorf("decode tag list: %w", decodeErr)
+		}
+		link := resp.Header.Get("Link")
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, body.Tags...)
+
+		next = ""
+		if link != "" {
+			if next, err = nextPageURL(resp.Request.URL, link); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return tags, nil
+}
+
+// nextPageURL resolves the target of a `Link: </v2/...>; rel="next"` header
+// against the URL of the current page.
+func nextPageURL(current *url.URL, link string) (string, error) {
+	target, params, _ := strings.Cut(link, ";")
+	if !strings.Contains(params, `rel="next"`) {
+		return "", nil
+	}
+	target = strings.Trim(strings.TrimSpace(target), "<>")
+	u, err := current.Parse(target)
+	if err != nil {
+		return "", fmt.Errorf("invalid pagination link %q: %w", link, err)
+	}
+	return u.String(), nil
+}
+
+// do performs a registry request, answering a 401 challenge with either
+// basic credentials or a bearer token fetched from the advertised realm.
+func (r *registryClient) do(ctx context.Context, method, target, host, repo string) (*http.Response, error) {
+	send := func(authorization string) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, method, target, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		return r.http.Do(req)
+	}
+
+	resp, err := send(r.tokens[host+"/"+repo])
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+
+	scheme, params := parseChallenge(challenge)
+	var authorization string
+	switch strings.ToLower(scheme) {
+	case "basic":
+		user, pass, ok := r.credentialsFor(host)
+		if !ok {
+			return nil, fmt.Errorf("registry %s requires credentials", host)
+		}
+		authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+	case "bearer":
+		token, err := r.fetchToken(ctx, host, repo, params)
+		if err != nil {
+			return nil, err
+		}
+		authorization = "Bearer " + token
+	default:
+		return nil, fmt.Errorf("unsupported auth challenge %q from %s", challenge, host)
+	}
+
+	r.tokens[host+"/"+repo] = authorization
+	return send(authorization)
+}
+
+// fetchToken obtains a pull token from the realm advertised in a bearer challenge.
+func (r *registryClient) fetchToken(ctx context.Context, host, repo string, params map[string]string) (string, error) {
+	realm := params["realm"]
+	if realm == "" {
+		return "", fmt.Errorf("bearer challenge from %s has no realm", host)
+	}
+	u, err := url.Parse(realm)
+	if err != nil {
+		return "", fmt.Errorf("invalid token realm %q: %w", realm, err)
+	}
+	q := u.Query()
+	if service := params["service"]; service != "" {
+		q.Set("service", service)
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = fmt.Sprintf("repository:%s:pull", repo)
+	}
+	q.Set("scope", scope)
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if user, pass, ok := r.credentialsFor(host); ok {
+		req.SetBasicAuth(user, pass)
+	}
+
+	resp, err := r.http.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("token request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request returned status %d", resp.StatusCode)
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("decode token response: %w", err)
+	}
+	if body.Token != "" {
+		return body.Token, nil
+	}
+	if body.AccessToken != "" {
+		return body.AccessToken, nil
+	}
+	return "", fmt.Errorf("token response from %s contained no token", realm)
+}
+
+// parseChallenge splits a WWW-Authenticate header such as
+// `Bearer realm="https://auth.example.com/token",service="registry"`.
+func parseChallenge(header string) (string, map[string]string) {
+	params := make(map[string]string)
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	for rest != "" {
+		var pair string
+		rest = strings.TrimLeft(rest, " ,")
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		if strings.HasPrefix(value, `"`) {
+			end := strings.Index(value[1:], `"`)
+			if end < 0 {
+				pair, rest = value[1:], ""
+			} else {
+				pair, rest = value[1:end+1], value[end+2:]
+			}
+		} else {
+			pair, rest, _ = strings.Cut(value, ",")
+		}
+		params[strings.ToLower(strings.TrimSpace(key))] = pair
+	}
+	return scheme, params
+}
+
+// digestResolver resolves an image reference to the manifest digest its
+// registry currently serves.
+type digestResolver interface {
+	manifestDigest(ctx context.Context, image string) (string, error)
+}
+
+// checkRegistryDigest is the update detection shared by containers and Swarm
+// services. It resolves image through the registry and reports the digest
+// together with whether it differs from every digest in running.
+func checkRegistryDigest(ctx context.Context, registry digestResolver, image string, running []string) (string, bool, error) {
+	digest, err := registry.manifestDigest(ctx, image)
+	if err != nil {
+		return "", false, err
+	}
+	for _, d := range running {
+		if d == digest {
+			return digest, false, nil
+		}
+	}
+	return digest, true, nil
+}
+
+// repoDigests returns the digests of RepoDigests entries (repo@digest).
+func repoDigests(entries []string) []string {
+	digests := make([]string, 0, len(entries))
+	for _, rd := range entries {
+		if _, digest, ok := strings.Cut(rd, "@"); ok {
+			digests = append(digests, digest)
+		}
+	}
+	return digests
+}
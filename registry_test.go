@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+const testDigest = "sha256:4c0fdaa8b6341bfdeca5f18f7837462c80cff90527ee35ef185571e1c327beac"
+
+// fakeRegistry is a v2 registry serving one repository behind bearer token
+// authentication.
+type fakeRegistry struct {
+	*httptest.Server
+	mu        sync.Mutex
+	repo      string
+	digests   map[string]string // tag -> manifest digest
+	tags      []string
+	user      string
+	pass      string
+	token     string
+	headers   http.Header // extra response headers for manifest requests
+	status    int         // forced manifest status, 0 for normal operation
+	manifests int
+	tokens    int
+	scopes    []string
+}
+
+func newFakeRegistry(t *testing.T, repo string) *fakeRegistry {
+	t.Helper()
+	r := &fakeRegistry{repo: repo, digests: make(map[string]string), token: "secret-token", headers: make(http.Header)}
+	r.Server = httptest.NewTLSServer(http.HandlerFunc(r.serve))
+	t.Cleanup(r.Close)
+	return r
+}
+
+// host returns the host:port images of this registry are prefixed with.
+func (r *fakeRegistry) host() string {
+	return strings.TrimPrefix(r.URL, "https://")
+}
+
+// client returns a registry client trusting the server's certificate.
+func (r *fakeRegistry) client(auth types.AuthConfig) *registryClient {
+	c := newRegistryClient(auth)
+	c.http = r.Client()
+	return c
+}
+
+// trust makes registry clients created by the code under test trust the
+// server's certificate for the duration of a test.
+func (r *fakeRegistry) trust(t *testing.T) {
+	t.Helper()
+	old := registryTLS
+	registryTLS = r.Client().Transport.(*http.Transport).TLSClientConfig
+	t.Cleanup(func() { registryTLS = old })
+}
+
+func (r *fakeRegistry) serve(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if req.URL.Path == "/token" {
+		r.tokens++
+		r.scopes = append(r.scopes, req.URL.Query().Get("scope"))
+		if r.user != "" {
+			if user, pass, ok := req.BasicAuth(); !ok || user != r.user || pass != r.pass {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"token":"` + r.token + `"}`))
+		return
+	}
+
+	if req.Header.Get("Authorization") != "Bearer "+r.token {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="`+r.URL+`/token",service="fake-registry"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	prefix := "/v2/" + r.repo + "/"
+	if !strings.HasPrefix(req.URL.Path, prefix) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch rest := strings.TrimPrefix(req.URL.Path, prefix); {
+	case strings.HasPrefix(rest, "manifests/"):
+		r.manifests++
+		if !strings.Contains(req.Header.Get("Accept"), "application/vnd.docker.distribution.manifest.v2+json") {
+			w.WriteHeader(http.StatusNotAcceptable)
+			return
+		}
+		for k, v := range r.headers {
+			w.Header()[k] = v
+		}
+		if r.status != 0 {
+			w.WriteHeader(r.status)
+			return
+		}
+		digest, ok := r.digests[strings.TrimPrefix(rest, "manifests/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.WriteHeader(http.StatusOK)
+	case rest == "tags/list":
+		w.Header().Set("Content-Type", "application/json")
+		quoted := make([]string, len(r.tags))
+		for i, tag := range r.tags {
+			quoted[i] = `"` + tag + `"`
+		}
+		_, _ = w.Write([]byte(`{"name":"` + r.repo + `","tags":[` + strings.Join(quoted, ",") + `]}`))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestManifestDigestTokenExchange(t *testing.T) {
+	reg := newFakeRegistry(t, "team/app")
+	reg.user, reg.pass = "alice", "s3cret"
+	reg.digests["1.0"] = testDigest
+
+	client := reg.client(types.AuthConfig{Username: "alice", Password: "s3cret", ServerAddress: reg.host()})
+	digest, err := client.manifestDigest(context.Background(), reg.host()+"/team/app:1.0")
+	if err != nil {
+		t.Fatalf("manifestDigest: %v", err)
+	}
+	if digest != testDigest {
+		t.Errorf("digest = %s, want %s", digest, testDigest)
+	}
+	if reg.tokens != 1 {
+		t.Errorf("token requests = %d, want 1", reg.tokens)
+	}
+	if want := "repository:team/app:pull"; len(reg.scopes) != 1 || reg.scopes[0] != want {
+		t.Errorf("token scopes = %v, want [%s]", reg.scopes, want)
+	}
+
+	// The digest is cached for the rest of the cycle.
+	if _, err := client.manifestDigest(context.Background(), reg.host()+"/team/app:1.0"); err != nil {
+		t.Fatalf("second manifestDigest: %v", err)
+	}
+	if reg.manifests != 1 {
+		t.Errorf("authorized manifest requests = %d, want 1", reg.manifests)
+	}
+}
+
+func TestManifestDigestCredentialsStayWithTheirRegistry(t *testing.T) {
+	reg := newFakeRegistry(t, "team/app")
+	reg.user, reg.pass = "alice", "s3cret"
+	reg.digests["latest"] = testDigest
+
+	// Credentials for another registry must not be sent to the token realm.
+	client := reg.client(types.AuthConfig{Username: "alice", Password: "s3cret", ServerAddress: "https://index.docker.io/v1/"})
+	if _, err := client.manifestDigest(context.Background(), reg.host()+"/team/app"); err == nil {
+		t.Fatal("manifestDigest succeeded without matching credentials")
+	}
+}
+
+func TestManifestDigestUnknownTag(t *testing.T) {
+	reg := newFakeRegistry(t, "team/app")
+	client := reg.client(types.AuthConfig{})
+	if _, err := client.manifestDigest(context.Background(), reg.host()+"/team/app:missing"); err == nil {
+		t.Fatal("manifestDigest succeeded for an unknown tag")
+	}
+}
+
+func TestCheckRegistryDigest(t *testing.T) {
+	reg := newFakeRegistry(t, "team/app")
+	reg.digests["latest"] = testDigest
+	client := reg.client(types.AuthConfig{})
+	image := reg.host() + "/team/app:latest"
+
+	running := repoDigests([]string{"other.example.com/team/app@sha256:0000", reg.host() + "/team/app@" + testDigest})
+	digest, changed, err := checkRegistryDigest(context.Background(), client, image, running)
+	if err != nil || changed || digest != testDigest {
+		t.Errorf("running digest: got (%s, %v, %v), want (%s, false, nil)", digest, changed, err, testDigest)
+	}
+
+	digest, changed, err = checkRegistryDigest(context.Background(), client, image, []string{"sha256:0000"})
+	if err != nil || !changed || digest != testDigest {
+		t.Errorf("other digest: got (%s, %v, %v), want (%s, true, nil)", digest, changed, err, testDigest)
+	}
+
+	if _, _, err := checkRegistryDigest(context.Background(), client, reg.host()+"/team/app:missing", nil); err == nil {
+		t.Error("missing tag did not fail")
+	}
+}
+
+func TestManifestDigestThroughMirror(t *testing.T) {
+	reg := newFakeRegistry(t, "library/nginx")
+	reg.user, reg.pass = "cache", "cache-secret"
+	reg.digests["latest"] = testDigest
+	withMirrors(t, reg.host())
+	withDockerConfig(t, map[string]dockerConfigAuth{reg.host(): {Username: "cache", Password: "cache-secret"}})
+
+	// Docker Hub credentials are configured but the mirror gets its own.
+	client := reg.client(types.AuthConfig{Username: "alice", Password: "hub-secret", ServerAddress: dockerHubServer})
+	digest, err := client.manifestDigest(context.Background(), "docker.io/library/nginx")
+	if err != nil {
+		t.Fatalf("manifestDigest: %v", err)
+	}
+	if digest != testDigest {
+		t.Errorf("digest = %s, want %s", digest, testDigest)
+	}
+	if reg.manifests != 1 {
+		t.Errorf("mirror received %d manifest requests, want 1", reg.manifests)
+	}
+}
+
+// withRateLimitState resets the registry rate limit for the duration of a
+// test.
+func withRateLimitState(t *testing.T) {
+	t.Helper()
+	oldUntil, oldAnnounced := rateLimitedUntil, rateLimitAnnounced
+	rateLimitedUntil, rateLimitAnnounced = time.Time{}, false
+	t.Cleanup(func() { rateLimitedUntil, rateLimitAnnounced = oldUntil, oldAnnounced })
+}
+
+func TestManifestDigestRateLimits(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		headers   map[string]string
+		wantErr   bool
+		wantDefer time.Duration // 0 when pulls must not be deferred
+	}{
+		{"429 with Retry-After", http.StatusTooManyRequests, map[string]string{"Retry-After": "120"}, true, 2 * time.Minute},
+		{"429 without Retry-After", http.StatusTooManyRequests, nil, true, rateLimitBackoff},
+		{"last pull of the window", 0, map[string]string{"RateLimit-Remaining": "0;w=21600"}, false, rateLimitBackoff},
+		{"pulls remaining", 0, map[string]string{"RateLimit-Remaining": "76;w=21600"}, false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withRateLimitState(t)
+			reg := newFakeRegistry(t, "library/nginx")
+			reg.digests["latest"] = testDigest
+			reg.status = tt.status
+			for k, v := range tt.headers {
+				reg.headers.Set(k, v)
+			}
+
+			start := time.Now()
+			_, err := reg.client(types.AuthConfig{}).manifestDigest(context.Background(), reg.host()+"/library/nginx")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("manifestDigest error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, errRateLimited) {
+				t.Errorf("error %v is not errRateLimited", err)
+			}
+			if tt.wantDefer == 0 {
+				if rateLimited() {
+					t.Errorf("pulls deferred until %s", rateLimitedUntil)
+				}
+				return
+			}
+			if !rateLimited() {
+				t.Fatal("pulls are not deferred")
+			}
+			if got := rateLimitedUntil.Sub(start); got < tt.wantDefer-time.Minute || got > tt.wantDefer+time.Minute {
+				t.Errorf("pulls deferred for %s, want about %s", got.Round(time.Second), tt.wantDefer)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Actions recorded for a container in the -report-file output.
+const (
+	actionUpdated = "updated"
+	actionSkipped = "skipped"
+	actionError   = "error"
+)
+
+// containerResult is the outcome of one container in a check cycle. Its JSON
+// form is the -report-file contract and must stay backwards compatible.
+type containerResult struct {
+	Name       string `json:"name"`
+	Image      string `json:"image"`
+	OldImageID string `json:"oldImageId"`
+	NewImageID string `json:"newImageId,omitempty"`
+	Action     string `json:"action"`
+	Error      string `json:"error,omitempty"`
+}
+
+// cycleReport collects the per-container results of a check cycle. It is
+// safe for concurrent use, and a nil report discards everything.
+type cycleReport struct {
+	mu      sync.Mutex
+	results []containerResult
+}
+
+// newCycleReport returns a report when -report-file or -summary-json is set,
+// nil otherwise.
+func newCycleReport() *cycleReport {
+	if *reportFile == "" && *summaryJSON == "" {
+		return nil
+	}
+	return &cycleReport{results: []containerResult{}}
+}
+
+func (r *cycleReport) add(res containerResult) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.results = append(r.results, res)
+}
+
+// write stores the report in -report-file. By default the file is replaced
+// atomically with a JSON array; with -report-append one JSON object with a
+// timestamp is appended per cycle instead.
+func (r *cycleReport) write() error {
+	if r == nil || *reportFile == "" {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !*reportAppend {
+		data, err := json.MarshalIndent(r.results, "", "  ")
+		if err != nil {
+			return err
+		}
+		return writeFileAtomic(*reportFile, append(data, '\n'))
+	}
+
+	data, err := json.Marshal(struct {
+		Time       time.Time         `json:"time"`
+		Containers []containerResult `json:"containers"`
+	}{time.Now(), r.results})
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(*reportFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("append to %s: %w", *reportFile, err)
+	}
+	return f.Close()
+}
+
+// cycleSummary is the line written to -summary-json after each cycle.
+type cycleSummary struct {
+	Timestamp  time.Time         `json:"timestamp"`
+	Eligible   int               `json:"eligible"`
+	Checked    int               `json:"checked"`
+	Updated    int               `json:"updated"`
+	Skipped    int               `json:"skipped"`
+	Errors     int               `json:"errors"`
+	Duration   float64           `json:"durationSeconds"`
+	Containers []containerResult `json:"containers"`
+}
+
+// writeSummary appends the cycle summary as one JSON line to -summary-json,
+// or prints it to stdout when the flag is "-".
+func (r *cycleReport) writeSummary(eligible, checked, updated, skipped, failed int, duration time.Duration) error {
+	if r == nil || *summaryJSON == "" {
+		return nil
+	}
+	r.mu.Lock()
+	data, err := json.Marshal(cycleSummary{
+		Timestamp:  time.Now(),
+		Eligible:   eligible,
+		Checked:    checked,
+		Updated:    updated,
+		Skipped:    skipped,
+		Errors:     failed,
+		Duration:   duration.Seconds(),
+		Containers: r.results,
+	})
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if *summaryJSON == "-" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	f, err := os.OpenFile(*summaryJSON, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("append to %s: %w", *summaryJSON, err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSummaryJSONMatchesCycle(t *testing.T) {
+	d, cli := withUpdate(t)
+	d.addImage("sha256:redis", "2024-01-01T00:00:00Z", "redis:7")
+	d.publish("redis:latest", "sha256:redis")
+	d.addContainer(testContainer("cache-id", "cache", "redis:7", "sha256:redis"))
+	d.addImage("sha256:broken", "2024-01-01T00:00:00Z", "myorg/broken:1")
+	d.addContainer(testContainer("broken-id", "broken", "myorg/broken:1", "sha256:broken"))
+	d.fail("POST /containers/create", http.StatusInternalServerError)
+	d.addImage("sha256:api", "2024-01-01T00:00:00Z", "myorg/api:1")
+	d.addContainer(testContainer("api-id", "api", "myorg/api:1", "sha256:api"))
+	d.publish("myorg/api:latest", "sha256:api")
+
+	started := time.Now()
+	summary := readSummary(t, cli)
+	elapsed := time.Since(started)
+
+	// web fails to recreate, broken fails to pull, cache and api are up to
+	// date.
+	if summary.Eligible != 4 || summary.Checked != 4 || summary.Updated != 0 || summary.Skipped != 2 || summary.Errors != 2 {
+		t.Errorf("eligible/checked/updated/skipped/errors = %d/%d/%d/%d/%d, want 4/4/0/2/2",
+			summary.Eligible, summary.Checked, summary.Updated, summary.Skipped, summary.Errors)
+	}
+	if summary.Duration <= 0 || summary.Duration > elapsed.Seconds() {
+		t.Errorf("durationSeconds = %v, want the cycle's duration of at most %v", summary.Duration, elapsed.Seconds())
+	}
+	if summary.Timestamp.Before(started) {
+		t.Errorf("timestamp %s is before the cycle started", summary.Timestamp)
+	}
+	actions := make(map[string]string)
+	for _, c := range summary.Containers {
+		actions[c.Name] = c.Action
+	}
+	want := map[string]string{"web": actionError, "broken": actionError, "cache": actionSkipped, "api": actionSkipped}
+	for name, action := range want {
+		if actions[name] != action {
+			t.Errorf("%s: action %q, want %q", name, actions[name], action)
+		}
+	}
+}
+
+func TestSummaryJSONCountsUpdates(t *testing.T) {
+	d, cli := withUpdate(t)
+	d.addContainer(testContainer("api-id", "api", "nginx:latest", oldImageID))
+
+	summary := readSummary(t, cli)
+	if summary.Checked != 2 || summary.Updated != 2 || summary.Errors != 0 {
+		t.Errorf("checked/updated/errors = %d/%d/%d, want 2/2/0", summary.Checked, summary.Updated, summary.Errors)
+	}
+	for _, c := range summary.Containers {
+		if c.Action != actionUpdated || c.NewImageID != newImageID {
+			t.Errorf("%s: %s to %s, want updated to %s", c.Name, c.Action, c.NewImageID, newImageID)
+		}
+	}
+}
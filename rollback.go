@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/docker/docker/client"
+)
+
+// healthCheckError is returned by recreateContainer when the new container
+// does not become healthy. It identifies the failed container and the image
+// it replaced, so the update can be rolled back.
+type healthCheckError struct {
+	containerID     string
+	previousImage   string
+	previousImageID string
+	err             error
+}
+
+func (e *healthCheckError) Error() string { return "health check failed: " + e.err.Error() }
+func (e *healthCheckError) Unwrap() error { return e.err }
+
+// badImageLimit bounds the bad images remembered per container. A failed
+// update marks at most its new image and every rollback target, so all images
+// of the most recent failure are kept while older ones, which registries have
+// usually moved past, are forgotten.
+func badImageLimit() int {
+	return *rollbackHistory + 1
+}
+
+// rollbackTargets returns the images to try when rolling back name, starting
+// with the image it ran right before the failed update and skipping images
+// known to be bad.
+func rollbackTargets(name, previousImageID string, limit int) []string {
+	var targets []string
+	seen := make(map[string]bool)
+	for _, id := range append([]string{previousImageID}, state.history(name)...) {
+		if id == "" || seen[id] || state.isBad(name, id) {
+			continue
+		}
+		seen[id] = true
+		if targets = append(targets, id); len(targets) == limit {
+			break
+		}
+	}
+	return targets
+}
+
+// rollbackUpdate marks the image of a failed update as bad and recreates the
+// container from the first earlier image that becomes healthy again.
+func rollbackUpdate(cli *client.Client, ctx context.Context, p pendingUpdate, failed *healthCheckError, notifier Notifier) {
+	state.markBad(p.name, p.result.NewImageID, badImageLimit())
+
+	containerID := failed.containerID
+	for _, imageID := range rollbackTargets(p.name, failed.previousImageID, *rollbackHistory) {
+		logUpdate("Rolling back %s to %s", p.name, imageID)
+		// The container is recreated from its image reference, which must
+		// resolve to the rollback target again.
+		callCtx, cancel := withAPITimeout(ctx)
+		err := cli.ImageTag(callCtx, imageID, failed.previousImage)
+		cancel()
+		if err != nil {
+			logError("Failed to tag %s as %s for rollback of %s: %v", imageID, failed.previousImage, p.name, err)
+			continue
+		}
+		err = recreateContainer(cli, ctx, containerID, p.name, failed.previousImage)
+		if err == nil {
+			msg := fmt.Sprintf("Rolled back %s to %s after a failed health check", p.name, imageID)
+			logUpdate(msg)
+			notifyEvent(ctx, notifier, Event{Type: eventRollback, Container: p.name, OldImage: p.result.NewImageID, NewImage: imageID, Message: msg})
+			return
+		}
+		logError("Rollback of %s to %s failed: %v", p.name, imageID, err)
+		var healthErr *healthCheckError
+		if errors.As(err, &healthErr) {
+			state.markBad(p.name, imageID, badImageLimit())
+			containerID = healthErr.containerID
+		} else {
+			// The container may be gone, so further attempts are unsafe.
+			break
+		}
+	}
+	msg := fmt.Sprintf("Could not roll back %s to a healthy image", p.name)
+	logError(msg)
+	notifyEvent(ctx, notifier, p.event(eventError, msg))
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+// withRollback enables -rollback with an in-memory state store for the
+// duration of a test.
+func withRollback(t *testing.T, history int) {
+	t.Helper()
+	oldRollback, oldTimeout, oldHistory, oldState := *rollback, *healthTimeout, *rollbackHistory, state
+	*rollback, *healthTimeout, *rollbackHistory = true, 5*time.Second, history
+	state = &stateStore{Containers: make(map[string]containerState)}
+	t.Cleanup(func() {
+		*rollback, *healthTimeout, *rollbackHistory, state = oldRollback, oldTimeout, oldHistory, oldState
+	})
+}
+
+func TestRollbackAfterFailedHealthCheck(t *testing.T) {
+	withRollback(t, 1)
+	d, cli := withUpdate(t)
+	d.container("web").Config.Healthcheck = &container.HealthConfig{Test: []string{"CMD", "true"}}
+	d.unhealthy[newImageID] = true
+
+	rec := &recordingNotifier{}
+	if err := checkContainers(cli, "", "", "", "", rec); err != nil {
+		t.Fatalf("checkContainers: %v", err)
+	}
+	web := d.container("web")
+	if web == nil || web.Image != oldImageID || !web.State.Running {
+		t.Fatalf("web was not rolled back to %s: %+v", oldImageID, web)
+	}
+	if !state.isBad("web", newImageID) {
+		t.Error("the failing image was not recorded as bad")
+	}
+	var rolledBack bool
+	for _, event := range rec.events {
+		rolledBack = rolledBack || event.Type == eventRollback
+	}
+	if !rolledBack {
+		t.Errorf("no rollback notification in %+v", rec.events)
+	}
+
+	// The registry still serves the bad image, which is not adopted again.
+	rolledBackID := web.ID
+	if err := checkContainers(cli, "", "", "", "", NoopNotifier{}); err != nil {
+		t.Fatalf("second checkContainers: %v", err)
+	}
+	if web := d.container("web"); web.ID != rolledBackID || web.Image != oldImageID {
+		t.Errorf("bad image was adopted again: %+v", web)
+	}
+}
+
+func TestRollbackTargetsSkipBadImages(t *testing.T) {
+	withRollback(t, 3)
+	state.pushHistory("web", "sha256:b", 3)
+	state.pushHistory("web", "sha256:a", 3)
+	state.markBad("web", "sha256:a", badImageLimit())
+
+	got := rollbackTargets("web", "sha256:a", *rollbackHistory)
+	if want := []string{"sha256:b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("rollbackTargets = %v, want %v", got, want)
+	}
+}
+
+func TestBadImagesAreBounded(t *testing.T) {
+	s := &stateStore{Containers: make(map[string]containerState)}
+	for _, id := range []string{"sha256:1", "sha256:2", "sha256:1", "sha256:3", "sha256:4"} {
+		s.markBad("web", id, 3)
+	}
+	if got, want := s.Containers["web"].BadImages, []string{"sha256:2", "sha256:3", "sha256:4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("bad images = %v, want %v", got, want)
+	}
+	if s.isBad("web", "sha256:1") {
+		t.Error("the oldest bad image was not forgotten")
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+// patternLabel makes a container follow the highest tag matching a version
+// pattern or constraint (e.g. 1.2.* or ~1.2) instead of a floating tag.
+const patternLabel = "puller.update.pattern"
+
+// semverLabel is another name for patternLabel, which wins when both are set.
+const semverLabel = "puller.update.semver"
+
+// versionPattern returns the version pattern a container follows, or "".
+func versionPattern(labels map[string]string) string {
+	if pattern := labels[patternLabel]; pattern != "" {
+		return pattern
+	}
+	return labels[semverLabel]
+}
+
+// newestMatchingTag returns the tag with the highest semantic version that
+// satisfies constraint. Tags that are not versions are ignored.
+func newestMatchingTag(tags []string, constraint *semver.Constraints) (string, *semver.Version) {
+	var best string
+	var bestVersion *semver.Version
+	for _, tag := range tags {
+		v, err := semver.NewVersion(tag)
+		if err != nil || !constraint.Check(v) {
+			continue
+		}
+		if bestVersion == nil || v.GreaterThan(bestVersion) {
+			best, bestVersion = tag, v
+		}
+	}
+	return best, bestVersion
+}
+
+// checkPatternUpdate looks up the newest tag of image matching pattern and
+// pulls it when it is a higher version than the running tag. It returns the
+// reference and ID of the pulled image, or "" when the container is up to
+// date.
+func checkPatternUpdate(cli *client.Client, ctx context.Context, registry *registryClient, image, pattern, platform, currentImgID string, authConfig types.AuthConfig, cache *pullCache) (string, string, error) {
+	constraint, err := semver.NewConstraint(pattern)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid version pattern %q: %w", pattern, err)
+	}
+	tags, err := registry.listTags(ctx, image)
+	if err != nil {
+		return "", "", fmt.Errorf("list tags: %w", err)
+	}
+	newest, newestVersion := newestMatchingTag(tags, constraint)
+	if newest == "" {
+		logVerbose("No tag of %s matches %s", image, pattern)
+		return "", "", nil
+	}
+	if running, err := semver.NewVersion(imageTag(image)); err == nil && !newestVersion.GreaterThan(running) {
+		logVerbose("%s is the newest version matching %s", image, pattern)
+		return "", "", nil
+	}
+
+	ref, err := replaceTag(image, newest)
+	if err != nil {
+		return "", "", err
+	}
+	pulled, err := cache.pull(ref, platform, func() (types.ImageInspect, error) {
+		return pullImage(cli, ctx, ref, authConfig, platform)
+	}, func(src string) error {
+		return cli.ImageTag(ctx, src, ref)
+	})
+	if err != nil {
+		return "", "", err
+	}
+	if pulled.ID == currentImgID {
+		return "", "", nil
+	}
+	logVerbose("Found newer version %s for %s (pattern %s)", newest, image, pattern)
+	return ref, pulled.ID, nil
+}
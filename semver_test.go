@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/docker/docker/api/types"
+)
+
+func TestNewestMatchingTag(t *testing.T) {
+	tags := []string{"latest", "alpine", "1.2.0", "1.2.3", "1.2.10", "1.3.0-rc.1", "1.3.0", "2.0.0", "v1.4.1", "1.2.11-alpine", "stable-1.2"}
+	tests := []struct {
+		pattern string
+		want    string
+	}{
+		{pattern: "1.2.*", want: "1.2.10"},
+		{pattern: "~1.2", want: "1.2.10"},
+		{pattern: "^1", want: "v1.4.1"},
+		{pattern: ">=1.3, <2", want: "v1.4.1"},
+		{pattern: "1.3.0", want: "1.3.0"},
+		{pattern: "*", want: "2.0.0"},
+		{pattern: "3.x", want: ""},
+	}
+	for _, tt := range tests {
+		constraint, err := semver.NewConstraint(tt.pattern)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.pattern, err)
+		}
+		got, _ := newestMatchingTag(tags, constraint)
+		if got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.pattern, got, tt.want)
+		}
+	}
+
+	// Pre-releases and suffixed tags only match a constraint asking for them.
+	constraint, _ := semver.NewConstraint("~1.3")
+	if got, _ := newestMatchingTag([]string{"1.3.0", "1.3.1-rc.1", "1.3.2-alpine"}, constraint); got != "1.3.0" {
+		t.Errorf("~1.3: got %q, want the release 1.3.0", got)
+	}
+	constraint, _ = semver.NewConstraint(">=1.3.1-0")
+	if got, _ := newestMatchingTag([]string{"1.3.0", "1.3.1-rc.1"}, constraint); got != "1.3.1-rc.1" {
+		t.Errorf(">=1.3.1-0: got %q, want the pre-release 1.3.1-rc.1", got)
+	}
+}
+
+func TestListTags(t *testing.T) {
+	reg := newFakeRegistry(t, "team/app")
+	reg.tags = []string{"1.2.0", "1.2.3", "latest"}
+
+	tags, err := reg.client(types.AuthConfig{}).listTags(context.Background(), reg.host()+"/team/app:1.2.0")
+	if err != nil {
+		t.Fatalf("listTags: %v", err)
+	}
+	if !reflect.DeepEqual(tags, reg.tags) {
+		t.Errorf("got %v, want %v", tags, reg.tags)
+	}
+	if _, err := reg.client(types.AuthConfig{}).listTags(context.Background(), reg.host()+"/team/other:1"); err == nil {
+		t.Error("unknown repository: no error")
+	}
+}
+
+func TestCheckPatternUpdate(t *testing.T) {
+	reg := newFakeRegistry(t, "team/app")
+	reg.tags = []string{"1.2.0", "1.2.3", "1.2.4-rc.1", "1.3.0", "latest"}
+	image := reg.host() + "/team/app:1.2.0"
+
+	tests := []struct {
+		name    string
+		image   string
+		pattern string
+		want    string
+		wantErr bool
+	}{
+		{name: "newer patch", image: image, pattern: "1.2.*", want: reg.host() + "/team/app:1.2.3"},
+		{name: "newer minor", image: image, pattern: "^1", want: reg.host() + "/team/app:1.3.0"},
+		{name: "already newest", image: reg.host() + "/team/app:1.3.0", pattern: "^1"},
+		{name: "no match", image: image, pattern: "2.x"},
+		{name: "invalid pattern", image: image, pattern: "not a version", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, cli := newFakeDocker(t)
+			d.addImage(oldImageID, "2024-01-01T00:00:00Z", tt.image)
+			d.addImage(newImageID, "2024-02-01T00:00:00Z")
+			d.publish(reg.host()+"/team/app:1.2.3", newImageID)
+			d.publish(reg.host()+"/team/app:1.3.0", newImageID)
+
+			ref, id, err := checkPatternUpdate(cli, context.Background(), reg.client(types.AuthConfig{}), tt.image, tt.pattern, "", oldImageID, types.AuthConfig{}, newPullCache())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if ref != tt.want {
+				t.Errorf("got %q, want %q", ref, tt.want)
+			}
+			if tt.want != "" && id != newImageID {
+				t.Errorf("pulled %s, want %s", id, newImageID)
+			}
+			if tt.want == "" && d.count("POST /images/create") != 0 {
+				t.Error("pulled although the container is up to date")
+			}
+		})
+	}
+}
+
+func TestCheckRecreatesOnNewestMatchingTag(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   string
+	}{
+		{name: "pattern label", labels: map[string]string{patternLabel: "~1.2"}, want: "1.2.3"},
+		{name: "semver label", labels: map[string]string{semverLabel: "^1"}, want: "1.3.0"},
+		{name: "pattern label wins", labels: map[string]string{patternLabel: "~1.2", semverLabel: "^1"}, want: "1.2.3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := newFakeRegistry(t, "team/app")
+			reg.tags = []string{"1.2.0", "1.2.3", "1.3.0", "2.0.0", "latest"}
+			reg.trust(t)
+			image := reg.host() + "/team/app:1.2.0"
+
+			d, cli := newFakeDocker(t)
+			d.addImage(oldImageID, "2024-01-01T00:00:00Z", image)
+			d.addImage(newImageID, "2024-02-01T00:00:00Z")
+			d.publish(reg.host()+"/team/app:"+tt.want, newImageID)
+			c := testContainer("old", "app", image, oldImageID)
+			c.Config.Labels = tt.labels
+			d.addContainer(c)
+
+			if err := checkContainers(cli, "", "", "", "", NoopNotifier{}); err != nil {
+				t.Fatalf("checkContainers: %v", err)
+			}
+			recreated := d.container("app")
+			if recreated == nil || recreated.ID == "old" {
+				t.Fatal("app was not recreated")
+			}
+			if want := reg.host() + "/team/app:" + tt.want; recreated.Config.Image != want || recreated.Image != newImageID {
+				t.Errorf("recreated on %s (%s), want %s (%s)", recreated.Config.Image, recreated.Image, want, newImageID)
+			}
+		})
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+const maxRecentUpdates = 20
+
+// containerUpdate records a container recreated with a new image.
+type containerUpdate struct {
+	Name string    `json:"name"`
+	Time time.Time `json:"time"`
+}
+
+// statusTracker holds the state of the most recent check cycle for the
+// /status endpoint. It is safe for concurrent use.
+type statusTracker struct {
+	mu        sync.Mutex
+	lastCheck time.Time
+	nextCheck time.Time
+	eligible  int
+	updated   int
+	updates   []containerUpdate
+	failures  int
+	lastError string
+	// lastPing and lastSuccess are the times of the last successful Docker
+	// ping and the last cycle that finished without error, for /healthz.
+	lastPing    time.Time
+	lastSuccess time.Time
+	// interval or cron describe the configured schedule; cycleStart and
+	// duration time the running and the last finished cycle.
+	interval   time.Duration
+	cron       string
+	cycleStart time.Time
+	duration   time.Duration
+}
+
+var status = &statusTracker{}
+
+// recordContainers stores the results of a cycle that got as far as
+// evaluating containers.
+func (s *statusTracker) recordContainers(eligible int, updated []string, failures int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.eligible = eligible
+	s.updated = len(updated)
+	s.failures = failures
+	now := time.Now()
+	for _, name := range updated {
+		s.updates = append([]containerUpdate{{Name: name, Time: now}}, s.updates...)
+	}
+	if len(s.updates) > maxRecentUpdates {
+		s.updates = s.updates[:maxRecentUpdates]
+	}
+}
+
+// failed reports whether the last cycle returned an error or failed to
+// check or update any container.
+func (s *statusTracker) failed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastError != "" || s.failures > 0
+}
+
+// finishCycle marks the end of a check cycle and its outcome.
+func (s *statusTracker) finishCycle(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastCheck = time.Now()
+	if !s.cycleStart.IsZero() {
+		s.duration = s.lastCheck.Sub(s.cycleStart)
+	}
+	s.lastError = ""
+	if err != nil {
+		s.lastError = err.Error()
+	} else {
+		s.lastSuccess = s.lastCheck
+	}
+}
+
+// recordPing notes a successful Docker ping.
+func (s *statusTracker) recordPing() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastPing = time.Now()
+}
+
+// setSchedule records the configured interval or cron expression.
+func (s *statusTracker) setSchedule(interval time.Duration, cron string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.interval, s.cron = interval, cron
+}
+
+// startCycle marks the start of a check cycle, which is no longer pending.
+func (s *statusTracker) startCycle() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cycleStart = time.Now()
+	s.nextCheck = time.Time{}
+}
+
+func (s *statusTracker) setNextCheck(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextCheck = t
+}
+
+type statusResponse struct {
+	Interval           string            `json:"interval,omitempty"`
+	Cron               string            `json:"cron,omitempty"`
+	LastCheck          *time.Time        `json:"lastCheck"`
+	LastCheckDuration  float64           `json:"lastCheckDurationSeconds"`
+	NextCheck          *time.Time        `json:"nextCheck"`
+	EligibleContainers int               `json:"eligibleContainers"`
+	UpdatedContainers  int               `json:"updatedContainers"`
+	FailedContainers   int               `json:"failedContainers"`
+	RecentUpdates      []containerUpdate `json:"recentUpdates"`
+	LastError          string            `json:"lastError,omitempty"`
+}
+
+func (s *statusTracker) snapshot() statusResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resp := statusResponse{
+		Cron:               s.cron,
+		LastCheckDuration:  s.duration.Seconds(),
+		EligibleContainers: s.eligible,
+		UpdatedContainers:  s.updated,
+		FailedContainers:   s.failures,
+		RecentUpdates:      append([]containerUpdate{}, s.updates...),
+		LastError:          s.lastError,
+	}
+	if s.cron == "" && s.interval > 0 {
+		resp.Interval = s.interval.String()
+	}
+	if !s.lastCheck.IsZero() {
+		t := s.lastCheck
+		resp.LastCheck = &t
+	}
+	if !s.nextCheck.IsZero() {
+		t := s.nextCheck
+		resp.NextCheck = &t
+	}
+	return resp
+}
+
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status.snapshot()); err != nil {
+		logWarn("Failed to write status response: %v", err)
+	}
+}
+
+// readyTimeout bounds the daemon ping made for each /readyz request.
+const readyTimeout = 5 * time.Second
+
+// daemonPinger is the part of the Docker client used by /readyz.
+type daemonPinger interface {
+	Ping(ctx context.Context) (types.Ping, error)
+}
+
+type healthResponse struct {
+	Status              string     `json:"status"`
+	LastPing            *time.Time `json:"lastPing"`
+	LastSuccessfulCycle *time.Time `json:"lastSuccessfulCycle"`
+}
+
+// handleHealthz is the liveness probe; it answers as long as the process is
+// serving requests, reporting when Docker last answered a ping and when the
+// last cycle succeeded.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	resp := healthResponse{Status: "ok"}
+	status.mu.Lock()
+	if !status.lastPing.IsZero() {
+		t := status.lastPing
+		resp.LastPing = &t
+	}
+	if !status.lastSuccess.IsZero() {
+		t := status.lastSuccess
+		resp.LastSuccessfulCycle = &t
+	}
+	status.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logWarn("Failed to write health response: %v", err)
+	}
+}
+
+// readyzHandler is the readiness probe; it reports ready only while the
+// Docker daemon answers a ping.
+func readyzHandler(cli daemonPinger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+		defer cancel()
+		if _, err := cli.Ping(ctx); err != nil {
+			http.Error(w, "docker daemon unreachable: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		status.recordPing()
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok\n"))
+	}
+}
+
+// startHTTPServer binds addr and serves the operational endpoints in the
+// background. Binding errors are returned so misconfiguration fails fast.
+func startHTTPServer(addr string, cli daemonPinger) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", handleStatus)
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/history", handleHistory)
+	if *serveWebhook {
+		mux.HandleFunc("/webhook", handleWebhook)
+	}
+	mux.HandleFunc("/readyz", readyzHandler(cli))
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			logError("HTTP server stopped: %v", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+)
+
+func TestStatusAfterCheck(t *testing.T) {
+	d, cli := withUpdate(t)
+	d.addImage("sha256:redis", "2024-01-01T00:00:00Z", "redis:7")
+	d.publish("redis:latest", "sha256:redis")
+	d.addContainer(testContainer("cache-id", "cache", "redis:7", "sha256:redis"))
+
+	old := status
+	status = &statusTracker{}
+	defer func() { status = old }()
+
+	status.startCycle()
+	status.finishCycle(checkContainers(cli, "", "", "", "", NoopNotifier{}))
+
+	rec := httptest.NewRecorder()
+	handleStatus(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status code = %d", rec.Code)
+	}
+	var resp statusResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode /status: %v", err)
+	}
+	if resp.LastCheck == nil {
+		t.Error("lastCheck is not set")
+	}
+	if resp.LastError != "" {
+		t.Errorf("lastError = %q", resp.LastError)
+	}
+	if resp.EligibleContainers != 2 || resp.UpdatedContainers != 1 || resp.FailedContainers != 0 {
+		t.Errorf("eligible/updated/failed = %d/%d/%d, want 2/1/0", resp.EligibleContainers, resp.UpdatedContainers, resp.FailedContainers)
+	}
+	if len(resp.RecentUpdates) != 1 || resp.RecentUpdates[0].Name != "web" {
+		t.Errorf("recentUpdates = %+v, want web", resp.RecentUpdates)
+	}
+}
+
+func TestStatusRejectsOtherMethods(t *testing.T) {
+	rec := httptest.NewRecorder()
+	handleStatus(rec, httptest.NewRequest(http.MethodPost, "/status", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /status = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+// fakePinger answers /readyz pings with err.
+type fakePinger struct{ err error }
+
+func (p fakePinger) Ping(ctx context.Context) (types.Ping, error) {
+	return types.Ping{APIVersion: "1.43"}, p.err
+}
+
+func TestReadyz(t *testing.T) {
+	tests := []struct {
+		name string
+		cli  daemonPinger
+		want int
+	}{
+		{"daemon answers", fakePinger{}, http.StatusOK},
+		{"daemon down", fakePinger{err: errors.New("connection refused")}, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := status
+			status = &statusTracker{}
+			defer func() { status = old }()
+
+			rec := httptest.NewRecorder()
+			readyzHandler(tt.cli).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if rec.Code != tt.want {
+				t.Errorf("GET /readyz = %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			if pinged := !status.lastPing.IsZero(); pinged != (tt.want == http.StatusOK) {
+				t.Errorf("last ping recorded = %v", pinged)
+			}
+		})
+	}
+}
+
+func TestReadyzAgainstDaemon(t *testing.T) {
+	d, cli := newFakeDocker(t)
+	rec := httptest.NewRecorder()
+	readyzHandler(cli).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("GET /readyz = %d, want 200", rec.Code)
+	}
+
+	d.fail("GET /_ping", http.StatusInternalServerError)
+	d.fail("HEAD /_ping", http.StatusInternalServerError)
+	rec = httptest.NewRecorder()
+	readyzHandler(cli).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("GET /readyz with a failing daemon = %d, want 503", rec.Code)
+	}
+}
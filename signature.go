@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/client"
+)
+
+// rejectedImages maps containers to the image ID whose signature failed to
+// verify, so a rejected image is only reported once.
+var rejectedImages = make(map[string]string)
+
+// validateSignatureConfig checks that -verify-signatures has either a key or
+// a keyless identity and issuer to verify against, and that cosign exists.
+func validateSignatureConfig() error {
+	keyless := *cosignIdentity != "" || *cosignIssuer != ""
+	switch {
+	case *cosignKey != "" && keyless:
+		return errors.New("-cosign-key cannot be combined with -cosign-identity and -cosign-issuer")
+	case *cosignKey == "" && !keyless:
+		return errors.New("set -cosign-key, or -cosign-identity and -cosign-issuer for keyless signatures")
+	case keyless && (*cosignIdentity == "" || *cosignIssuer == ""):
+		return errors.New("keyless verification needs both -cosign-identity and -cosign-issuer")
+	}
+	if _, err := exec.LookPath("cosign"); err != nil {
+		return fmt.Errorf("cosign not found: %w", err)
+	}
+	return nil
+}
+
+// verifySignature runs cosign verify against the registry digest of image,
+// so the signature checked is the one of the exact image that was pulled.
+func verifySignature(cli *client.Client, ctx context.Context, image string) error {
+	ref, err := pinnedReference(cli, ctx, image)
+	if err != nil {
+		return err
+	}
+	args := []string{"verify", "--output", "text"}
+	if *cosignKey != "" {
+		args = append(args, "--key", *cosignKey)
+	} else {
+		args = append(args, "--certificate-identity-regexp", *cosignIdentity, "--certificate-oidc-issuer", *cosignIssuer)
+	}
+	args = append(args, ref)
+
+	ctx, cancel := withAPITimeout(ctx)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "cosign", args...)
+	cmd.Env = os.Environ()
+	if *dockerConfigPath != "" {
+		dir := *dockerConfigPath
+		if info, err := os.Stat(dir); err == nil && !info.IsDir() {
+			dir = filepath.Dir(dir)
+		}
+		cmd.Env = append(cmd.Env, "DOCKER_CONFIG="+dir)
+	}
+	logVerbose("Running cosign %s", strings.Join(args, " "))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("cosign verify %s failed: %w: %s", ref, err, strings.TrimSpace(string(out)))
+	}
+	logVerbose("Verified signature of %s", ref)
+	return nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// containerState is what the puller last observed for a container.
+type containerState struct {
+	ImageID      string    `json:"imageId"`
+	Created      string    `json:"created,omitempty"`
+	RemoteDigest string    `json:"remoteDigest,omitempty"`
+	CheckedAt    time.Time `json:"checkedAt"`
+	// History lists the images the container ran before its updates, most
+	// recent first, as rollback targets.
+	History []string `json:"history,omitempty"`
+	// BadImages lists images that failed the health check after an update
+	// and are not adopted again.
+	BadImages []string `json:"badImages,omitempty"`
+}
+
+// stateStore persists the last-seen image per container across restarts.
+// A nil store is valid and simply remembers nothing.
+type stateStore struct {
+	mu         sync.Mutex
+	path       string
+	Containers map[string]containerState `json:"containers"`
+}
+
+var state *stateStore
+
+// loadState reads the state file at path. A missing or corrupt file yields
+// an empty store.
+func loadState(path string) (*stateStore, error) {
+	s := &stateStore{path: path, Containers: make(map[string]containerState)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		// A damaged state file only costs some redundant work, so keep it
+		// aside for inspection and start over instead of refusing to run.
+		logWarn("State file %s is corrupt, starting with empty state: %v", path, err)
+		if err := os.Rename(path, path+".corrupt"); err != nil {
+			logWarn("Failed to move corrupt state file aside: %v", err)
+		}
+		return &stateStore{path: path, Containers: make(map[string]containerState)}, nil
+	}
+	if s.Containers == nil {
+		s.Containers = make(map[string]containerState)
+	}
+	return s, nil
+}
+
+// knownDigest returns the remote digest recorded for name, provided the
+// container still runs the image it was recorded against.
+func (s *stateStore) knownDigest(name, imageID string) string {
+	if s == nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cs, ok := s.Containers[name]; ok && cs.ImageID == imageID {
+		return cs.RemoteDigest
+	}
+	return ""
+}
+
+// record stores the image a container was found running. An empty digest
+// keeps the previously known one if the image did not change.
+func (s *stateStore) record(name, imageID, created, digest string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev, ok := s.Containers[name]
+	if ok && digest == "" && prev.ImageID == imageID {
+		digest = prev.RemoteDigest
+	}
+	s.Containers[name] = containerState{
+		ImageID:      imageID,
+		Created:      created,
+		RemoteDigest: digest,
+		CheckedAt:    time.Now(),
+		History:      prev.History,
+		BadImages:    prev.BadImages,
+	}
+}
+
+// pushHistory records imageID as the most recent image name ran before an
+// update, keeping at most limit entries. It returns the images dropped from
+// the history.
+func (s *stateStore) pushHistory(name, imageID string, limit int) []string {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cs := s.Containers[name]
+	history := []string{imageID}
+	var dropped []string
+	for _, id := range cs.History {
+		switch {
+		case id == imageID:
+		case len(history) < limit:
+			history = append(history, id)
+		default:
+			dropped = append(dropped, id)
+		}
+	}
+	cs.History = history
+	s.Containers[name] = cs
+	return dropped
+}
+
+// history returns the rollback targets recorded for name, most recent first.
+func (s *stateStore) history(name string) []string {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.Containers[name].History...)
+}
+
+// markBad records that imageID failed the health check for name, keeping
+// only the limit most recent bad images.
+func (s *stateStore) markBad(name, imageID string, limit int) {
+	if s == nil || imageID == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cs := s.Containers[name]
+	for _, id := range cs.BadImages {
+		if id == imageID {
+			return
+		}
+	}
+	cs.BadImages = append(cs.BadImages, imageID)
+	if len(cs.BadImages) > limit {
+		cs.BadImages = append([]string(nil), cs.BadImages[len(cs.BadImages)-limit:]...)
+	}
+	s.Containers[name] = cs
+}
+
+// isBad reports whether imageID failed the health check for name before.
+func (s *stateStore) isBad(name, imageID string) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range s.Containers[name].BadImages {
+		if id == imageID {
+			return true
+		}
+	}
+	return false
+}
+
+// save atomically rewrites the state file via a temporary file and rename.
+// A store without a path is kept in memory only.
+func (s *stateStore) save() error {
+	if s == nil || s.path == "" {
+		return nil
+	}
+	s.mu.Lock()
+	data, err := json.MarshalIndent(s, "", "  ")
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(s.path, data)
+}
+
+// writeFileAtomic replaces path with data through a synced temporary file, so
+// readers never see a partially written file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
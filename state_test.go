@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	s, err := loadState(path)
+	if err != nil {
+		t.Fatalf("loadState of a missing file: %v", err)
+	}
+	if len(s.Containers) != 0 {
+		t.Fatalf("missing file loaded %d containers", len(s.Containers))
+	}
+
+	s.record("web", oldImageID, "2024-01-01T00:00:00Z", testDigest)
+	s.pushHistory("web", "sha256:previous", 2)
+	if err := s.save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	loaded, err := loadState(path)
+	if err != nil {
+		t.Fatalf("loadState: %v", err)
+	}
+	if got := loaded.knownDigest("web", oldImageID); got != testDigest {
+		t.Errorf("knownDigest = %q, want %q", got, testDigest)
+	}
+	if got := loaded.knownDigest("web", newImageID); got != "" {
+		t.Errorf("knownDigest for another image = %q, want none", got)
+	}
+	if got := loaded.history("web"); len(got) != 1 || got[0] != "sha256:previous" {
+		t.Errorf("history = %v, want [sha256:previous]", got)
+	}
+
+	// No temporary files are left behind by the atomic write.
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("state directory holds %d files, want only the state file", len(entries))
+	}
+}
+
+func TestLoadCorruptState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(path, []byte(`{"containers": {"web": `), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := loadState(path)
+	if err != nil {
+		t.Fatalf("loadState of a corrupt file: %v", err)
+	}
+	if len(s.Containers) != 0 {
+		t.Errorf("corrupt file loaded %d containers", len(s.Containers))
+	}
+	if _, err := os.Stat(path + ".corrupt"); err != nil {
+		t.Errorf("corrupt file was not moved aside: %v", err)
+	}
+
+	// The fresh state is written to the original path.
+	s.record("web", oldImageID, "", "")
+	if err := s.save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if loaded, err := loadState(path); err != nil || len(loaded.Containers) != 1 {
+		t.Errorf("reloaded state: %v, %v", loaded, err)
+	}
+}
+
+func TestNilStateIsUsable(t *testing.T) {
+	var s *stateStore
+	s.record("web", oldImageID, "", testDigest)
+	if got := s.knownDigest("web", oldImageID); got != "" {
+		t.Errorf("nil store knows digest %q", got)
+	}
+	if err := s.save(); err != nil {
+		t.Errorf("save on nil store: %v", err)
+	}
+}
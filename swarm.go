@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+// swarmServiceLabel marks containers that are tasks of a Swarm service. They
+// belong to the orchestrator and are never recreated directly.
+const swarmServiceLabel = "com.docker.swarm.service.id"
+
+// detectSwarm reports whether the daemon is part of an active swarm and
+// whether it is a manager, which is required to update services.
+func detectSwarm(cli *client.Client, ctx context.Context) (active, manager bool, err error) {
+	infoCtx, cancel := withAPITimeout(ctx)
+	defer cancel()
+	info, err := cli.Info(infoCtx)
+	if err != nil {
+		return false, false, err
+	}
+	return info.Swarm.LocalNodeState == swarm.LocalNodeStateActive, info.Swarm.ControlAvailable, nil
+}
+
+// serviceAPI is the part of the Docker client checkServices uses.
+type serviceAPI interface {
+	ServiceList(ctx context.Context, options types.ServiceListOptions) ([]swarm.Service, error)
+	ServiceUpdate(ctx context.Context, serviceID string, version swarm.Version, service swarm.ServiceSpec, options types.ServiceUpdateOptions) (types.ServiceUpdateResponse, error)
+}
+
+// validateSwarmFlags rejects flags that only apply to standalone containers,
+// which -swarm would otherwise silently ignore.
+func validateSwarmFlags() error {
+	containerOnly := []struct {
+		name string
+		set  bool
+	}{
+		{"compose-project", *composeProject != ""},
+		{"compose-safe", *composeSafe},
+		{"state-file", *stateFile != ""},
+		{"rollback", *rollback},
+		{"health-timeout", *healthTimeout > 0},
+		{"cleanup", *cleanup},
+		{"keep-images", *keepImages > 0},
+		{"verify-signatures", *verifySignatures},
+		{"tag-map", *tagMapSpec != ""},
+	}
+	for _, f := range containerOnly {
+		if f.set {
+			return fmt.Errorf("-%s only applies to standalone containers and cannot be combined with -swarm", f.name)
+		}
+	}
+	return nil
+}
+
+// selectServices drops services excluded by labels, -containers or the name,
+// repository and prefix filters.
+func selectServices(services []swarm.Service) []swarm.Service {
+	var selected []swarm.Service
+	found := make(map[string]bool)
+	for _, svc := range services {
+		name := svc.Spec.Name
+		if svc.Spec.TaskTemplate.ContainerSpec == nil {
+			continue
+		}
+		if allowedNames != nil {
+			if !allowedNames[name] {
+				continue
+			}
+			found[name] = true
+		}
+		specImage := svc.Spec.TaskTemplate.ContainerSpec.Image
+		if !isTargeted(specImage) {
+			continue
+		}
+		if isIgnored(svc.Spec.Labels) {
+			logVerbose("Skipping service %s: excluded by ignore label", name)
+			continue
+		}
+		if !matchesNameFilters(name) || !matchesRepoFilters(specImage) {
+			logVerbose("Skipping service %s: excluded by filters", name)
+			continue
+		}
+		if len(imagePrefixes) > 0 && !hasImagePrefix(specImage) {
+			logVerbose("Skipping service %s: image does not start with any -image-prefix", name)
+			continue
+		}
+		selected = append(selected, svc)
+	}
+	for name := range allowedNames {
+		if !found[name] {
+			logWarn("Service %s from -containers not found", name)
+		}
+	}
+	return selected
+}
+
+// checkServices is the swarm counterpart of checkContainers. It checks the
+// image of every selected service, pulling it through images unless registry
+// is set for -head-check, and lets Swarm roll out updates through
+// ServiceUpdate instead of recreating containers itself. Updates pass the
+// same gates as container updates.
+func checkServices(cli serviceAPI, images *client.Client, registry digestResolver, authConfig types.AuthConfig, notifier Notifier) error {
+	ctx := context.Background()
+	if *cycleTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *cycleTimeout)
+		defer cancel()
+	}
+	started := time.Now()
+	report := newCycleReport()
+	notifyEvent(ctx, notifier, Event{Type: eventStart, Message: "Check started"})
+
+	opts := types.ServiceListOptions{}
+	if *labelEnable {
+		opts.Filters = filters.NewArgs(filters.Arg("label", *enableLabel+"=true"))
+	}
+	listCtx, cancel := withAPITimeout(ctx)
+	services, err := cli.ServiceList(listCtx, opts)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("error listing services: %v", err)
+	}
+	selected := selectServices(services)
+
+	checked, updated, failed := len(selected), 0, 0
+	// Services excluded by filters count as skipped, as containers do.
+	skipped := len(services) - len(selected)
+	skip := func(result containerResult) {
+		skipped++
+		result.Action = actionSkipped
+		report.add(result)
+	}
+	var updatedNames []string
+	byID := make(map[string]swarm.Service, len(selected))
+	var pending []pendingUpdate
+	cache := newPullCache()
+
+	var cycleErr error
+	for i, svc := range selected {
+		if ctx.Err() != nil {
+			cycleErr = fmt.Errorf("cycle timeout of %s exceeded, %d services left unchecked", *cycleTimeout, len(selected)-i)
+			break
+		}
+		name := svc.Spec.Name
+		specImage := svc.Spec.TaskTemplate.ContainerSpec.Image
+		result := containerResult{Name: name, Image: specImage, OldImageID: specDigest(specImage)}
+		if rateLimited() {
+			deferForRateLimit(ctx, notifier, "service "+name)
+			skip(result)
+			continue
+		}
+
+		newRef, err := checkServiceImage(ctx, images, registry, cache, svc, authConfig)
+		if errors.Is(err, errRateLimited) {
+			deferForRateLimit(ctx, notifier, "service "+name)
+			skip(result)
+			continue
+		}
+		if err != nil {
+			logError("Error checking service %s: %v", name, err)
+			failed++
+			result.Action, result.Error = actionError, err.Error()
+			report.add(result)
+			if *failFast {
+				cycleErr = fmt.Errorf("aborting cycle after service %s failed: %w", name, err)
+				break
+			}
+			continue
+		}
+		if newRef == "" {
+			logVerbose("No updates needed for service %s", name)
+			skip(result)
+			continue
+		}
+		result.NewImageID = specDigest(newRef)
+		byID[svc.ID] = svc
+		pending = append(pending, pendingUpdate{id: svc.ID, name: name, labels: svc.Spec.Labels, oldImage: specImage, newImage: newRef, result: result})
+	}
+
+	if *failFast && cycleErr != nil {
+		// Nothing is rolled out in a cycle aborted by -fail-fast.
+		for _, p := range pending {
+			skip(p.result)
+		}
+		pending = nil
+	}
+
+	for _, p := range gateUpdates(ctx, pending, notifier, skip) {
+		logUpdate("Updating service %s to %s", p.name, p.newImage)
+		if err := updateServiceImage(cli, ctx, byID[p.id], p.newImage, authConfig); err != nil {
+			msg := fmt.Sprintf("Error updating service %s: %v", p.name, err)
+			logError(msg)
+			notifyEvent(ctx, notifier, p.event(eventError, msg))
+			failed++
+			p.result.Action, p.result.Error = actionError, err.Error()
+			report.add(p.result)
+			if *failFast {
+				cycleErr = fmt.Errorf("aborting cycle after service %s failed: %w", p.name, err)
+				break
+			}
+			continue
+		}
+		delete(serviceBaselines, p.id)
+		msg := fmt.Sprintf("Successfully updated service %s", p.name)
+		logUpdate(msg)
+		notifyEvent(ctx, notifier, p.event(eventUpdate, msg))
+		p.result.Action = actionUpdated
+		report.add(p.result)
+		updated++
+		updatedNames = append(updatedNames, p.name)
+	}
+
+	if err := report.write(); err != nil {
+		logWarn("Failed to write report file: %v", err)
+	}
+	if err := report.writeSummary(checked, checked, updated, skipped, failed, time.Since(started)); err != nil {
+		logWarn("Failed to write JSON summary: %v", err)
+	}
+	status.recordContainers(checked, updatedNames, failed)
+	if updated > 0 {
+		logInfo("Check completed: %d services updated, %d skipped", updated, skipped)
+	} else {
+		logVerbose("Check completed: no updates needed for %d services", checked)
+	}
+	notifyEvent(ctx, notifier, Event{Type: eventComplete, Message: fmt.Sprintf("Check completed: %d services checked, %d updated", checked, updated)})
+	sendCycleSummary(ctx, notifier, checked, updated, skipped, failed, time.Since(started))
+
+	if cycleErr == nil && failed > 0 {
+		cycleErr = fmt.Errorf("%d of %d services failed", failed, checked)
+	}
+	return cycleErr
+}
+
+// specDigest returns the digest an image reference is pinned to, if any.
+func specDigest(image string) string {
+	if _, digest, ok := strings.Cut(image, "@"); ok {
+		return digest
+	}
+	return ""
+}
+
+// serviceBaselines remembers the digest a service runs when its spec is not
+// pinned to one, as resolved by its first check.
+var serviceBaselines = make(map[string]string)
+
+// checkServiceImage returns the digest-qualified reference a service should
+// be rolled out to, or "" when it already runs the newest image of its tag.
+// The image is checked like a container's: pulled through
+// pullImageAndCheckUpdate, or with -head-check (registry set) by comparing
+// registry digests without pulling. A service whose current digest cannot be
+// resolved only records the newest one as its baseline, so it is not rolled
+// out until the tag moves.
+func checkServiceImage(ctx context.Context, images *client.Client, registry digestResolver, cache *pullCache, svc swarm.Service, authConfig types.AuthConfig) (string, error) {
+	specImage := svc.Spec.TaskTemplate.ContainerSpec.Image
+	named, err := reference.ParseNormalizedNamed(specImage)
+	if err != nil {
+		return "", fmt.Errorf("parse image %q: %w", specImage, err)
+	}
+	tagged := reference.TagNameOnly(reference.TrimNamed(named))
+	if t, ok := named.(reference.Tagged); ok {
+		tagged, _ = reference.WithTag(reference.TrimNamed(named), t.Tag())
+	}
+	tagRef := reference.FamiliarString(tagged)
+	running := currentServiceDigest(ctx, images, svc.ID, named)
+
+	digest := ""
+	if registry != nil {
+		d, changed, err := checkRegistryDigest(ctx, registry, tagRef, []string{running})
+		switch {
+		case errors.Is(err, errRateLimited):
+			return "", err
+		case err != nil:
+			logVerbose("Manifest check failed for %s, falling back to pull: %v", tagRef, err)
+		case !changed:
+			return "", nil
+		default:
+			digest = d
+		}
+	}
+	if digest == "" {
+		currentID := ""
+		if running != "" {
+			inspectCtx, cancel := withAPITimeout(ctx)
+			if img, _, err := images.ImageInspectWithRaw(inspectCtx, named.Name()+"@"+running); err == nil {
+				currentID = img.ID
+			}
+			cancel()
+		}
+		_, updated, err := pullImageAndCheckUpdate(images, ctx, tagRef, authConfig, "", "service "+svc.Spec.Name, currentID, cache)
+		if err != nil {
+			return "", err
+		}
+		if currentID != "" && !updated {
+			return "", nil
+		}
+		pinned, err := pinnedReference(images, ctx, tagRef)
+		if err != nil {
+			return "", err
+		}
+		digest = specDigest(pinned)
+	}
+
+	if running == "" {
+		serviceBaselines[svc.ID] = digest
+		logVerbose("Service %s is not pinned to a digest, recording %s as its current image", svc.Spec.Name, digest)
+		return "", nil
+	}
+	if digest == running {
+		return "", nil
+	}
+	return tagRef + "@" + digest, nil
+}
+
+// currentServiceDigest returns the digest a service runs: the one pinned in
+// its spec, the baseline recorded by an earlier check, or the registry digest
+// of the local image of its tag, which becomes the baseline. It returns ""
+// when none is known.
+func currentServiceDigest(ctx context.Context, images *client.Client, id string, named reference.Named) string {
+	if d, ok := named.(reference.Digested); ok {
+		return d.Digest().String()
+	}
+	if digest := serviceBaselines[id]; digest != "" {
+		return digest
+	}
+	inspectCtx, cancel := withAPITimeout(ctx)
+	img, _, err := images.ImageInspectWithRaw(inspectCtx, reference.FamiliarString(reference.TagNameOnly(named)))
+	cancel()
+	if err != nil {
+		return ""
+	}
+	for _, rd := range img.RepoDigests {
+		digested, err := reference.ParseNormalizedNamed(rd)
+		if err != nil || digested.Name() != named.Name() {
+			continue
+		}
+		if d, ok := digested.(reference.Digested); ok {
+			serviceBaselines[id] = d.Digest().String()
+			return serviceBaselines[id]
+		}
+	}
+	return ""
+}
+
+// updateServiceImage points the service at image and lets Swarm perform the
+// rolling update according to the service's own update config.
+func updateServiceImage(cli serviceAPI, ctx context.Context, svc swarm.Service, image string, authConfig types.AuthConfig) error {
+	spec := svc.Spec
+	containerSpec := *spec.TaskTemplate.ContainerSpec
+	containerSpec.Image = image
+	spec.TaskTemplate.ContainerSpec = &containerSpec
+
+	opts := types.ServiceUpdateOptions{}
+	if authConfig = authFor(image, currentAuth(authConfig)); hasCredentials(authConfig) {
+		opts.EncodedRegistryAuth = encodeAuth(authConfig)
+	}
+	updateCtx, cancel := withAPITimeout(ctx)
+	defer cancel()
+	resp, err := cli.ServiceUpdate(updateCtx, svc.ID, svc.Version, spec, opts)
+	if err != nil {
+		return err
+	}
+	for _, w := range resp.Warnings {
+		logWarn("Service %s: %s", svc.Spec.Name, w)
+	}
+	return nil
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+// fakeDigests resolves images from a fixed map, as the registry would.
+type fakeDigests map[string]string
+
+func (f fakeDigests) manifestDigest(_ context.Context, image string) (string, error) {
+	if digest, ok := f[image]; ok {
+		return digest, nil
+	}
+	return "", fmt.Errorf("manifest for %s not found", image)
+}
+
+// withBaselines gives a test its own service baselines.
+func withBaselines(t *testing.T) {
+	t.Helper()
+	old := serviceBaselines
+	serviceBaselines = make(map[string]string)
+	t.Cleanup(func() { serviceBaselines = old })
+}
+
+func TestCheckServiceImageHeadCheck(t *testing.T) {
+	const current = "sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	const published = "sha256:bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+	registry := fakeDigests{"nginx:1.25": published, "registry.example.com:5000/team/api:latest": current, "myorg/local:1": current}
+
+	tests := []struct {
+		name      string
+		specImage string
+		want      string
+		wantErr   bool
+	}{
+		{"new digest", "nginx:1.25@" + current, "nginx:1.25@" + published, false},
+		{"up to date", "registry.example.com:5000/team/api:latest@" + current, "", false},
+		{"default tag", "registry.example.com:5000/team/api@" + current, "", false},
+		{"unpinned spec without local image", "nginx:1.25", "", false},
+		{"unpinned spec with local image", "myorg/local:1", "", false},
+		{"unknown image", "missing/app:1", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withBaselines(t)
+			d, images := newFakeDocker(t)
+			d.addImage(oldImageID, "2024-01-01T00:00:00Z", "myorg/local:1")
+			d.images[oldImageID] = withRepoDigests(d.images[oldImageID], "myorg/local@"+current)
+
+			svc := testService("svc", tt.name, tt.specImage)
+			got, err := checkServiceImage(context.Background(), images, registry, newPullCache(), svc, types.AuthConfig{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkServiceImage(%q) error = %v, wantErr %v", tt.specImage, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("checkServiceImage(%q) = %q, want %q", tt.specImage, got, tt.want)
+			}
+			if d.called("POST /images/create") != (tt.name == "unknown image") {
+				t.Errorf("pulled = %v, want a pull only when the registry check fails", d.called("POST /images/create"))
+			}
+		})
+	}
+}
+
+func withRepoDigests(img types.ImageInspect, repoDigests ...string) types.ImageInspect {
+	img.RepoDigests = repoDigests
+	return img
+}
+
+// withServiceImages returns a node on which nginx:1.25 pulls newImageID,
+// published under publishedDigest, while oldImageID has runningDigest.
+func withServiceImages(t *testing.T) (*fakeDocker, *client.Client) {
+	t.Helper()
+	withBaselines(t)
+	d, images := newFakeDocker(t)
+	d.addImage(oldImageID, "2024-01-01T00:00:00Z")
+	d.addImage(newImageID, "2024-02-01T00:00:00Z")
+	d.images[oldImageID] = withRepoDigests(d.images[oldImageID], "nginx@"+runningDigest)
+	d.images[newImageID] = withRepoDigests(d.images[newImageID], "nginx@"+publishedDigest)
+	d.publish("nginx:1.25", newImageID)
+	return d, images
+}
+
+func TestCheckServiceImagePulls(t *testing.T) {
+	t.Run("new image", func(t *testing.T) {
+		_, images := withServiceImages(t)
+		svc := testService("svc-web", "web", "nginx:1.25@"+runningDigest)
+		got, err := checkServiceImage(context.Background(), images, nil, newPullCache(), svc, types.AuthConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "nginx:1.25@" + publishedDigest; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("up to date", func(t *testing.T) {
+		d, images := withServiceImages(t)
+		d.publish("nginx:1.25", oldImageID)
+		svc := testService("svc-web", "web", "nginx:1.25@"+runningDigest)
+		got, err := checkServiceImage(context.Background(), images, nil, newPullCache(), svc, types.AuthConfig{})
+		if err != nil || got != "" {
+			t.Errorf("got %q, %v, want no update", got, err)
+		}
+		if !d.called("POST /images/create") {
+			t.Error("the service image was not pulled")
+		}
+	})
+
+	t.Run("unpinned spec with local image", func(t *testing.T) {
+		d, images := withServiceImages(t)
+		d.addImage(oldImageID, "2024-01-01T00:00:00Z", "nginx:1.25")
+		svc := testService("svc-web", "web", "nginx:1.25")
+		got, err := checkServiceImage(context.Background(), images, nil, newPullCache(), svc, types.AuthConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "nginx:1.25@" + publishedDigest; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("unpinned spec records a baseline", func(t *testing.T) {
+		d, images := withServiceImages(t)
+		d.publish("nginx:1.25", oldImageID)
+		svc := testService("svc-web", "web", "nginx:1.25")
+		got, err := checkServiceImage(context.Background(), images, nil, newPullCache(), svc, types.AuthConfig{})
+		if err != nil || got != "" {
+			t.Fatalf("first check: got %q, %v, want no update", got, err)
+		}
+		if serviceBaselines["svc-web"] != runningDigest {
+			t.Fatalf("baseline = %q, want %s", serviceBaselines["svc-web"], runningDigest)
+		}
+
+		// The tag moves: the service is rolled out once.
+		d.publish("nginx:1.25", newImageID)
+		got, err = checkServiceImage(context.Background(), images, nil, newPullCache(), svc, types.AuthConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "nginx:1.25@" + publishedDigest; got != want {
+			t.Errorf("after the tag moved: got %q, want %q", got, want)
+		}
+	})
+}
+
+// fakeServices is a Swarm manager holding services, recording updates.
+type fakeServices struct {
+	services  []swarm.Service
+	updateErr error
+	lists     int
+	updates   []serviceUpdate
+}
+
+type serviceUpdate struct {
+	id      string
+	version swarm.Version
+	image   string
+	auth    string
+}
+
+func (f *fakeServices) ServiceList(_ context.Context, _ types.ServiceListOptions) ([]swarm.Service, error) {
+	f.lists++
+	return f.services, nil
+}
+
+func (f *fakeServices) ServiceUpdate(_ context.Context, id string, version swarm.Version, spec swarm.ServiceSpec, opts types.ServiceUpdateOptions) (types.ServiceUpdateResponse, error) {
+	f.updates = append(f.updates, serviceUpdate{id: id, version: version, image: spec.TaskTemplate.ContainerSpec.Image, auth: opts.EncodedRegistryAuth})
+	return types.ServiceUpdateResponse{}, f.updateErr
+}
+
+func testService(id, name, image string) swarm.Service {
+	svc := swarm.Service{ID: id}
+	svc.Version.Index = 7
+	svc.Spec.Name = name
+	svc.Spec.TaskTemplate.ContainerSpec = &swarm.ContainerSpec{Image: image}
+	return svc
+}
+
+const (
+	runningDigest   = "sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	publishedDigest = "sha256:bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+)
+
+// withServices returns a manager running web, which has a new image, and
+// api, which is up to date, with the registry digests -head-check sees and
+// a node without local images.
+func withServices(t *testing.T) (*fakeServices, fakeDigests, *client.Client) {
+	t.Helper()
+	withBaselines(t)
+	oldAllowed := allowedNames
+	allowedNames = nil
+	t.Cleanup(func() { allowedNames = oldAllowed })
+	cli := &fakeServices{services: []swarm.Service{
+		testService("svc-web", "web", "nginx:1.25@"+runningDigest),
+		testService("svc-api", "api", "myorg/api:2@"+runningDigest),
+	}}
+	_, images := newFakeDocker(t)
+	return cli, fakeDigests{"nginx:1.25": publishedDigest, "myorg/api:2": runningDigest}, images
+}
+
+func TestCheckServicesUpdatesChangedServices(t *testing.T) {
+	cli, registry, images := withServices(t)
+	auth := types.AuthConfig{Username: "alice", Password: "secret", ServerAddress: dockerHubServer}
+
+	rec := &recordingNotifier{}
+	if err := checkServices(cli, images, registry, auth, rec); err != nil {
+		t.Fatalf("checkServices: %v", err)
+	}
+	if cli.lists != 1 {
+		t.Errorf("ServiceList called %d times, want 1", cli.lists)
+	}
+	if len(cli.updates) != 1 {
+		t.Fatalf("ServiceUpdate calls = %+v, want one for web", cli.updates)
+	}
+	got := cli.updates[0]
+	if got.id != "svc-web" || got.image != "nginx:1.25@"+publishedDigest {
+		t.Errorf("ServiceUpdate(%s, image %s), want svc-web on the published digest", got.id, got.image)
+	}
+	if got.version.Index != 7 {
+		t.Errorf("ServiceUpdate sent version %d, want the listed 7", got.version.Index)
+	}
+	if a := decodeAuth(t, got.auth); a.Username != "alice" {
+		t.Errorf("ServiceUpdate sent credentials for %q, want alice", a.Username)
+	}
+	var updated bool
+	for _, e := range rec.events {
+		updated = updated || (e.Type == eventUpdate && e.Container == "web")
+	}
+	if !updated {
+		t.Errorf("no update notification for web in %+v", rec.events)
+	}
+}
+
+func TestCheckServicesPullOnly(t *testing.T) {
+	cli, registry, images := withServices(t)
+	old := *pullOnly
+	*pullOnly = true
+	defer func() { *pullOnly = old }()
+
+	rec := &recordingNotifier{}
+	if err := checkServices(cli, images, registry, types.AuthConfig{}, rec); err != nil {
+		t.Fatalf("checkServices: %v", err)
+	}
+	if len(cli.updates) != 0 {
+		t.Errorf("-pull-only rolled out %+v", cli.updates)
+	}
+	var announced bool
+	for _, e := range rec.events {
+		announced = announced || (e.Kind == kindUpdateAvailable && e.Container == "web")
+	}
+	if !announced {
+		t.Errorf("the new image of web was not announced in %+v", rec.events)
+	}
+}
+
+func TestCheckServicesHonoursContainerList(t *testing.T) {
+	cli, registry, images := withServices(t)
+	allowedNames = parseContainerList("api")
+
+	if err := checkServices(cli, images, registry, types.AuthConfig{}, NoopNotifier{}); err != nil {
+		t.Fatalf("checkServices: %v", err)
+	}
+	if len(cli.updates) != 0 {
+		t.Errorf("web is not in -containers but was updated: %+v", cli.updates)
+	}
+}
+
+func TestCheckServicesReportsFailures(t *testing.T) {
+	t.Run("update fails", func(t *testing.T) {
+		cli, registry, images := withServices(t)
+		cli.updateErr = errors.New("update out of sequence")
+		if err := checkServices(cli, images, registry, types.AuthConfig{}, NoopNotifier{}); err == nil {
+			t.Error("checkServices succeeded although the update of web failed")
+		}
+	})
+
+	t.Run("fail fast", func(t *testing.T) {
+		cli, registry, images := withServices(t)
+		// api is checked first and cannot be resolved.
+		cli.services[0], cli.services[1] = cli.services[1], cli.services[0]
+		delete(registry, "myorg/api:2")
+		old := *failFast
+		*failFast = true
+		defer func() { *failFast = old }()
+
+		if err := checkServices(cli, images, registry, types.AuthConfig{}, NoopNotifier{}); err == nil {
+			t.Error("checkServices succeeded although api failed")
+		}
+		if len(cli.updates) != 0 {
+			t.Errorf("services were updated after -fail-fast aborted the cycle: %+v", cli.updates)
+		}
+	})
+}
+
+func TestCheckServicesPullsWithoutHeadCheck(t *testing.T) {
+	cli, _, _ := withServices(t)
+	cli.services = []swarm.Service{testService("svc-web", "web", "nginx:1.25@"+runningDigest)}
+	d, images := withServiceImages(t)
+
+	if err := checkServices(cli, images, nil, types.AuthConfig{}, NoopNotifier{}); err != nil {
+		t.Fatalf("checkServices: %v", err)
+	}
+	if n := d.count("POST /images/create"); n != 1 {
+		t.Errorf("pulled %d times, want once", n)
+	}
+	if len(cli.updates) != 1 || cli.updates[0].image != "nginx:1.25@"+publishedDigest {
+		t.Errorf("ServiceUpdate calls = %+v, want web on the published digest", cli.updates)
+	}
+}
+
+func TestValidateSwarmFlags(t *testing.T) {
+	if err := validateSwarmFlags(); err != nil {
+		t.Fatalf("default flags rejected: %v", err)
+	}
+	oldCleanup, oldState := *cleanup, *stateFile
+	defer func() { *cleanup, *stateFile = oldCleanup, oldState }()
+
+	*cleanup = true
+	if err := validateSwarmFlags(); err == nil || !strings.Contains(err.Error(), "-cleanup") {
+		t.Errorf("-cleanup with -swarm: got %v", err)
+	}
+	*cleanup, *stateFile = false, "/var/lib/puller/state.json"
+	if err := validateSwarmFlags(); err == nil || !strings.Contains(err.Error(), "-state-file") {
+		t.Errorf("-state-file with -swarm: got %v", err)
+	}
+}
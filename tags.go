@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/distribution/reference"
+)
+
+// tagMapping maps the tag a container runs to the tag checked for updates,
+// as configured with -tag-map.
+var tagMapping map[string]string
+
+// parseTagMap parses a comma-separated list of running=checked tag pairs,
+// e.g. "prod=stable,staging=edge".
+func parseTagMap(spec string) (map[string]string, error) {
+	mapping := make(map[string]string)
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(pair, "=")
+		from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("entry %q must be running=checked", pair)
+		}
+		if _, dup := mapping[from]; dup {
+			return nil, fmt.Errorf("tag %q is mapped more than once", from)
+		}
+		mapping[from] = to
+	}
+	return mapping, nil
+}
+
+// imageTag returns the tag of image, "latest" when it has none, or "" when
+// image cannot be parsed.
+func imageTag(image string) string {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return ""
+	}
+	if tagged, ok := reference.TagNameOnly(named).(reference.Tagged); ok {
+		return tagged.Tag()
+	}
+	return ""
+}
+
+// replaceTag returns image with its tag (and any digest) replaced by tag.
+func replaceTag(image, tag string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", fmt.Errorf("parse reference %q: %w", image, err)
+	}
+	tagged, err := reference.WithTag(reference.TrimNamed(named), tag)
+	if err != nil {
+		return "", err
+	}
+	return reference.FamiliarString(tagged), nil
+}
+
+// imageRepo returns the repository of image without its tag or digest, or
+// image unchanged when it cannot be parsed.
+func imageRepo(image string) string {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return image
+	}
+	return reference.FamiliarName(named)
+}
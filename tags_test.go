@@ -0,0 +1,123 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCheckPullsMappedTag(t *testing.T) {
+	old := tagMapping
+	tagMapping = map[string]string{"prod": "stable"}
+	defer func() { tagMapping = old }()
+
+	d, cli := newFakeDocker(t)
+	d.addImage(oldImageID, "2024-01-01T00:00:00Z", "nginx:prod")
+	d.addImage(newImageID, "2024-02-01T00:00:00Z")
+	d.publish("nginx:stable", newImageID)
+	d.publish("nginx:prod", oldImageID)
+	d.addContainer(testContainer("old", "web", "nginx:prod", oldImageID))
+
+	if err := checkContainers(cli, "", "", "", "", NoopNotifier{}); err != nil {
+		t.Fatalf("checkContainers: %v", err)
+	}
+	d.mu.Lock()
+	_, pulledStable := d.pullAuth[normalizeRef("nginx:stable")]
+	_, pulledProd := d.pullAuth[normalizeRef("nginx:prod")]
+	_, pulledLatest := d.pullAuth[normalizeRef("nginx:latest")]
+	prod := d.tags[normalizeRef("nginx:prod")]
+	d.mu.Unlock()
+	if !pulledStable || pulledProd || pulledLatest {
+		t.Errorf("pulled stable/prod/latest = %v/%v/%v, want only the mapped tag", pulledStable, pulledProd, pulledLatest)
+	}
+	if !d.called("POST /images/nginx:stable/tag") {
+		t.Error("the mapped tag was not retagged")
+	}
+	if prod != newImageID {
+		t.Errorf("nginx:prod points to %s, want the pulled %s", prod, newImageID)
+	}
+	recreated := d.container("web")
+	if recreated == nil || recreated.Config.Image != "nginx:prod" || recreated.Image != newImageID {
+		t.Errorf("web not recreated from nginx:prod on the new image: %+v", recreated)
+	}
+}
+
+const pinnedDigest = "sha256:4c0fdaa8b6341bfdeca5f18f7837462c80cff90527ee35ef185571e1c327beac"
+
+func TestReferenceParsing(t *testing.T) {
+	tests := []struct {
+		image    string
+		tag      string // imageTag
+		repo     string // imageRepo
+		replaced string // replaceTag(image, "edge")
+	}{
+		{"registry.example.com:5000/app:latest", "latest", "registry.example.com:5000/app", "registry.example.com:5000/app:edge"},
+		{"registry.example.com:5000/team/app:1.2", "1.2", "registry.example.com:5000/team/app", "registry.example.com:5000/team/app:edge"},
+		{"registry.example.com:5000/app", "latest", "registry.example.com:5000/app", "registry.example.com:5000/app:edge"},
+		{"localhost:5000/app:v1", "v1", "localhost:5000/app", "localhost:5000/app:edge"},
+		{"nginx", "latest", "nginx", "nginx:edge"},
+		{"nginx:1.25", "1.25", "nginx", "nginx:edge"},
+		{"docker.io/library/nginx:1.25", "1.25", "nginx", "nginx:edge"},
+		{"myorg/api", "latest", "myorg/api", "myorg/api:edge"},
+		{"myorg/api@" + pinnedDigest, "", "myorg/api", "myorg/api:edge"},
+		{"registry.example.com:5000/app:1.0@" + pinnedDigest, "1.0", "registry.example.com:5000/app", "registry.example.com:5000/app:edge"},
+	}
+	for _, tt := range tests {
+		if got := imageTag(tt.image); got != tt.tag {
+			t.Errorf("imageTag(%q) = %q, want %q", tt.image, got, tt.tag)
+		}
+		if got := imageRepo(tt.image); got != tt.repo {
+			t.Errorf("imageRepo(%q) = %q, want %q", tt.image, got, tt.repo)
+		}
+		got, err := replaceTag(tt.image, "edge")
+		if err != nil || got != tt.replaced {
+			t.Errorf("replaceTag(%q, edge) = %q, %v, want %q", tt.image, got, err, tt.replaced)
+		}
+	}
+
+	for _, bad := range []string{"", "myorg/API", "registry.example.com:5000/"} {
+		if got := imageTag(bad); got != "" {
+			t.Errorf("imageTag(%q) = %q, want empty", bad, got)
+		}
+		if _, err := replaceTag(bad, "edge"); err == nil {
+			t.Errorf("replaceTag(%q) succeeded", bad)
+		}
+	}
+	if _, err := replaceTag("nginx", "not a tag"); err == nil {
+		t.Error("replaceTag accepted an invalid tag")
+	}
+}
+
+func TestDigestPinnedRepo(t *testing.T) {
+	tests := []struct {
+		image  string
+		repo   string
+		pinned bool
+	}{
+		{"myorg/api@" + pinnedDigest, "myorg/api", true},
+		{"registry.example.com:5000/app@" + pinnedDigest, "registry.example.com:5000/app", true},
+		{"registry.example.com:5000/app:1.0@" + pinnedDigest, "registry.example.com:5000/app", true},
+		{"registry.example.com:5000/app:1.0", "", false},
+		{"nginx", "", false},
+	}
+	for _, tt := range tests {
+		repo, pinned := digestPinnedRepo(tt.image)
+		if repo != tt.repo || pinned != tt.pinned {
+			t.Errorf("digestPinnedRepo(%q) = %q, %v, want %q, %v", tt.image, repo, pinned, tt.repo, tt.pinned)
+		}
+	}
+}
+
+func TestParseTagMap(t *testing.T) {
+	got, err := parseTagMap(" prod=stable, staging = edge ,")
+	if err != nil {
+		t.Fatalf("parseTagMap: %v", err)
+	}
+	if want := map[string]string{"prod": "stable", "staging": "edge"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("parseTagMap = %v, want %v", got, want)
+	}
+	for _, bad := range []string{"prod", "prod=", "=stable", "prod=stable,prod=edge"} {
+		if _, err := parseTagMap(bad); err == nil {
+			t.Errorf("parseTagMap(%q) succeeded", bad)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+)
+
+// eventDebounce is how long the event stream has to stay quiet before a
+// triggered check runs, so a burst of events causes a single check. It is
+// also the delay before resubscribing after the stream fails.
+var eventDebounce = 5 * time.Second
+
+// ownEventWindow is how far apart the puller's own action and the daemon's
+// event for it may be for the event to be recognized as self-caused.
+const ownEventWindow = time.Minute
+
+// eventSource is the part of the Docker client watchDockerEvents uses.
+type eventSource interface {
+	Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error)
+}
+
+// dockerEvents collects the containers and repositories named by Docker
+// events until the main loop picks them up for a targeted check.
+var dockerEvents = struct {
+	mu         sync.Mutex
+	containers map[string]bool
+	repos      map[string]bool
+	// own maps the container IDs and repositories the puller itself just
+	// started or pulled to when it did so.
+	own map[string]time.Time
+}{containers: make(map[string]bool), repos: make(map[string]bool), own: make(map[string]time.Time)}
+
+// targetContainers adds containers by ID to an event-triggered check, which
+// is otherwise restricted to targetRepos.
+var targetContainers map[string]bool
+
+// noteOwnEvent records that the puller caused, or is about to cause, a
+// Docker event for key, a container ID or a repository name, so the event
+// does not trigger another check.
+func noteOwnEvent(key string) {
+	if key == "" {
+		return
+	}
+	now := time.Now()
+	dockerEvents.mu.Lock()
+	defer dockerEvents.mu.Unlock()
+	for k, at := range dockerEvents.own {
+		if now.Sub(at) > ownEventWindow {
+			delete(dockerEvents.own, k)
+		}
+	}
+	dockerEvents.own[key] = now
+}
+
+// queueDockerEvent records the container or repository an event asks to
+// check and reports whether the event calls for a check. Events the puller
+// caused itself are ignored.
+func queueDockerEvent(msg events.Message) bool {
+	key := msg.Actor.ID
+	if msg.Type == events.ImageEventType {
+		key = repositoryName(msg.Actor.ID)
+	}
+	if key == "" {
+		return false
+	}
+	at := time.Unix(msg.Time, 0)
+	if msg.TimeNano != 0 {
+		at = time.Unix(0, msg.TimeNano)
+	}
+
+	dockerEvents.mu.Lock()
+	defer dockerEvents.mu.Unlock()
+	if own, ok := dockerEvents.own[key]; ok {
+		if d := at.Sub(own); d > -ownEventWindow && d < ownEventWindow {
+			return false
+		}
+	}
+	if msg.Type == events.ImageEventType {
+		dockerEvents.repos[key] = true
+	} else {
+		dockerEvents.containers[key] = true
+	}
+	return true
+}
+
+// takeEventTargets returns and clears the containers and repositories queued
+// since the last call.
+func takeEventTargets() (map[string]bool, map[string]bool) {
+	dockerEvents.mu.Lock()
+	defer dockerEvents.mu.Unlock()
+	containers, repos := dockerEvents.containers, dockerEvents.repos
+	dockerEvents.containers, dockerEvents.repos = make(map[string]bool), make(map[string]bool)
+	return containers, repos
+}
+
+// watchDockerEvents follows the daemon event stream and signals trigger when
+// a container starts or an image is pulled by someone other than the puller.
+// It resubscribes when the stream fails and returns when ctx is done.
+func watchDockerEvents(ctx context.Context, src eventSource, trigger chan<- struct{}) {
+	opts := types.EventsOptions{Filters: filters.NewArgs(
+		filters.Arg("type", string(events.ContainerEventType)),
+		filters.Arg("type", string(events.ImageEventType)),
+		filters.Arg("event", "start"),
+		filters.Arg("event", "pull"),
+	)}
+	for {
+		msgs, errs := src.Events(ctx, opts)
+	stream:
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg := <-msgs:
+				actor := msg.Actor.Attributes["name"]
+				if actor == "" {
+					actor = msg.Actor.ID
+				}
+				if !queueDockerEvent(msg) {
+					logVerbose("Ignoring Docker event %s %s %s", msg.Type, msg.Action, actor)
+					continue
+				}
+				logVerbose("Docker event: %s %s %s", msg.Type, msg.Action, actor)
+				select {
+				case trigger <- struct{}{}:
+				default:
+				}
+			case err := <-errs:
+				logWarn("Docker event stream failed, resubscribing: %v", err)
+				break stream
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(eventDebounce):
+		}
+	}
+}
+
+// waitForCheck waits until the next scheduled check is due after d, or until
+// an event arrives on trigger and the stream has then been quiet for
+// eventDebounce. It reports whether an event ended the wait. A nil trigger
+// only waits for d.
+func waitForCheck(d time.Duration, trigger <-chan struct{}) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return false
+	case <-trigger:
+	}
+	for {
+		select {
+		case <-trigger:
+		case <-time.After(eventDebounce):
+			return true
+		}
+	}
+}
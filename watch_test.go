@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+)
+
+// fakeEvents is an event stream fed by the test.
+type fakeEvents struct {
+	msgs chan events.Message
+	errs chan error
+}
+
+func (f *fakeEvents) Events(context.Context, types.EventsOptions) (<-chan events.Message, <-chan error) {
+	return f.msgs, f.errs
+}
+
+// withEventState gives a test empty event queues and a short debounce.
+func withEventState(t *testing.T) {
+	t.Helper()
+	oldDebounce := eventDebounce
+	eventDebounce = 20 * time.Millisecond
+	dockerEvents.mu.Lock()
+	dockerEvents.containers, dockerEvents.repos, dockerEvents.own = make(map[string]bool), make(map[string]bool), make(map[string]time.Time)
+	dockerEvents.mu.Unlock()
+	t.Cleanup(func() {
+		eventDebounce = oldDebounce
+		takeEventTargets()
+	})
+}
+
+func startEvent(id string, at time.Time) events.Message {
+	return events.Message{Type: events.ContainerEventType, Action: "start", Actor: events.Actor{ID: id}, TimeNano: at.UnixNano()}
+}
+
+func pullEvent(ref string, at time.Time) events.Message {
+	return events.Message{Type: events.ImageEventType, Action: "pull", Actor: events.Actor{ID: ref}, TimeNano: at.UnixNano()}
+}
+
+func TestWatchDockerEventsCoalescesBursts(t *testing.T) {
+	withEventState(t)
+	noteOwnEvent("own-id")
+	src := &fakeEvents{msgs: make(chan events.Message), errs: make(chan error)}
+	trigger := make(chan struct{}, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		watchDockerEvents(ctx, src, trigger)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	now := time.Now()
+	for _, msg := range []events.Message{
+		startEvent("web-id", now),
+		startEvent("web-id", now),
+		pullEvent("nginx:latest", now),
+		startEvent("own-id", now),
+		startEvent("api-id", now),
+	} {
+		src.msgs <- msg
+	}
+
+	if !waitForCheck(5*time.Second, trigger) {
+		t.Fatal("events did not trigger a check")
+	}
+	if len(trigger) != 0 {
+		t.Error("the burst triggered more than one check")
+	}
+	containers, repos := takeEventTargets()
+	if want := map[string]bool{"web-id": true, "api-id": true}; !reflect.DeepEqual(containers, want) {
+		t.Errorf("target containers = %v, want %v", containers, want)
+	}
+	if want := map[string]bool{"docker.io/library/nginx": true}; !reflect.DeepEqual(repos, want) {
+		t.Errorf("target repositories = %v, want %v", repos, want)
+	}
+
+	// Only the puller's own events arrive: no check is triggered.
+	src.msgs <- startEvent("own-id", time.Now())
+	if waitForCheck(100*time.Millisecond, trigger) {
+		t.Error("the puller's own event triggered a check")
+	}
+}
+
+func TestQueueDockerEventIgnoresOwnEvents(t *testing.T) {
+	withEventState(t)
+	d, cli := withUpdate(t)
+	if _, err := pullImage(cli, context.Background(), "nginx:latest", types.AuthConfig{}, ""); err != nil {
+		t.Fatalf("pullImage: %v", err)
+	}
+	if err := recreateContainer(cli, context.Background(), "old", "web", ""); err != nil {
+		t.Fatalf("recreateContainer: %v", err)
+	}
+	now := time.Now()
+	if queueDockerEvent(startEvent(d.container("web").ID, now)) {
+		t.Error("start of the recreated container was queued")
+	}
+	if queueDockerEvent(pullEvent("nginx:latest", now)) {
+		t.Error("the puller's own pull was queued")
+	}
+	// The same repository pulled by someone else much later is checked.
+	if !queueDockerEvent(pullEvent("nginx:latest", now.Add(2*ownEventWindow))) {
+		t.Error("a later pull of the same repository was ignored")
+	}
+	if !queueDockerEvent(startEvent("other-id", now)) {
+		t.Error("start of another container was ignored")
+	}
+}
+
+func TestEventTargetsRestrictSelection(t *testing.T) {
+	containers := func() []types.Container {
+		return []types.Container{
+			{ID: "web-id", Names: []string{"/web"}, Image: "nginx:latest", State: "running"},
+			{ID: "api-id", Names: []string{"/api"}, Image: "myorg/api:2", State: "running"},
+			{ID: "cache-id", Names: []string{"/cache"}, Image: "redis:7", State: "running"},
+		}
+	}
+	defer func() { targetContainers, targetRepos = nil, nil }()
+
+	targetContainers, targetRepos = map[string]bool{"api-id": true}, map[string]bool{"docker.io/library/redis": true}
+	var names []string
+	for _, c := range selectContainers(containers()) {
+		names = append(names, containerName(c))
+	}
+	if want := []string{"api", "cache"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("event-triggered check selected %v, want %v", names, want)
+	}
+
+	targetContainers, targetRepos = nil, nil
+	if got := len(selectContainers(containers())); got != 3 {
+		t.Errorf("scheduled check selected %d containers, want 3", got)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/distribution/reference"
+)
+
+const (
+	// webhookSignatureHeader carries the hex HMAC-SHA256 of the request body,
+	// prefixed with "sha256=".
+	webhookSignatureHeader = "X-Hub-Signature-256"
+	// maxWebhookBody bounds the payload read from a webhook request.
+	maxWebhookBody = 1 << 20
+)
+
+// webhookPushes collects the repositories reported by webhooks until the
+// main loop picks them up for a targeted check.
+var webhookPushes = struct {
+	mu     sync.Mutex
+	repos  map[string]bool
+	signal chan struct{}
+}{repos: make(map[string]bool), signal: make(chan struct{}, 1)}
+
+// targetRepos restricts a check to containers running images of these
+// repositories. It is only set for webhook- and event-triggered checks.
+var targetRepos map[string]bool
+
+// queuePush records pushed repositories and wakes the main loop. Pushes
+// arriving while a check runs are merged into the next one.
+func queuePush(repos []string) {
+	webhookPushes.mu.Lock()
+	for _, repo := range repos {
+		webhookPushes.repos[repo] = true
+	}
+	webhookPushes.mu.Unlock()
+	select {
+	case webhookPushes.signal <- struct{}{}:
+	default:
+	}
+}
+
+// takePushes returns and clears the repositories queued since the last call.
+func takePushes() map[string]bool {
+	webhookPushes.mu.Lock()
+	defer webhookPushes.mu.Unlock()
+	repos := webhookPushes.repos
+	webhookPushes.repos = make(map[string]bool)
+	return repos
+}
+
+// isTargeted reports whether image belongs to a repository of the current
+// webhook-triggered check; every image is when no check is targeted.
+func isTargeted(image string) bool {
+	if targetRepos == nil {
+		return true
+	}
+	return targetRepos[repositoryName(image)]
+}
+
+// repositoryName returns the fully qualified repository of an image
+// reference, e.g. docker.io/library/nginx for nginx:latest, or "" if image
+// cannot be parsed.
+func repositoryName(image string) string {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return ""
+	}
+	return named.Name()
+}
+
+// webhookPayload covers the fields of the supported webhook formats that
+// name the pushed repository.
+type webhookPayload struct {
+	// Repository is an object in Docker Hub payloads and a plain name in
+	// generic ones.
+	Repository json.RawMessage `json:"repository"`
+	Repo       string          `json:"repo"`
+	Image      string          `json:"image"`
+	EventData  struct {
+		Resources []struct {
+			ResourceURL string `json:"resource_url"`
+		} `json:"resources"`
+		Repository struct {
+			RepoFullName string `json:"repo_full_name"`
+		} `json:"repository"`
+	} `json:"event_data"`
+}
+
+// pushedRepositories extracts the repositories named in a Docker Hub,
+// Harbor or generic webhook payload.
+func pushedRepositories(body []byte) ([]string, error) {
+	var p webhookPayload
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, err
+	}
+	var names []string
+	// Harbor lists the pushed artifacts with their registry host.
+	for _, r := range p.EventData.Resources {
+		names = append(names, r.ResourceURL)
+	}
+	if len(names) == 0 && p.EventData.Repository.RepoFullName != "" {
+		names = append(names, p.EventData.Repository.RepoFullName)
+	}
+	if len(p.Repository) > 0 {
+		var hub struct {
+			RepoName string `json:"repo_name"`
+		}
+		var plain string
+		if json.Unmarshal(p.Repository, &hub) == nil && hub.RepoName != "" {
+			names = append(names, hub.RepoName)
+		} else if json.Unmarshal(p.Repository, &plain) == nil {
+			names = append(names, plain)
+		}
+	}
+	names = append(names, p.Repo, p.Image)
+
+	seen := make(map[string]bool)
+	var repos []string
+	for _, name := range names {
+		if repo := repositoryName(strings.TrimSpace(name)); repo != "" && !seen[repo] {
+			seen[repo] = true
+			repos = append(repos, repo)
+		}
+	}
+	if len(repos) == 0 {
+		return nil, errors.New("payload names no repository")
+	}
+	sort.Strings(repos)
+	return repos, nil
+}
+
+// validWebhookSignature checks the HMAC-SHA256 of body against the
+// signature header, in constant time.
+func validWebhookSignature(secret string, body []byte, header string) bool {
+	sig, ok := strings.CutPrefix(header, "sha256=")
+	if !ok {
+		return false
+	}
+	got, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// handleWebhook accepts registry push notifications and queues a check of
+// the containers running the pushed repositories.
+func handleWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBody))
+	if err != nil {
+		http.Error(w, "cannot read body", http.StatusBadRequest)
+		return
+	}
+	if secret := os.Getenv("WEBHOOK_SECRET"); secret != "" && !validWebhookSignature(secret, body, r.Header.Get(webhookSignatureHeader)) {
+		logWarn("Rejected webhook from %s: invalid signature", r.RemoteAddr)
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+	repos, err := pushedRepositories(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	logInfo("Webhook reported a push to %s", strings.Join(repos, ", "))
+	queuePush(repos)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(map[string][]string{"repositories": repos}); err != nil {
+		logWarn("Failed to write webhook response: %v", err)
+	}
+}
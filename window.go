@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	_ "time/tzdata" // the alpine runtime image ships without zoneinfo
+)
+
+// updateWindow is a daily time range during which containers may be
+// recreated. Ranges whose end is before the start wrap around midnight.
+type updateWindow struct {
+	spec  string
+	start int // minutes after midnight
+	end   int
+	loc   *time.Location
+}
+
+// maintenanceWindow is set from -update-window; nil means always open.
+var maintenanceWindow *updateWindow
+
+// windowLabel sets a container's own update window, e.g. "02:00-04:00" or
+// "22:00-02:00 Europe/Berlin". It replaces -update-window for the container.
+const windowLabel = "puller.update.window"
+
+// clock returns the time update windows are checked against; tests replace
+// it.
+var clock = time.Now
+
+// deferredUpdates remembers containers whose update was announced while the
+// window was closed, so the announcement is not repeated every cycle.
+var deferredUpdates = make(map[string]bool)
+
+// parseUpdateWindow parses a range such as "02:00-05:00" in the given
+// time zone (empty for the local zone).
+func parseUpdateWindow(spec, tz string) (*updateWindow, error) {
+	from, to, ok := strings.Cut(spec, "-")
+	if !ok {
+		return nil, fmt.Errorf("update window %q must look like HH:MM-HH:MM", spec)
+	}
+	start, err := parseClock(from)
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseClock(to)
+	if err != nil {
+		return nil, err
+	}
+	if start == end {
+		return nil, fmt.Errorf("update window %q is empty", spec)
+	}
+
+	loc := time.Local
+	if tz != "" {
+		if loc, err = time.LoadLocation(tz); err != nil {
+			return nil, fmt.Errorf("invalid time zone %q: %w", tz, err)
+		}
+	}
+	return &updateWindow{spec: spec, start: start, end: end, loc: loc}, nil
+}
+
+// windowFor returns the update window of a container: its window label when
+// set and valid, otherwise -update-window. The label's time zone defaults to
+// -update-window-tz.
+func windowFor(labels map[string]string) *updateWindow {
+	spec := strings.TrimSpace(labels[windowLabel])
+	if spec == "" {
+		return maintenanceWindow
+	}
+	tz := *updateWindowTZ
+	if r, zone, ok := strings.Cut(spec, " "); ok {
+		spec, tz = r, strings.TrimSpace(zone)
+	}
+	w, err := parseUpdateWindow(spec, tz)
+	if err != nil {
+		logWarn("Ignoring %s label %q: %v", windowLabel, labels[windowLabel], err)
+		return maintenanceWindow
+	}
+	return w
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// contains reports whether t falls inside the window. A nil window is
+// always open.
+func (w *updateWindow) contains(t time.Time) bool {
+	if w == nil {
+		return true
+	}
+	t = t.In(w.loc)
+	m := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return m >= w.start && m < w.end
+	}
+	return m >= w.start || m < w.end
+}
+
+func (w *updateWindow) String() string {
+	return fmt.Sprintf("%s (%s)", w.spec, w.loc)
+}
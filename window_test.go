@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUpdateWindowContains(t *testing.T) {
+	at := func(clock string) time.Time {
+		t, _ := time.ParseInLocation("2006-01-02 15:04", "2024-03-01 "+clock, time.UTC)
+		return t
+	}
+	tests := []struct {
+		spec string
+		at   string
+		want bool
+	}{
+		{"02:00-05:00", "02:00", true},
+		{"02:00-05:00", "04:59", true},
+		{"02:00-05:00", "05:00", false},
+		{"02:00-05:00", "01:59", false},
+		{"02:00-05:00", "12:00", false},
+		{"22:00-02:00", "22:00", true},
+		{"22:00-02:00", "23:30", true},
+		{"22:00-02:00", "00:00", true},
+		{"22:00-02:00", "01:59", true},
+		{"22:00-02:00", "02:00", false},
+		{"22:00-02:00", "21:59", false},
+		{"22:00-02:00", "12:00", false},
+	}
+	for _, tt := range tests {
+		w, err := parseUpdateWindow(tt.spec, "UTC")
+		if err != nil {
+			t.Fatalf("parseUpdateWindow(%q): %v", tt.spec, err)
+		}
+		if got := w.contains(at(tt.at)); got != tt.want {
+			t.Errorf("%s at %s: contains = %v, want %v", tt.spec, tt.at, got, tt.want)
+		}
+	}
+
+	// The window is evaluated in its own time zone.
+	w, err := parseUpdateWindow("02:00-05:00", "Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !w.contains(at("01:30")) || w.contains(at("04:30")) {
+		t.Error("02:00-05:00 Europe/Berlin not evaluated in Berlin time")
+	}
+}
+
+func TestCheckHonoursUpdateWindow(t *testing.T) {
+	tests := []struct {
+		name   string
+		window string
+		now    string
+		update bool
+	}{
+		{"inside", "02:00-05:00", "03:00", true},
+		{"outside", "02:00-05:00", "06:00", false},
+		{"across midnight before", "22:00-02:00", "23:00", true},
+		{"across midnight after", "22:00-02:00", "01:00", true},
+		{"across midnight outside", "22:00-02:00", "12:00", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseUpdateWindow(tt.window, "UTC")
+			if err != nil {
+				t.Fatal(err)
+			}
+			oldWindow, oldClock := maintenanceWindow, clock
+			maintenanceWindow = w
+			clock = func() time.Time {
+				t, _ := time.ParseInLocation("2006-01-02 15:04", "2024-03-01 "+tt.now, time.UTC)
+				return t
+			}
+			defer func() {
+				maintenanceWindow, clock = oldWindow, oldClock
+				deferredUpdates = make(map[string]bool)
+			}()
+
+			d, cli := withUpdate(t)
+			if err := checkContainers(cli, "", "", "", "", NoopNotifier{}); err != nil {
+				t.Fatalf("checkContainers: %v", err)
+			}
+			if updated := len(d.created) == 1; updated != tt.update {
+				t.Errorf("%s at %s: updated = %v, want %v", tt.window, tt.now, updated, tt.update)
+			}
+			if deferred := deferredUpdates["old"]; deferred == tt.update {
+				t.Errorf("%s at %s: deferred = %v, want %v", tt.window, tt.now, deferred, !tt.update)
+			}
+		})
+	}
+}